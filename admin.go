@@ -0,0 +1,253 @@
+package barash
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+type queueDepth struct {
+	Length   int `json:"length"`
+	Capacity int `json:"capacity"`
+}
+
+type breakerStatus struct {
+	State               string `json:"state"`
+	Requests            uint32 `json:"requests"`
+	TotalFailures       uint32 `json:"total_failures"`
+	ConsecutiveFailures uint32 `json:"consecutive_failures"`
+}
+
+func (t *apiTarget) breakerStatus() breakerStatus {
+	counts := t.breaker.Counts()
+	return breakerStatus{
+		State:               t.breaker.State().String(),
+		Requests:            counts.Requests,
+		TotalFailures:       counts.TotalFailures,
+		ConsecutiveFailures: counts.ConsecutiveFailures,
+	}
+}
+
+type adminStatus struct {
+	controlState
+	// Breaker of the first target
+	Breaker breakerStatus `json:"breaker"`
+	// Breakers by target name, if there are targets
+	Targets map[string]breakerStatus `json:"targets,omitempty"`
+	Queues  map[string]queueDepth    `json:"queues"`
+	Config  map[string]any           `json:"config"`
+}
+
+type workersRequest struct {
+	Count int `json:"count"`
+}
+
+type rpsRequest struct {
+	RPS float64 `json:"rps"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeAdminJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// validToken reports whether the Authorization header carries the bearer
+// token.
+func validToken(authorization string, token string) bool {
+	provided, ok := strings.CutPrefix(authorization, "Bearer ")
+	return ok && subtle.ConstantTimeCompare(
+		[]byte(provided),
+		[]byte(token),
+	) == 1
+}
+
+// withToken rejects requests without the bearer token.
+func withToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !validToken(req.Header.Get("Authorization"), token) {
+			writeAdminJSON(
+				w,
+				http.StatusUnauthorized,
+				adminError{Error: "invalid token"},
+			)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (r *Runner[S, R, P, Q]) adminStatus() (adminStatus, error) {
+	status := adminStatus{
+		controlState: r.control.state(),
+		Breaker:      r.targets[0].breakerStatus(),
+		Queues: map[string]queueDepth{
+			"tasks": {
+				Length:   len(r.taskQueue),
+				Capacity: cap(r.taskQueue),
+			},
+			"results": {
+				Length:   len(r.resultQueue),
+				Capacity: cap(r.resultQueue),
+			},
+		},
+	}
+	if len(r.config().API.Targets) > 0 {
+		status.Targets = map[string]breakerStatus{}
+		for _, target := range r.targets {
+			status.Targets[target.name] = target.breakerStatus()
+		}
+	}
+	// The configuration is shown with the same keys as in the YAML file
+	data, err := yaml.Marshal(r.config().Redacted())
+	if err != nil {
+		return status, fmt.Errorf("encoding config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &status.Config); err != nil {
+		return status, fmt.Errorf("decoding config: %w", err)
+	}
+	return status, nil
+}
+
+func (r *Runner[S, R, P, Q]) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	writeStatus := func(w http.ResponseWriter) {
+		status, err := r.adminStatus()
+		if err != nil {
+			writeAdminJSON(
+				w,
+				http.StatusInternalServerError,
+				adminError{Error: err.Error()},
+			)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, status)
+	}
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, _ *http.Request) {
+		writeStatus(w)
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, _ *http.Request) {
+		r.control.setPaused(true)
+		zap.S().Infow("fetching is paused with the admin api")
+		writeStatus(w)
+	})
+	mux.HandleFunc(
+		"POST /resume",
+		func(w http.ResponseWriter, _ *http.Request) {
+			r.control.setPaused(false)
+			zap.S().Infow("fetching is resumed with the admin api")
+			writeStatus(w)
+		},
+	)
+	mux.HandleFunc(
+		"POST /workers",
+		func(w http.ResponseWriter, req *http.Request) {
+			var body workersRequest
+			err := json.NewDecoder(req.Body).Decode(&body)
+			if err == nil && body.Count < 1 {
+				err = errors.New("worker count must be positive")
+			}
+			if err != nil {
+				writeAdminJSON(
+					w,
+					http.StatusBadRequest,
+					adminError{Error: err.Error()},
+				)
+				return
+			}
+			r.control.setWorkers(body.Count)
+			zap.S().Infow(
+				"worker count is changed with the admin api",
+				"workers", body.Count,
+			)
+			writeStatus(w)
+		},
+	)
+	mux.HandleFunc("POST /rps", func(w http.ResponseWriter, req *http.Request) {
+		var body rpsRequest
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err == nil && body.RPS < 0 {
+			err = errors.New("rps must not be negative")
+		}
+		if err != nil {
+			writeAdminJSON(
+				w,
+				http.StatusBadRequest,
+				adminError{Error: err.Error()},
+			)
+			return
+		}
+		r.control.setRPS(body.RPS)
+		zap.S().
+			Infow("rps limit is changed with the admin api", "rps", body.RPS)
+		writeStatus(w)
+	})
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, _ *http.Request) {
+		r.control.startDrain()
+		zap.S().Infow("draining is started with the admin api")
+		writeStatus(w)
+	})
+	return withToken(token, mux)
+}
+
+// startAdmin starts the admin HTTP server, which is stopped once the context
+// is done or the runner has finished.
+func (r *Runner[S, R, P, Q]) startAdmin(
+	wg *sync.WaitGroup,
+	ctx context.Context,
+	finished <-chan struct{},
+) error {
+	cfg := r.config().Admin
+	token := cfg.Token
+	if token == "" {
+		token = os.Getenv("ADMIN_TOKEN")
+	}
+	if token == "" {
+		return errors.New("admin token is not set")
+	}
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("listening for admin api: %w", err)
+	}
+	server := &http.Server{
+		Handler:           r.adminHandler(token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	wg.Go(func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zap.S().Errorw("serving admin api", "error", err)
+		}
+	})
+	wg.Go(func() {
+		select {
+		case <-ctx.Done():
+		case <-finished:
+		}
+		shutdownCtx, cancel := context.WithTimeout(
+			context.Background(),
+			r.config().Shutdown.GracePeriod,
+		)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			zap.S().Warnw("shutting down admin api", "error", err)
+		}
+	})
+	zap.S().Infow("serving admin api", "address", listener.Addr().String())
+	return nil
+}
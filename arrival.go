@@ -0,0 +1,278 @@
+package barash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/kiltia/barash/config"
+	"go.uber.org/zap"
+)
+
+const defaultMaxInFlight = 1000
+
+// arrivalSchedule returns the time of the next arrival since the start of
+// the schedule, given the time of the current one, and false once the
+// schedule is over.
+type arrivalSchedule func(at time.Duration) (time.Duration, bool)
+
+func rateInterval(rate float64) time.Duration {
+	return time.Duration(float64(time.Second) / rate)
+}
+
+func newArrivalSchedule(
+	cfg config.ArrivalConfig,
+	stages []config.StageConfig,
+) (arrivalSchedule, error) {
+	if len(stages) > 0 {
+		return newStagedSchedule(cfg.Model, stages)
+	}
+	switch cfg.Model {
+	case config.ArrivalModelConstant:
+		if cfg.Rate <= 0 {
+			return nil, errors.New("arrival rate must be positive")
+		}
+		interval := rateInterval(cfg.Rate)
+		return func(at time.Duration) (time.Duration, bool) {
+			return at + interval, true
+		}, nil
+	case config.ArrivalModelPoisson:
+		if cfg.Rate <= 0 {
+			return nil, errors.New("arrival rate must be positive")
+		}
+		return func(at time.Duration) (time.Duration, bool) {
+			// Intervals between arrivals of a Poisson process are exponential
+			return at + time.Duration(
+				rand.ExpFloat64()/cfg.Rate*float64(time.Second),
+			), true
+		}, nil
+	case config.ArrivalModelProfile:
+		return newProfileSchedule(cfg.Profile)
+	default:
+		return nil, fmt.Errorf("unknown arrival model: %s", cfg.Model)
+	}
+}
+
+func newProfileSchedule(steps []config.ArrivalStep) (arrivalSchedule, error) {
+	if len(steps) == 0 {
+		return nil, errors.New("arrival profile has no steps")
+	}
+	var total time.Duration
+	for i, step := range steps {
+		if step.Duration <= 0 {
+			return nil, fmt.Errorf("step %d: duration must be positive", i)
+		}
+		if step.Rate < 0 {
+			return nil, fmt.Errorf("step %d: rate must not be negative", i)
+		}
+		total += step.Duration
+	}
+
+	// rate returns the rate at the given time, how fast it changes per
+	// second and the end of its step
+	rate := func(at time.Duration) (float64, float64, time.Duration) {
+		var start time.Duration
+		prev := 0.0
+		for _, step := range steps {
+			end := start + step.Duration
+			if at < end {
+				if !step.Ramp {
+					return step.Rate, 0, end
+				}
+				slope := (step.Rate - prev) / step.Duration.Seconds()
+				return prev + slope*(at-start).Seconds(), slope, end
+			}
+			start, prev = end, step.Rate
+		}
+		return 0, 0, total
+	}
+	return func(at time.Duration) (time.Duration, bool) {
+		for at < total {
+			current, slope, end := rate(at)
+			// The next arrival is when the rate integrated from now adds up
+			// to one request: current*x + slope*x²/2 = 1
+			var x float64
+			switch {
+			case slope == 0 && current > 0:
+				x = 1 / current
+			case slope != 0:
+				discriminant := current*current + 2*slope
+				if discriminant < 0 {
+					x = -1
+				} else {
+					x = (math.Sqrt(discriminant) - current) / slope
+				}
+			default:
+				x = -1
+			}
+			next := at + time.Duration(x*float64(time.Second))
+			// Times are rounded to nanoseconds, which can move an arrival
+			// due at the end of a ramp slightly before it
+			if x > 0 && next < end &&
+				float64(end-next) < x*float64(time.Second)/1000 {
+				next = end
+			}
+			if x > 0 && next <= end {
+				return next, next < total
+			}
+			// There's no whole request left in the step
+			at = end
+		}
+		return 0, false
+	}, nil
+}
+
+// arrivalsEnabled reports whether requests are started on a schedule
+// instead of by the worker pool.
+func (r *Runner[S, R, P, Q]) arrivalsEnabled() bool {
+	return r.config().Fetcher.Arrival.Model != ""
+}
+
+// startArrivals starts requests on the arrival schedule regardless of how
+// long the previous ones take. If there are too many requests in flight, the
+// arrival is dropped and the task is left for the next one. Once the schedule
+// is over, the run is stopped with the given function.
+func (r *Runner[S, R, P, Q]) startArrivals(
+	globalWg *sync.WaitGroup,
+	ctx context.Context,
+	input chan APIRequest[P],
+	stop func(),
+) chan taskResult[S] {
+	cfg := r.config().Fetcher.Arrival
+	maxInFlight := cfg.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = defaultMaxInFlight
+	}
+	output := make(
+		chan taskResult[S],
+		2*r.config().Writer.InsertBatchSize+1,
+	)
+	slots := make(chan struct{}, maxInFlight)
+	zap.S().Infow(
+		"starting requests on a schedule",
+		"model", cfg.Model,
+		"rate", cfg.Rate,
+		"steps", len(cfg.Profile),
+		"max_in_flight", maxInFlight,
+	)
+
+	// Requests in flight are finished when the schedule is over, but they
+	// are cancelled along with the run otherwise
+	requestCtx, cancelRequests := context.WithCancel(
+		context.WithoutCancel(ctx),
+	)
+	over := make(chan struct{})
+	globalWg.Go(func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-over:
+			default:
+				cancelRequests()
+			}
+		case <-over:
+		}
+	})
+
+	globalWg.Go(func() {
+		var inFlight sync.WaitGroup
+		defer func() {
+			inFlight.Wait()
+			cancelRequests()
+			zap.S().Info("all scheduled requests are finished")
+			r.closeCapture()
+			close(output)
+		}()
+
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		start := time.Now()
+		var at time.Duration
+		stages := r.config().Fetcher.Stages
+		stage := -1
+		for {
+			// The schedule is shifted by the time spent paused
+			pausedAt := time.Now()
+			if !r.control.resumed(ctx) {
+				return
+			}
+			start = start.Add(time.Since(pausedAt))
+
+			intended := start.Add(at)
+			timer.Reset(time.Until(intended))
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			if len(stages) > 0 {
+				if i, _ := stageAt(stages, at); i != stage {
+					stage = i
+					r.startStage(stages[i])
+				}
+			}
+
+			select {
+			case slots <- struct{}{}:
+				task, ok := r.nextArrival(ctx, input)
+				if !ok {
+					<-slots
+					return
+				}
+				task.intendedAt = intended
+				if stage >= 0 {
+					task.stage = stages[stage].Name
+				}
+				inFlight.Go(func() {
+					defer func() { <-slots }()
+					r.performArrival(requestCtx, task, output)
+				})
+			default:
+				r.stats.recordDropped()
+			}
+
+			next, ok := r.arrivals(at)
+			if !ok {
+				zap.S().Infow("arrival schedule is over, stopping")
+				close(over)
+				stop()
+				return
+			}
+			at = next
+		}
+	})
+	return output
+}
+
+func (r *Runner[S, R, P, Q]) nextArrival(
+	ctx context.Context,
+	input <-chan APIRequest[P],
+) (APIRequest[P], bool) {
+	select {
+	case <-ctx.Done():
+		return APIRequest[P]{}, false
+	case task, ok := <-input:
+		return task, ok
+	}
+}
+
+func (r *Runner[S, R, P, Q]) performArrival(
+	ctx context.Context,
+	task APIRequest[P],
+	output chan<- taskResult[S],
+) {
+	logger := zap.S().With("request", task.GetRequestLink())
+	storedValues, err := r.performRequest(ctx, task, logger)
+	if rejected(err) {
+		return
+	}
+	output <- taskResult[S]{
+		values: storedValues,
+		batch:  task.batch,
+		params: &task.Params,
+	}
+}
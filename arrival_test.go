@@ -0,0 +1,229 @@
+package barash
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kiltia/barash/config"
+)
+
+func seconds(x float64) time.Duration {
+	return time.Duration(x * float64(time.Second))
+}
+
+// arrivals returns the times of the arrivals following the one at zero.
+func arrivals(t *testing.T, schedule arrivalSchedule) []time.Duration {
+	t.Helper()
+	var (
+		result []time.Duration
+		at     time.Duration
+	)
+	for range 10000 {
+		next, ok := schedule(at)
+		if !ok {
+			return result
+		}
+		if next <= at {
+			t.Fatalf("arrival at %v follows the one at %v", next, at)
+		}
+		result = append(result, next)
+		at = next
+	}
+	t.Fatal("schedule is never over")
+	return nil
+}
+
+func TestProfileSchedule(t *testing.T) {
+	ms := time.Millisecond
+	// Arrivals of a ramp from zero to 10 rps over 2s after an idle second,
+	// where the rate integrated over x seconds is 2.5x²
+	var ramp []time.Duration
+	for k := 1.0; k < 10; k++ {
+		ramp = append(
+			ramp,
+			time.Second+seconds(math.Sqrt(k/2.5)),
+		)
+	}
+	var fast []time.Duration
+	for i := 1; i < 100; i++ {
+		fast = append(fast, time.Duration(i)*ms)
+	}
+	tests := []struct {
+		name  string
+		steps []config.ArrivalStep
+		want  []time.Duration
+	}{
+		{
+			"constant",
+			[]config.ArrivalStep{{Duration: time.Second, Rate: 4}},
+			[]time.Duration{250 * ms, 500 * ms, 750 * ms},
+		},
+		{
+			"step",
+			[]config.ArrivalStep{
+				{Duration: time.Second, Rate: 2},
+				{Duration: time.Second, Rate: 4},
+			},
+			[]time.Duration{
+				500 * ms, 1000 * ms, 1250 * ms, 1500 * ms, 1750 * ms,
+			},
+		},
+		{
+			"ramp",
+			[]config.ArrivalStep{
+				{Duration: time.Second, Rate: 0},
+				{Duration: 2 * time.Second, Rate: 10, Ramp: true},
+			},
+			ramp,
+		},
+		{
+			"ramp down",
+			[]config.ArrivalStep{
+				{Duration: time.Second, Rate: 2},
+				{Duration: 2 * time.Second, Rate: 0, Ramp: true},
+			},
+			// The rate integrated over x seconds of the ramp is 2x - x²/2,
+			// so it adds up to one at 2 - √2
+			[]time.Duration{
+				500 * ms,
+				1000 * ms,
+				time.Second + seconds(2-math.Sqrt2),
+			},
+		},
+		{
+			"fast",
+			[]config.ArrivalStep{{Duration: 100 * ms, Rate: 1000}},
+			fast,
+		},
+		{
+			"idle",
+			[]config.ArrivalStep{{Duration: time.Second, Rate: 0}},
+			nil,
+		},
+		{
+			"too slow for a request",
+			[]config.ArrivalStep{{Duration: time.Second, Rate: 0.5}},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := newProfileSchedule(tt.steps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := arrivals(t, schedule)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got arrivals %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if diff := got[i] - tt.want[i]; diff < -time.Microsecond ||
+					diff > time.Microsecond {
+					t.Fatalf("got arrivals %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestArrivalScheduleValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ArrivalConfig
+	}{
+		{"unknown model", config.ArrivalConfig{Model: "burst", Rate: 1}},
+		{
+			"constant without rate",
+			config.ArrivalConfig{Model: config.ArrivalModelConstant},
+		},
+		{
+			"poisson with negative rate",
+			config.ArrivalConfig{Model: config.ArrivalModelPoisson, Rate: -1},
+		},
+		{
+			"profile without steps",
+			config.ArrivalConfig{Model: config.ArrivalModelProfile},
+		},
+		{
+			"profile step without duration",
+			config.ArrivalConfig{
+				Model:   config.ArrivalModelProfile,
+				Profile: []config.ArrivalStep{{Rate: 1}},
+			},
+		},
+		{
+			"profile step with negative rate",
+			config.ArrivalConfig{
+				Model: config.ArrivalModelProfile,
+				Profile: []config.ArrivalStep{
+					{Duration: time.Second, Rate: -1},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newArrivalSchedule(tt.cfg, nil); err == nil {
+				t.Fatal("invalid settings are accepted")
+			}
+		})
+	}
+}
+
+func TestConstantArrivals(t *testing.T) {
+	schedule, err := newArrivalSchedule(
+		config.ArrivalConfig{Model: config.ArrivalModelConstant, Rate: 4},
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Duration(0)
+	for range 100 {
+		next, ok := schedule(at)
+		if !ok || next-at != 250*time.Millisecond {
+			t.Fatalf("arrival at %v follows the one at %v", next, at)
+		}
+		at = next
+	}
+}
+
+func TestPoissonArrivals(t *testing.T) {
+	const (
+		rate    = 100
+		samples = 10000
+	)
+	schedule, err := newArrivalSchedule(
+		config.ArrivalConfig{Model: config.ArrivalModelPoisson, Rate: rate},
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		at      time.Duration
+		shorter int
+	)
+	mean := time.Second / rate
+	for range samples {
+		next, ok := schedule(at)
+		if !ok || next < at {
+			t.Fatalf("arrival at %v follows the one at %v", next, at)
+		}
+		if next-at < mean {
+			shorter++
+		}
+		at = next
+	}
+	// The mean interval has a standard deviation of 1%, and 1-1/e of the
+	// exponential intervals are shorter than the mean
+	if got := at / samples; got < mean*95/100 || got > mean*105/100 {
+		t.Fatalf("mean interval is %v, want about %v", got, mean)
+	}
+	if share := float64(shorter) / samples; math.Abs(
+		share-(1-1/math.E),
+	) > 0.03 {
+		t.Fatalf("%.2f of intervals are shorter than the mean", share)
+	}
+}
@@ -0,0 +1,199 @@
+package barash
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiltia/barash/config"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultAssertionInterval = 10 * time.Second
+	defaultAssertionMinTasks = 100
+)
+
+var ErrAssertionsFailed = errors.New("assertions failed")
+
+// AssertionFailure describes a breached assertion.
+type AssertionFailure struct {
+	Assertion string `json:"assertion"`
+	Limit     string `json:"limit"`
+	Actual    string `json:"actual"`
+}
+
+func (f AssertionFailure) String() string {
+	return fmt.Sprintf("%s: %s, limit %s", f.Assertion, f.Actual, f.Limit)
+}
+
+func assertionsEnabled(cfg config.AssertionsConfig) bool {
+	return cfg.MaxP50Latency > 0 ||
+		cfg.MaxP95Latency > 0 ||
+		cfg.MaxP99Latency > 0 ||
+		cfg.MaxErrorRate != nil ||
+		cfg.MinRPS > 0 ||
+		cfg.NoBreakerTrips
+}
+
+// checkAssertions returns the assertions breached by the summary. Some
+// assertions only make sense for the whole run, so they are skipped unless
+// the run is finished.
+func checkAssertions(
+	cfg config.AssertionsConfig,
+	summary Summary,
+	finished bool,
+) []AssertionFailure {
+	var failures []AssertionFailure
+	// Corrected latencies include the time spent behind stalled requests
+	latency := summary.Latency
+	if summary.CorrectedLatency != nil {
+		latency = *summary.CorrectedLatency
+	}
+	checkLatency := func(name string, limit time.Duration, actualMs float64) {
+		actual := time.Duration(actualMs * float64(time.Millisecond))
+		if limit > 0 && actual > limit {
+			failures = append(failures, AssertionFailure{
+				Assertion: name,
+				Limit:     limit.String(),
+				Actual:    actual.String(),
+			})
+		}
+	}
+	checkLatency("max_p50_latency", cfg.MaxP50Latency, latency.P50)
+	checkLatency("max_p95_latency", cfg.MaxP95Latency, latency.P95)
+	checkLatency("max_p99_latency", cfg.MaxP99Latency, latency.P99)
+
+	if cfg.MaxErrorRate != nil && summary.Tasks > 0 {
+		rate := float64(summary.Failed) / float64(summary.Tasks) * 100
+		if rate > *cfg.MaxErrorRate {
+			failures = append(failures, AssertionFailure{
+				Assertion: "max_error_rate",
+				Limit:     fmt.Sprintf("%g%%", *cfg.MaxErrorRate),
+				Actual:    fmt.Sprintf("%.2f%%", rate),
+			})
+		}
+	}
+	if cfg.NoBreakerTrips && summary.BreakerTrips > 0 {
+		failures = append(failures, AssertionFailure{
+			Assertion: "no_breaker_trips",
+			Limit:     "0",
+			Actual:    fmt.Sprint(summary.BreakerTrips),
+		})
+	}
+	if finished && cfg.MinRPS > 0 && summary.RPS < cfg.MinRPS {
+		failures = append(failures, AssertionFailure{
+			Assertion: "min_rps",
+			Limit:     fmt.Sprintf("%g", cfg.MinRPS),
+			Actual:    fmt.Sprintf("%.2f", summary.RPS),
+		})
+	}
+	return failures
+}
+
+// assertionState holds the outcome of the assertions for Err.
+type assertionState struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (s *assertionState) fail(failures []AssertionFailure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	report := make([]string, len(failures))
+	for i, failure := range failures {
+		report[i] = failure.String()
+	}
+	s.err = fmt.Errorf(
+		"%w: %s",
+		ErrAssertionsFailed,
+		strings.Join(report, "; "),
+	)
+}
+
+func (s *assertionState) get() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Err returns an error wrapping ErrAssertionsFailed if any of the configured
+// assertions has been breached. It's meant to be checked once the run is
+// finished, to exit with a non-zero code.
+func (r *Runner[S, R, P, Q]) Err() error {
+	return r.assertions.get()
+}
+
+// watchAssertions checks the assertions while the runner is working, and
+// aborts the run on a breach if it's configured to.
+func (r *Runner[S, R, P, Q]) watchAssertions(
+	wg *sync.WaitGroup,
+	finished <-chan struct{},
+	abort func(),
+) {
+	cfg := r.config().Assertions
+	interval := cfg.CheckInterval
+	if interval <= 0 {
+		interval = defaultAssertionInterval
+	}
+	minTasks := cfg.MinTasks
+	if minTasks <= 0 {
+		minTasks = defaultAssertionMinTasks
+	}
+	wg.Go(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+			}
+			summary := r.Summary()
+			if summary.Tasks < minTasks {
+				continue
+			}
+			failures := checkAssertions(cfg, summary, false)
+			if len(failures) == 0 {
+				continue
+			}
+			if !cfg.Abort {
+				zap.S().Warnw(
+					"assertions are breached",
+					"failures", failures,
+				)
+				continue
+			}
+			zap.S().Errorw(
+				"assertions are breached, aborting the run",
+				"failures", failures,
+			)
+			r.stats.setFailedAssertions(failures)
+			r.assertions.fail(failures)
+			abort()
+			return
+		}
+	})
+}
+
+// checkFinalAssertions checks the assertions against the whole run. A
+// breach found earlier, which has aborted the run, is kept.
+func (r *Runner[S, R, P, Q]) checkFinalAssertions() {
+	cfg := r.config().Assertions
+	if !assertionsEnabled(cfg) || r.assertions.get() != nil {
+		return
+	}
+	failures := checkAssertions(cfg, r.Summary(), true)
+	if len(failures) == 0 {
+		zap.S().Infow("all assertions have passed")
+		return
+	}
+	zap.S().Errorw("assertions have failed", "failures", failures)
+	r.stats.setFailedAssertions(failures)
+	r.assertions.fail(failures)
+}
@@ -0,0 +1,115 @@
+package barashtest_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiltia/barash"
+	"github.com/kiltia/barash/config"
+)
+
+type params struct {
+	ID int `json:"id" query:"id"`
+}
+
+type result struct {
+	ID      int    `json:"id"`
+	Status  int    `json:"status"`
+	Attempt int    `json:"attempt"`
+	Error   string `json:"error"`
+}
+
+func (result) GetCreateQuery(string) string { return "" }
+
+type response struct{}
+
+func (response) IntoStored(
+	req barash.APIRequest[params],
+	err error,
+	attempt int,
+	status int,
+	_ time.Duration,
+	_ string,
+	_ string,
+) result {
+	stored := result{ID: req.Params.ID, Status: status, Attempt: attempt}
+	if err != nil {
+		stored.Error = err.Error()
+	}
+	return stored
+}
+
+type state struct{}
+
+func (*state) UpdateState([]params) {}
+
+func (*state) ResetState() {}
+
+func newTasks(n int) []params {
+	tasks := make([]params, n)
+	for i := range tasks {
+		tasks[i].ID = i
+	}
+	return tasks
+}
+
+// newConfig returns a two-table mode configuration which sends tasks to
+// the given URL without retries.
+func newConfig(url string) *config.Config {
+	cfg := &config.Config{Mode: config.TwoTableMode}
+	cfg.API = config.APIConfig{
+		RequestURL:  url,
+		Method:      config.RunnerHTTPMethodGet,
+		APITimeout:  time.Second,
+		MinWaitTime: time.Millisecond,
+		MaxWaitTime: 2 * time.Millisecond,
+	}
+	cfg.Provider.SelectBatchSize = 10
+	cfg.Provider.SelectRetries = 1
+	cfg.Provider.SleepTime = 50 * time.Millisecond
+	cfg.Fetcher = config.FetcherConfig{
+		MinFetcherWorkers: 4,
+		MaxFetcherWorkers: 4,
+		IdleTime:          200 * time.Millisecond,
+	}
+	cfg.Writer.InsertBatchSize = 10
+	cfg.Shutdown.DBSaveTimeout = time.Second
+	return cfg
+}
+
+// run runs the runner until it's done or the context is cancelled.
+func run(
+	ctx context.Context,
+	t *testing.T,
+	cfg *config.Config,
+	opts ...barash.Option,
+) *barash.Runner[result, response, params, *state] {
+	t.Helper()
+	runner, err := barash.New[result, response, params, *state](
+		cfg,
+		&state{},
+		opts...,
+	)
+	if err != nil {
+		t.Fatalf("creating runner: %v", err)
+	}
+	var wg sync.WaitGroup
+	runner.Run(ctx, &wg)
+	wg.Wait()
+	return runner
+}
+
+// waitFor polls the condition until it holds or the timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cond()
+}
@@ -0,0 +1,32 @@
+package barashtest
+
+import (
+	"github.com/twmb/franz-go/pkg/kfake"
+)
+
+// Kafka is an embedded single-node fake broker which can be used with the
+// kafka source and sink instead of a real cluster.
+type Kafka struct {
+	*kfake.Cluster
+}
+
+// NewKafka starts a broker with the given topics created. Topics have the
+// given number of partitions, or the broker default if it's not positive.
+func NewKafka(partitions int32, topics ...string) (*Kafka, error) {
+	if partitions <= 0 {
+		partitions = -1
+	}
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.SeedTopics(partitions, topics...),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Kafka{Cluster: cluster}, nil
+}
+
+// Brokers returns the addresses to put into the kafka configuration.
+func (k *Kafka) Brokers() []string {
+	return k.ListenAddrs()
+}
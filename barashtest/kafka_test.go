@@ -0,0 +1,454 @@
+package barashtest_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiltia/barash"
+	"github.com/kiltia/barash/barashtest"
+	"github.com/kiltia/barash/config"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	testTopic = "tasks"
+	testGroup = "runner"
+)
+
+// newKafka starts a broker with a single-partition topic and produces the
+// given record values to it.
+func newKafka(t *testing.T, values ...[]byte) (*barashtest.Kafka, *kgo.Client) {
+	t.Helper()
+	kafka, err := barashtest.NewKafka(1, testTopic)
+	if err != nil {
+		t.Fatalf("starting kafka: %v", err)
+	}
+	t.Cleanup(kafka.Close)
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(kafka.Brokers()...),
+		kgo.DefaultProduceTopic(testTopic),
+	)
+	if err != nil {
+		t.Fatalf("creating kafka client: %v", err)
+	}
+	t.Cleanup(client.Close)
+	produce(t, client, values...)
+	return kafka, client
+}
+
+func produce(t *testing.T, client *kgo.Client, values ...[]byte) {
+	t.Helper()
+	records := make([]*kgo.Record, len(values))
+	for i, value := range values {
+		records[i] = &kgo.Record{Value: value}
+	}
+	if len(records) == 0 {
+		return
+	}
+	err := client.ProduceSync(context.Background(), records...).FirstErr()
+	if err != nil {
+		t.Fatalf("producing records: %v", err)
+	}
+}
+
+func taskValues(t *testing.T, tasks []params) [][]byte {
+	t.Helper()
+	values := make([][]byte, len(tasks))
+	for i, task := range tasks {
+		value, err := json.Marshal(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values[i] = value
+	}
+	return values
+}
+
+func newKafkaSource(
+	t *testing.T,
+	kafka *barashtest.Kafka,
+	batchSize int,
+) *barash.KafkaSource[params] {
+	t.Helper()
+	var cfg config.SourceConfig
+	cfg.Kafka = config.KafkaConfig{
+		Brokers:     kafka.Brokers(),
+		Topic:       testTopic,
+		Group:       testGroup,
+		PollTimeout: 100 * time.Millisecond,
+	}
+	source, err := barash.NewKafkaSource[params](cfg, batchSize)
+	if err != nil {
+		t.Fatalf("creating kafka source: %v", err)
+	}
+	return source
+}
+
+// committedOffset returns the offset committed by the group to the only
+// partition of the topic, or -1 if there's none.
+func committedOffset(t *testing.T, client *kgo.Client) int64 {
+	t.Helper()
+	offsets, err := kadm.NewClient(client).
+		FetchOffsets(context.Background(), testGroup)
+	if err != nil {
+		return -1
+	}
+	offset, ok := offsets.Lookup(testTopic, 0)
+	if !ok || offset.Err != nil {
+		return -1
+	}
+	return offset.At
+}
+
+func TestKafkaOffsetsAdvanceAfterBreakerTrip(t *testing.T) {
+	const tasks = 30
+	kafka, client := newKafka(t, taskValues(t, newTasks(tasks))...)
+
+	// The first requests fail to trip the breaker, the rest succeed
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			if requests.Add(1) <= 3 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte("{}"))
+		},
+	))
+	defer srv.Close()
+
+	cfg := newConfig(srv.URL)
+	cfg.Mode = config.ContinuousMode
+	cfg.Provider.SelectBatchSize = 5
+	cfg.Fetcher.MinFetcherWorkers = 1
+	cfg.Fetcher.MaxFetcherWorkers = 1
+	cfg.Fetcher.IdleTime = time.Minute
+	cfg.Fetcher.CircuitBreaker = config.CircuitBreakerConfig{
+		Enabled:            true,
+		MaxRequests:        1,
+		ConsecutiveFailure: 2,
+		Timeout:            200 * time.Millisecond,
+	}
+	cfg.Writer.InsertBatchSize = 1
+	sink := barashtest.NewSink[result]()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		waitFor(t, 20*time.Second, func() bool {
+			return committedOffset(t, client) == tasks
+		})
+	}()
+	runner := run(
+		ctx,
+		t,
+		cfg,
+		barash.WithSource(newKafkaSource(t, kafka, 5)),
+		barash.WithSinks(sink),
+	)
+
+	if got := committedOffset(t, client); got != tasks {
+		t.Fatalf("committed offset is %d, want %d", got, tasks)
+	}
+	summary := runner.Summary()
+	if summary.BreakerTrips == 0 || summary.BreakerRejections == 0 {
+		t.Fatalf(
+			"breaker tripped %d times and rejected %d requests, want both",
+			summary.BreakerTrips,
+			summary.BreakerRejections,
+		)
+	}
+	written := map[int]bool{}
+	for _, res := range sink.Results() {
+		written[res.ID] = true
+	}
+	if len(written) != tasks {
+		t.Fatalf(
+			"results of %d tasks are written, want %d",
+			len(written),
+			tasks,
+		)
+	}
+}
+
+func TestKafkaSinkKeysByParams(t *testing.T) {
+	const (
+		topic = "results"
+		tasks = 5
+	)
+	kafka, err := barashtest.NewKafka(1, topic)
+	if err != nil {
+		t.Fatalf("starting kafka: %v", err)
+	}
+	defer kafka.Close()
+	var cfg config.SinkConfig
+	cfg.Kafka = config.KafkaConfig{
+		Brokers: kafka.Brokers(),
+		Topic:   topic,
+		Key:     "id",
+	}
+	sink, err := barash.NewKafkaSink[result](cfg)
+	if err != nil {
+		t.Fatalf("creating kafka sink: %v", err)
+	}
+	defer sink.Close()
+
+	ctx := context.Background()
+	batch := make([]result, tasks)
+	taskParams := make([]any, tasks)
+	for i := range batch {
+		// Results carry their own id, which isn't used as the key
+		batch[i] = result{ID: i, Status: http.StatusOK}
+		taskParams[i] = &params{ID: 100 + i}
+	}
+	if err := sink.InsertBatch(ctx, batch); err == nil {
+		t.Fatal("keyed results are produced without the task parameters")
+	}
+	deduped := barash.NewDedupSink[result](sink, 10)
+	if err := deduped.InsertTaskBatch(ctx, batch, taskParams); err != nil {
+		t.Fatalf("producing results: %v", err)
+	}
+
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(kafka.Brokers()...),
+		kgo.ConsumeTopics(topic),
+	)
+	if err != nil {
+		t.Fatalf("creating kafka client: %v", err)
+	}
+	defer client.Close()
+	pollCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < tasks {
+		fetches := client.PollFetches(pollCtx)
+		if err := pollCtx.Err(); err != nil {
+			t.Fatalf("consumed %d records, want %d", len(records), tasks)
+		}
+		records = append(records, fetches.Records()...)
+	}
+	for _, record := range records {
+		var res result
+		if err := json.Unmarshal(record.Value, &res); err != nil {
+			t.Fatal(err)
+		}
+		if want := strconv.Itoa(100 + res.ID); string(record.Key) != want {
+			t.Fatalf(
+				"record of result %d has key %q, want %s",
+				res.ID,
+				record.Key,
+				want,
+			)
+		}
+	}
+}
+
+// nextBatch polls the source until it returns tasks.
+func nextBatch(t *testing.T, source *barash.KafkaSource[params]) []params {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		batch, err := source.GetNextBatch(context.Background(), "", nil)
+		if err != nil {
+			t.Fatalf("getting next batch: %v", err)
+		}
+		if len(batch) > 0 {
+			return batch
+		}
+	}
+	t.Fatal("no tasks are polled")
+	return nil
+}
+
+func TestKafkaSourceDiscard(t *testing.T) {
+	kafka, client := newKafka(t, taskValues(t, newTasks(1))...)
+	source := newKafkaSource(t, kafka, 5)
+	defer source.Close()
+
+	nextBatch(t, source)
+	source.Discard()
+	if err := source.Commit(context.Background(), 1); err != nil {
+		t.Fatalf("committing: %v", err)
+	}
+	if got := committedOffset(t, client); got != -1 {
+		t.Fatalf("committed offset %d of a discarded batch", got)
+	}
+}
+
+// runUntilCommitted runs the runner in continuous mode with the kafka source
+// until the group commits the given offset.
+func runUntilCommitted(
+	t *testing.T,
+	kafka *barashtest.Kafka,
+	client *kgo.Client,
+	cfg *config.Config,
+	sink barash.Sink[result],
+	offset int64,
+) {
+	t.Helper()
+	cfg.Mode = config.ContinuousMode
+	// Fetchers outlive empty polls, the runner stops once it's cancelled
+	cfg.Fetcher.IdleTime = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		waitFor(t, 20*time.Second, func() bool {
+			return committedOffset(t, client) == offset
+		})
+	}()
+	run(
+		ctx,
+		t,
+		cfg,
+		barash.WithSource(
+			newKafkaSource(t, kafka, cfg.Provider.SelectBatchSize),
+		),
+		barash.WithSinks(sink),
+	)
+	if got := committedOffset(t, client); got != offset {
+		t.Fatalf("committed offset is %d, want %d", got, offset)
+	}
+}
+
+// committedSink checks that offsets are never committed past the written
+// results.
+type committedSink struct {
+	*barashtest.Sink[result]
+	t      *testing.T
+	client *kgo.Client
+}
+
+func (s *committedSink) InsertBatch(ctx context.Context, batch []result) error {
+	written := map[int]bool{}
+	for _, res := range s.Results() {
+		written[res.ID] = true
+	}
+	if offset := committedOffset(s.t, s.client); offset > int64(len(written)) {
+		s.t.Errorf(
+			"offset %d is committed with results of %d tasks written",
+			offset,
+			len(written),
+		)
+	}
+	return s.Sink.InsertBatch(ctx, batch)
+}
+
+func TestKafkaOffsetsCommittedAfterWrite(t *testing.T) {
+	const tasks = 40
+	kafka, client := newKafka(t, taskValues(t, newTasks(tasks))...)
+	srv := barashtest.NewServer(barashtest.ServerConfig{
+		Latency: barashtest.Uniform(time.Millisecond, 5*time.Millisecond),
+	})
+	defer srv.Close()
+
+	cfg := newConfig(srv.URL)
+	cfg.Provider.SelectBatchSize = 5
+	// Every result is flushed, a partial batch would wait for more results
+	cfg.Writer.InsertBatchSize = 1
+	sink := &committedSink{
+		Sink:   barashtest.NewSink[result](),
+		t:      t,
+		client: client,
+	}
+	// Failed inserts hold the offsets back until the results are written
+	sink.FailNext(2)
+	runUntilCommitted(t, kafka, client, cfg, sink, tasks)
+
+	written := map[int]bool{}
+	for _, res := range sink.Results() {
+		written[res.ID] = true
+	}
+	if len(written) != tasks {
+		t.Fatalf(
+			"results of %d tasks are written, want %d",
+			len(written),
+			tasks,
+		)
+	}
+}
+
+func TestKafkaSourceSkipsMalformedRecords(t *testing.T) {
+	valid := taskValues(t, newTasks(4))
+	bad := []byte("not json")
+	// The last batch has only malformed records
+	values := [][]byte{
+		valid[0], bad, valid[1], valid[2], bad, valid[3], bad, bad,
+	}
+	kafka, client := newKafka(t, values...)
+	srv := barashtest.NewServer(barashtest.ServerConfig{})
+	defer srv.Close()
+
+	cfg := newConfig(srv.URL)
+	cfg.Provider.SelectBatchSize = 2
+	cfg.Writer.InsertBatchSize = 1
+	sink := barashtest.NewSink[result]()
+	runUntilCommitted(t, kafka, client, cfg, sink, int64(len(values)))
+
+	written := map[int]int{}
+	for _, res := range sink.Results() {
+		written[res.ID]++
+	}
+	if len(written) != len(valid) {
+		t.Fatalf(
+			"results of %d tasks are written, want %d",
+			len(written),
+			len(valid),
+		)
+	}
+	if srv.Requests() != len(valid) {
+		t.Fatalf(
+			"server got %d requests, want %d",
+			srv.Requests(),
+			len(valid),
+		)
+	}
+}
+
+func TestKafkaSourceEmptyPolls(t *testing.T) {
+	const tasks = 10
+	kafka, client := newKafka(t)
+	source := newKafkaSource(t, kafka, 5)
+
+	// An empty poll returns no tasks after the poll timeout
+	start := time.Now()
+	batch, err := source.GetNextBatch(context.Background(), "", nil)
+	if err != nil || len(batch) != 0 {
+		t.Fatalf("got %d tasks and %v from an empty topic", len(batch), err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("empty poll returned after %v, want the poll timeout", elapsed)
+	}
+	// The partition is assigned to the runner once the source leaves
+	source.Close()
+
+	// The runner keeps polling until records arrive
+	srv := barashtest.NewServer(barashtest.ServerConfig{})
+	defer srv.Close()
+	cfg := newConfig(srv.URL)
+	cfg.Provider.SelectBatchSize = 5
+	sink := barashtest.NewSink[result]()
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		produce(t, client, taskValues(t, newTasks(tasks))...)
+	}()
+	runUntilCommitted(t, kafka, client, cfg, sink, tasks)
+
+	written := map[int]bool{}
+	for _, res := range sink.Results() {
+		written[res.ID] = true
+	}
+	if len(written) != tasks {
+		t.Fatalf(
+			"results of %d tasks are written, want %d",
+			len(written),
+			tasks,
+		)
+	}
+}
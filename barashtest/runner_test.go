@@ -0,0 +1,355 @@
+package barashtest_test
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kiltia/barash"
+	"github.com/kiltia/barash/barashtest"
+	"github.com/kiltia/barash/config"
+)
+
+func TestRunnerWritesEveryAttempt(t *testing.T) {
+	const tasks = 100
+	srv := barashtest.NewServer(barashtest.ServerConfig{
+		Latency: barashtest.Uniform(time.Millisecond, 3*time.Millisecond),
+		Statuses: map[int]float64{
+			http.StatusOK:                  7,
+			http.StatusNotFound:            1,
+			http.StatusInternalServerError: 2,
+		},
+	})
+	defer srv.Close()
+
+	cfg := newConfig(srv.URL)
+	cfg.API.NumRetries = 2
+	src := barashtest.NewSource(newTasks(tasks), 10)
+	sink := barashtest.NewSink[result]()
+	runner := run(
+		context.Background(),
+		t,
+		cfg,
+		barash.WithSource(src),
+		barash.WithSinks(sink),
+	)
+
+	if !sink.Initialized() {
+		t.Fatal("sink table isn't initialized in two-table mode")
+	}
+	// The last select returns nothing and stops the provider
+	if got := src.Calls(); got != tasks/10+1 {
+		t.Fatalf("source is selected %d times, want %d", got, tasks/10+1)
+	}
+
+	results := sink.Results()
+	summary := runner.Summary()
+	if summary.Tasks != tasks {
+		t.Fatalf("summary has %d tasks, want %d", summary.Tasks, tasks)
+	}
+	if int(summary.Attempts) != srv.Requests() {
+		t.Fatalf(
+			"summary has %d attempts, the server got %d requests",
+			summary.Attempts,
+			srv.Requests(),
+		)
+	}
+	if summary.Retries != summary.Attempts-tasks || summary.Retries == 0 {
+		t.Fatalf("summary has %d retries", summary.Retries)
+	}
+
+	// Every attempt is stored, so the sink mirrors the server statuses
+	statuses := map[int]int{}
+	attempts := map[int]int{}
+	for _, res := range results {
+		statuses[res.Status]++
+		attempts[res.ID]++
+	}
+	for status, n := range srv.Statuses() {
+		if statuses[status] != n {
+			t.Fatalf(
+				"sink has %d results with status %d, the server sent %d",
+				statuses[status],
+				status,
+				n,
+			)
+		}
+	}
+	if len(attempts) != tasks {
+		t.Fatalf("sink has results of %d tasks, want %d", len(attempts), tasks)
+	}
+	for id, n := range attempts {
+		// Only server errors are retried
+		if n < 1 || n > cfg.API.NumRetries+1 {
+			t.Fatalf("task %d has %d attempts", id, n)
+		}
+	}
+	// Only the last attempt of a task carries its error
+	last := map[int]result{}
+	for _, res := range results {
+		if res.Attempt > last[res.ID].Attempt {
+			last[res.ID] = res
+		}
+	}
+	for _, res := range last {
+		if res.Status == http.StatusInternalServerError && res.Error == "" {
+			t.Fatalf("result %+v of a server error has no error", res)
+		}
+	}
+}
+
+func TestRunnerRetriesFailedInserts(t *testing.T) {
+	const tasks = 50
+	srv := barashtest.NewServer(barashtest.ServerConfig{})
+	defer srv.Close()
+
+	cfg := newConfig(srv.URL)
+	src := barashtest.NewSource(newTasks(tasks), 10)
+	sink := barashtest.NewSink[result]()
+	// A failed batch is kept and written with the next one
+	sink.FailNext(2)
+	runner := run(
+		context.Background(),
+		t,
+		cfg,
+		barash.WithSource(src),
+		barash.WithSinks(sink),
+	)
+
+	written := map[int]int{}
+	for _, res := range sink.Results() {
+		written[res.ID]++
+	}
+	if len(written) != tasks {
+		t.Fatalf("sink has results of %d tasks, want %d", len(written), tasks)
+	}
+	for id, n := range written {
+		if n != 1 {
+			t.Fatalf("task %d is written %d times", id, n)
+		}
+	}
+	summary := runner.Summary().Sinks[0]
+	if summary.Failures != 2 || summary.Rows != tasks ||
+		summary.Batches != int64(sink.Batches()) {
+		t.Fatalf(
+			"summary has %d failures, %d rows and %d batches, "+
+				"want 2, %d and %d",
+			summary.Failures,
+			summary.Rows,
+			summary.Batches,
+			tasks,
+			sink.Batches(),
+		)
+	}
+}
+
+func TestRunnerSurvivesBrokenConnections(t *testing.T) {
+	const tasks = 100
+	srv := barashtest.NewServer(barashtest.ServerConfig{
+		TruncateRate: 0.1,
+		ResetRate:    0.1,
+		Body: func(*http.Request, int) []byte {
+			return []byte(`{"items":[1,2,3,4,5,6,7,8,9]}`)
+		},
+	})
+	defer srv.Close()
+
+	cfg := newConfig(srv.URL)
+	sink := barashtest.NewSink[result]()
+	run(
+		context.Background(),
+		t,
+		cfg,
+		barash.WithSource(barashtest.NewSource(newTasks(tasks), 10)),
+		barash.WithSinks(sink),
+	)
+
+	faults := srv.Faults()
+	if faults[barashtest.FaultTruncate]+faults[barashtest.FaultReset] == 0 {
+		t.Fatal("no faults are injected")
+	}
+	written := map[int]bool{}
+	for _, res := range sink.Results() {
+		written[res.ID] = true
+		// A reset connection has no response and fails the task
+		if res.Status == 0 && res.Error == "" {
+			t.Fatalf("result %+v without a response has no error", res)
+		}
+	}
+	if len(written) != tasks {
+		t.Fatalf("sink has results of %d tasks, want %d", len(written), tasks)
+	}
+}
+
+func TestRunnerResumesSourceFromCheckpoint(t *testing.T) {
+	const (
+		tasks = 50
+		done  = 20
+	)
+	srv := barashtest.NewServer(barashtest.ServerConfig{})
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	// A previous run has written the results of the first rows
+	err := barash.NewFileCheckpointStore(path).Save(
+		context.Background(),
+		barash.Checkpoint{Batches: done / 10, Rows: done},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newConfig(srv.URL)
+	cfg.Provider.Checkpoint.Enabled = true
+	cfg.Provider.Checkpoint.Backend = config.CheckpointBackendFile
+	cfg.Provider.Checkpoint.Path = path
+	sink := barashtest.NewSink[result]()
+	run(
+		context.Background(),
+		t,
+		cfg,
+		barash.WithSource(barash.NewSliceSource(newTasks(tasks), 10)),
+		barash.WithSinks(sink),
+	)
+
+	written := map[int]bool{}
+	for _, res := range sink.Results() {
+		if res.ID < done {
+			t.Fatalf("task %d covered by the checkpoint is sent again", res.ID)
+		}
+		written[res.ID] = true
+	}
+	if len(written) != tasks-done {
+		t.Fatalf(
+			"results of %d tasks are written, want %d",
+			len(written),
+			tasks-done,
+		)
+	}
+	cp, err := barash.NewFileCheckpointStore(path).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Rows != tasks || !cp.Completed {
+		t.Fatalf(
+			"checkpoint has %d rows and completed is %t, want %d and true",
+			cp.Rows,
+			cp.Completed,
+			tasks,
+		)
+	}
+}
+
+func TestRunnerDropsArrivalsAboveMaxInFlight(t *testing.T) {
+	const tasks = 20
+	srv := barashtest.NewServer(barashtest.ServerConfig{
+		Latency: barashtest.Constant(20 * time.Millisecond),
+	})
+	defer srv.Close()
+
+	cfg := newConfig(srv.URL)
+	// Arrivals come every 2ms, but only one request may be in flight
+	cfg.Fetcher.Arrival = config.ArrivalConfig{
+		Model:       config.ArrivalModelConstant,
+		Rate:        500,
+		MaxInFlight: 1,
+	}
+	sink := barashtest.NewSink[result]()
+	runner := run(
+		context.Background(),
+		t,
+		cfg,
+		barash.WithSource(barashtest.NewSource(newTasks(tasks), 10)),
+		barash.WithSinks(sink),
+	)
+
+	summary := runner.Summary()
+	if summary.Dropped == 0 {
+		t.Fatal("no arrivals are dropped")
+	}
+	// A dropped arrival leaves its task for the next one
+	written := map[int]bool{}
+	for _, res := range sink.Results() {
+		written[res.ID] = true
+	}
+	if len(written) != tasks || srv.Requests() != tasks {
+		t.Fatalf(
+			"results of %d tasks are written after %d requests, want %d",
+			len(written),
+			srv.Requests(),
+			tasks,
+		)
+	}
+}
+
+func TestRunnerFollowsPagesUpToMaxPages(t *testing.T) {
+	const (
+		tasks    = 10
+		maxPages = 3
+	)
+	tests := []struct {
+		name string
+		// Number of pages the server has for every task
+		pages int
+		want  int
+	}{
+		{"last page", 2, 2},
+		{"page limit", 100, maxPages},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := barashtest.NewServer(barashtest.ServerConfig{
+				// Every page but the last one points to the next one
+				Body: func(r *http.Request, _ int) []byte {
+					page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+					if page+1 >= tt.pages {
+						return []byte(`{}`)
+					}
+					return []byte(
+						`{"meta":{"next":` + strconv.Itoa(page+1) + `}}`,
+					)
+				},
+			})
+			defer srv.Close()
+
+			cfg := newConfig(srv.URL)
+			cfg.API.Pagination = config.PaginationConfig{
+				Mode:        config.PaginationModeCursor,
+				CursorField: "meta.next",
+				CursorParam: "page",
+				MaxPages:    maxPages,
+			}
+			sink := barashtest.NewSink[result]()
+			run(
+				context.Background(),
+				t,
+				cfg,
+				barash.WithSource(barashtest.NewSource(newTasks(tasks), 10)),
+				barash.WithSinks(sink),
+			)
+
+			// Every page is stored as a separate result
+			pages := map[int]int{}
+			for _, res := range sink.Results() {
+				pages[res.ID]++
+			}
+			if len(pages) != tasks || srv.Requests() != tasks*tt.want {
+				t.Fatalf(
+					"results of %d tasks are written after %d requests, "+
+						"want %d and %d",
+					len(pages),
+					srv.Requests(),
+					tasks,
+					tasks*tt.want,
+				)
+			}
+			for id, n := range pages {
+				if n != tt.want {
+					t.Fatalf("task %d has %d pages, want %d", id, n, tt.want)
+				}
+			}
+		})
+	}
+}
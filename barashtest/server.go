@@ -0,0 +1,226 @@
+// Package barashtest provides utilities for testing runners without real
+// upstream APIs and databases.
+package barashtest
+
+import (
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Latency returns the delay before the server responds.
+type Latency func() time.Duration
+
+func Constant(d time.Duration) Latency {
+	return func() time.Duration { return d }
+}
+
+// Uniform picks a delay between lo and hi inclusive. The bounds are swapped
+// if hi is less than lo.
+func Uniform(lo, hi time.Duration) Latency {
+	if hi < lo {
+		lo, hi = hi, lo
+	}
+	return func() time.Duration {
+		return lo + time.Duration(rand.Int64N(int64(hi-lo)+1))
+	}
+}
+
+func Normal(mean, stddev time.Duration) Latency {
+	return func() time.Duration {
+		d := float64(mean) + rand.NormFloat64()*float64(stddev)
+		return time.Duration(max(d, 0))
+	}
+}
+
+func Exponential(mean time.Duration) Latency {
+	return func() time.Duration {
+		return time.Duration(rand.ExpFloat64() * float64(mean))
+	}
+}
+
+// LogNormal produces a long-tailed distribution with the given median.
+func LogNormal(median time.Duration, sigma float64) Latency {
+	return func() time.Duration {
+		return time.Duration(
+			float64(median) * math.Exp(rand.NormFloat64()*sigma),
+		)
+	}
+}
+
+// Fault is a kind of broken response.
+type Fault int
+
+const (
+	// FaultNone is a regular response.
+	FaultNone Fault = iota
+	// FaultTruncate sends a part of the body and closes the connection.
+	FaultTruncate
+	// FaultReset resets the connection without a response.
+	FaultReset
+)
+
+type ServerConfig struct {
+	// Delay before responding, no delay if nil
+	Latency Latency
+	// Weights of the response status codes, always 200 if empty
+	Statuses map[int]float64
+	// Retry-After value for 429 responses
+	RetryAfter time.Duration
+	// Share of responses, from 0 to 1, sent with a truncated body
+	TruncateRate float64
+	// Share of connections, from 0 to 1, reset without a response
+	ResetRate float64
+	// Body of the response, `{}` if nil
+	Body func(r *http.Request, status int) []byte
+}
+
+// Server is an in-process HTTP server emulating an unreliable upstream.
+type Server struct {
+	*httptest.Server
+	cfg ServerConfig
+
+	mu       sync.Mutex
+	statuses map[int]int
+	faults   map[Fault]int
+	total    atomic.Int64
+}
+
+func NewServer(cfg ServerConfig) *Server {
+	s := &Server{
+		cfg:      cfg,
+		statuses: map[int]int{},
+		faults:   map[Fault]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Requests returns the number of received requests.
+func (s *Server) Requests() int {
+	return int(s.total.Load())
+}
+
+// Statuses returns the number of responses sent with each status code.
+func (s *Server) Statuses() map[int]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.statuses)
+}
+
+// Faults returns the number of injected faults of each kind.
+func (s *Server) Faults() map[Fault]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.faults)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.total.Add(1)
+	if s.cfg.Latency != nil {
+		select {
+		case <-time.After(s.cfg.Latency()):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	fault := s.pickFault()
+	if fault == FaultReset {
+		s.record(0, fault)
+		reset(w)
+		return
+	}
+
+	status := s.pickStatus()
+	s.record(status, fault)
+	body := []byte("{}")
+	if s.cfg.Body != nil {
+		body = s.cfg.Body(r, status)
+	}
+	if status == http.StatusTooManyRequests && s.cfg.RetryAfter > 0 {
+		w.Header().Set(
+			"Retry-After",
+			strconv.Itoa(int(s.cfg.RetryAfter.Seconds())),
+		)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+
+	if fault == FaultTruncate {
+		_, _ = w.Write(body[:len(body)/2])
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		reset(w)
+		return
+	}
+	_, _ = w.Write(body)
+}
+
+func (s *Server) record(status int, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status != 0 {
+		s.statuses[status]++
+	}
+	if fault != FaultNone {
+		s.faults[fault]++
+	}
+}
+
+func (s *Server) pickFault() Fault {
+	x := rand.Float64()
+	switch {
+	case x < s.cfg.ResetRate:
+		return FaultReset
+	case x < s.cfg.ResetRate+s.cfg.TruncateRate:
+		return FaultTruncate
+	default:
+		return FaultNone
+	}
+}
+
+func (s *Server) pickStatus() int {
+	var total float64
+	for _, weight := range s.cfg.Statuses {
+		total += weight
+	}
+	if total <= 0 {
+		return http.StatusOK
+	}
+	x := rand.Float64() * total
+	var fallback int
+	for status, weight := range s.cfg.Statuses {
+		if x < weight {
+			return status
+		}
+		x -= weight
+		fallback = status
+	}
+	return fallback
+}
+
+// reset closes the underlying connection, sending RST instead of FIN.
+func reset(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	_ = conn.Close()
+}
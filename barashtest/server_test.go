@@ -0,0 +1,238 @@
+package barashtest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, s *Server) (*http.Response, error) {
+	t.Helper()
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		Timeout:   5 * time.Second,
+	}
+	return client.Get(s.URL)
+}
+
+func TestLatencies(t *testing.T) {
+	const samples = 1000
+	tests := []struct {
+		name    string
+		latency Latency
+		lo, hi  time.Duration
+	}{
+		{"constant", Constant(time.Second), time.Second, time.Second},
+		{
+			"uniform", Uniform(time.Millisecond, 3*time.Millisecond),
+			time.Millisecond, 3 * time.Millisecond,
+		},
+		{
+			"uniform swapped", Uniform(3*time.Millisecond, time.Millisecond),
+			time.Millisecond, 3 * time.Millisecond,
+		},
+		{
+			"uniform empty", Uniform(time.Second, time.Second),
+			time.Second, time.Second,
+		},
+		{
+			"normal", Normal(time.Millisecond, 10*time.Millisecond),
+			0, time.Duration(1<<63 - 1),
+		},
+		{
+			"exponential", Exponential(time.Millisecond),
+			0, time.Duration(1<<63 - 1),
+		},
+		{
+			"log-normal", LogNormal(time.Millisecond, 1),
+			0, time.Duration(1<<63 - 1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sum time.Duration
+			for range samples {
+				d := tt.latency()
+				if d < tt.lo || d > tt.hi {
+					t.Fatalf("latency %v out of [%v, %v]", d, tt.lo, tt.hi)
+				}
+				sum += d
+			}
+			if tt.lo == 0 && sum == 0 {
+				t.Fatal("all latencies are zero")
+			}
+		})
+	}
+}
+
+func TestServerLatency(t *testing.T) {
+	s := NewServer(ServerConfig{Latency: Constant(50 * time.Millisecond)})
+	defer s.Close()
+
+	start := time.Now()
+	resp, err := get(t, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("responded after %v, want at least 50ms", elapsed)
+	}
+}
+
+func TestServerStatuses(t *testing.T) {
+	const requests = 400
+	s := NewServer(ServerConfig{
+		Statuses: map[int]float64{
+			http.StatusOK:                  3,
+			http.StatusInternalServerError: 1,
+			http.StatusNotFound:            0,
+		},
+	})
+	defer s.Close()
+
+	got := map[int]int{}
+	for range requests {
+		resp, err := get(t, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		got[resp.StatusCode]++
+	}
+	if s.Requests() != requests {
+		t.Fatalf("server counted %d requests, want %d", s.Requests(), requests)
+	}
+	statuses := s.Statuses()
+	for status, n := range got {
+		if statuses[status] != n {
+			t.Fatalf("server counted %d responses with %d, client got %d",
+				statuses[status], status, n)
+		}
+	}
+	if got[http.StatusNotFound] != 0 {
+		t.Fatalf("got %d responses with zero weight", got[http.StatusNotFound])
+	}
+	// The expected share of 200 is 0.75, the standard deviation is about
+	// 0.02, so the bounds are never crossed in practice
+	share := float64(got[http.StatusOK]) / requests
+	if share < 0.6 || share > 0.9 {
+		t.Fatalf("share of 200 responses is %.2f, want about 0.75", share)
+	}
+}
+
+func TestServerDefaultStatus(t *testing.T) {
+	s := NewServer(ServerConfig{})
+	defer s.Close()
+
+	resp, err := get(t, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "{}" {
+		t.Fatalf("got %d %q, want 200 {}", resp.StatusCode, body)
+	}
+}
+
+func TestServerRetryAfter(t *testing.T) {
+	s := NewServer(ServerConfig{
+		Statuses:   map[int]float64{http.StatusTooManyRequests: 1},
+		RetryAfter: 2 * time.Second,
+	})
+	defer s.Close()
+
+	resp, err := get(t, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Fatalf("got Retry-After %q, want 2", got)
+	}
+}
+
+func TestServerBody(t *testing.T) {
+	s := NewServer(ServerConfig{
+		Statuses: map[int]float64{http.StatusTeapot: 1},
+		Body: func(r *http.Request, status int) []byte {
+			return []byte(r.URL.Query().Get("q") + http.StatusText(status))
+		},
+	})
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "?q=hello+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello I'm a teapot" {
+		t.Fatalf("got body %q", body)
+	}
+}
+
+func TestServerTruncate(t *testing.T) {
+	const requests = 5
+	s := NewServer(ServerConfig{
+		TruncateRate: 1,
+		Body: func(*http.Request, int) []byte {
+			return []byte(`{"items":[1,2,3,4,5,6,7,8,9]}`)
+		},
+	})
+	defer s.Close()
+
+	for range requests {
+		resp, err := get(t, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The client sees either an early EOF or the reset, depending on
+		// whether the part of the body arrives before the RST
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Fatalf("read truncated body %q without an error", body)
+		}
+	}
+	if got := s.Faults()[FaultTruncate]; got != requests {
+		t.Fatalf("server counted %d truncated responses, want %d",
+			got, requests)
+	}
+	if got := s.Statuses()[http.StatusOK]; got != requests {
+		t.Fatalf("server counted %d responses with 200, want %d",
+			got, requests)
+	}
+}
+
+func TestServerReset(t *testing.T) {
+	const requests = 5
+	s := NewServer(ServerConfig{ResetRate: 1})
+	defer s.Close()
+
+	for range requests {
+		resp, err := get(t, s)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("got status %d from a reset connection", resp.StatusCode)
+		}
+	}
+	if got := s.Faults()[FaultReset]; got != requests {
+		t.Fatalf("server counted %d reset connections, want %d",
+			got, requests)
+	}
+	if got := len(s.Statuses()); got != 0 {
+		t.Fatalf("server counted %d statuses for reset connections", got)
+	}
+}
@@ -0,0 +1,105 @@
+package barashtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kiltia/barash"
+)
+
+var (
+	_ barash.Source[barash.StoredParams] = &Source[barash.StoredParams]{}
+	_ barash.Sink[barash.StoredResult]   = &Sink[barash.StoredResult]{}
+)
+
+var ErrInjected = errors.New("injected sink failure")
+
+// Source is an in-memory task storage which returns the tasks in batches
+// of the given size, and counts the selected batches. The select statement
+// and query state are ignored.
+type Source[P any] struct {
+	*barash.SliceSource[P]
+	calls atomic.Int64
+}
+
+func NewSource[P any](tasks []P, batchSize int) *Source[P] {
+	return &Source[P]{SliceSource: barash.NewSliceSource(tasks, batchSize)}
+}
+
+func (s *Source[P]) GetNextBatch(
+	ctx context.Context,
+	selectSQL string,
+	state barash.QueryState[P],
+) ([]P, error) {
+	s.calls.Add(1)
+	return s.SliceSource.GetNextBatch(ctx, selectSQL, state)
+}
+
+// Calls returns the number of selected batches.
+func (s *Source[P]) Calls() int {
+	return int(s.calls.Load())
+}
+
+// Sink is an in-memory result storage.
+type Sink[S any] struct {
+	mu          sync.Mutex
+	results     []S
+	batches     int
+	initialized bool
+	failures    int
+}
+
+func NewSink[S any]() *Sink[S] {
+	return &Sink[S]{}
+}
+
+func (s *Sink[S]) InsertBatch(_ context.Context, batch []S) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return ErrInjected
+	}
+	s.results = append(s.results, batch...)
+	s.batches++
+	return nil
+}
+
+func (s *Sink[S]) InitTable(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initialized = true
+	return nil
+}
+
+// FailNext makes the next n inserts fail with ErrInjected.
+func (s *Sink[S]) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// Results returns all written results.
+func (s *Sink[S]) Results() []S {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]S, len(s.results))
+	copy(results, s.results)
+	return results
+}
+
+// Batches returns the number of successful inserts.
+func (s *Sink[S]) Batches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+// Initialized reports whether InitTable has been called.
+func (s *Sink[S]) Initialized() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.initialized
+}
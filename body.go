@@ -0,0 +1,231 @@
+package barash
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/kiltia/barash/config"
+	"resty.dev/v3"
+)
+
+// ErrBodyTooLarge is wrapped by the error passed to IntoStored when the
+// response body exceeds the size limit of its target and is aborted.
+var ErrBodyTooLarge = errors.New("response body exceeds the size limit")
+
+// Blob is a response body streamed to the blob directory instead of being
+// read into memory.
+type Blob struct {
+	// Path of the file, named by the SHA-256 hash of the body
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// Whether the body has been cut at the size limit
+	Truncated bool `json:"truncated"`
+}
+
+// bodyInfo describes a response body which hasn't been read as is.
+type bodyInfo struct {
+	// Whether the body has exceeded the size limit
+	oversized bool
+	// Whether the body has been dropped because of the limit
+	aborted bool
+	blob    *Blob
+}
+
+type bodyInfoKey struct{}
+
+// responseBodyInfo returns how the body of the response has been read, or
+// nil if it has been read as is.
+func responseBodyInfo(resp *resty.Response) *bodyInfo {
+	if resp == nil || resp.RawResponse == nil ||
+		resp.RawResponse.Request == nil {
+		return nil
+	}
+	info, _ := resp.RawResponse.Request.Context().Value(bodyInfoKey{}).(*bodyInfo)
+	return info
+}
+
+func validateResponseBody(cfg config.ResponseBodyConfig) error {
+	switch cfg.OnLimit {
+	case "", config.BodyLimitAbort, config.BodyLimitTruncate:
+	default:
+		return fmt.Errorf("unknown body limit action: %s", cfg.OnLimit)
+	}
+	if cfg.MaxSize < 0 || cfg.BlobThreshold < 0 {
+		return errors.New("body sizes must not be negative")
+	}
+	return nil
+}
+
+// bodyTransport reads response bodies within the limits of a target before
+// they reach the client, so huge or endless bodies aren't buffered.
+type bodyTransport struct {
+	base http.RoundTripper
+	cfg  config.ResponseBodyConfig
+}
+
+// newBodyTransport wraps the transport if the settings limit bodies or
+// stream them to files.
+func newBodyTransport(
+	base http.RoundTripper,
+	cfg config.ResponseBodyConfig,
+) (http.RoundTripper, error) {
+	if err := validateResponseBody(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.MaxSize == 0 && cfg.BlobDir == "" {
+		return base, nil
+	}
+	if cfg.BlobDir != "" {
+		if err := os.MkdirAll(cfg.BlobDir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating blob directory: %w", err)
+		}
+	}
+	return &bodyTransport{base: base, cfg: cfg}, nil
+}
+
+// newTargetTransport applies the body limits of a target to the transport.
+// The limits are placed below the recorder of captures, so recorded bodies
+// are never read past the limit either.
+func newTargetTransport(
+	transport http.RoundTripper,
+	cfg config.ResponseBodyConfig,
+) (http.RoundTripper, error) {
+	recorder, ok := transport.(*RecordingTransport)
+	if !ok {
+		return newBodyTransport(transport, cfg)
+	}
+	limited, err := newBodyTransport(recorder.base, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return recorder.withBase(limited), nil
+}
+
+func (t *bodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	body, info, err := t.read(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	if info != nil {
+		// The response carries the info to the runner through its request
+		sent := resp.Request
+		if sent == nil {
+			sent = req
+		}
+		resp.Request = sent.WithContext(
+			context.WithValue(sent.Context(), bodyInfoKey{}, info),
+		)
+	}
+	return resp, nil
+}
+
+// read returns the part of the body kept in memory, along with the info if
+// the body has exceeded the limit or has been streamed to a file.
+func (t *bodyTransport) read(body io.Reader) ([]byte, *bodyInfo, error) {
+	limit := t.cfg.MaxSize
+	if t.cfg.BlobDir == "" || (limit > 0 && t.cfg.BlobThreshold >= limit) {
+		data, err := io.ReadAll(io.LimitReader(body, limit+1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading response body: %w", err)
+		}
+		if int64(len(data)) <= limit {
+			return data, nil, nil
+		}
+		if t.cfg.OnLimit == config.BodyLimitTruncate {
+			return data[:limit], &bodyInfo{oversized: true}, nil
+		}
+		return nil, &bodyInfo{oversized: true, aborted: true}, nil
+	}
+
+	head, err := io.ReadAll(io.LimitReader(body, t.cfg.BlobThreshold+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading response body: %w", err)
+	}
+	if int64(len(head)) <= t.cfg.BlobThreshold {
+		return head, nil, nil
+	}
+	info, err := t.writeBlob(io.MultiReader(bytes.NewReader(head), body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("writing response body to blob: %w", err)
+	}
+	return nil, info, nil
+}
+
+// writeBlob streams the body to a temporary file, which is renamed after the
+// hash of its content once the body is read. Equal bodies share the file.
+func (t *bodyTransport) writeBlob(body io.Reader) (*bodyInfo, error) {
+	file, err := os.CreateTemp(t.cfg.BlobDir, ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		file.Close()
+		if !committed {
+			os.Remove(file.Name())
+		}
+	}()
+
+	limit := t.cfg.MaxSize
+	src := body
+	if limit > 0 {
+		src = io.LimitReader(body, limit)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), src)
+	if err != nil {
+		return nil, err
+	}
+	oversized := false
+	if limit > 0 && size == limit {
+		var probe [1]byte
+		n, _ := io.ReadFull(body, probe[:])
+		oversized = n > 0
+	}
+	if oversized && t.cfg.OnLimit != config.BodyLimitTruncate {
+		return &bodyInfo{oversized: true, aborted: true}, nil
+	}
+
+	if err := file.Chmod(0o644); err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	// Files are spread over subdirectories by the first byte of the hash
+	dir := filepath.Join(t.cfg.BlobDir, sum[:2])
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, sum)
+	if err := os.Rename(file.Name(), path); err != nil {
+		return nil, err
+	}
+	committed = true
+	return &bodyInfo{
+		oversized: oversized,
+		blob: &Blob{
+			Path:      path,
+			SHA256:    sum,
+			Size:      size,
+			Truncated: oversized,
+		},
+	}, nil
+}
@@ -0,0 +1,251 @@
+package barash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/kiltia/barash/config"
+	"resty.dev/v3"
+)
+
+// bodyServer answers with a body of the size passed in the query.
+func bodyServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+			w.Write(bodyOf(size))
+		},
+	))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func bodyOf(size int) []byte {
+	body := make([]byte, size)
+	for i := range body {
+		body[i] = byte('a' + i%26)
+	}
+	return body
+}
+
+// fetchBody sends a request through the body transport and returns the
+// body passed to the client with the info of how it has been read.
+func fetchBody(
+	t *testing.T,
+	srv *httptest.Server,
+	cfg config.ResponseBodyConfig,
+	size int,
+) ([]byte, *bodyInfo) {
+	t.Helper()
+	transport, err := newBodyTransport(http.DefaultTransport, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(srv.URL + "?size=" + strconv.Itoa(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Fatalf(
+			"content length is %d, the body has %d bytes",
+			resp.ContentLength,
+			len(body),
+		)
+	}
+	return body, responseBodyInfo(&resty.Response{RawResponse: resp})
+}
+
+func TestBodyLimit(t *testing.T) {
+	srv := bodyServer(t)
+	tests := []struct {
+		name    string
+		onLimit string
+		size    int
+		want    []byte
+		// Nil if the body is read as is
+		info *bodyInfo
+	}{
+		{"abort within limit", config.BodyLimitAbort, 10, bodyOf(10), nil},
+		{
+			"abort", config.BodyLimitAbort, 11, nil,
+			&bodyInfo{oversized: true, aborted: true},
+		},
+		// Aborting is the default
+		{"default", "", 100, nil, &bodyInfo{oversized: true, aborted: true}},
+		{
+			"truncate within limit",
+			config.BodyLimitTruncate,
+			10,
+			bodyOf(10),
+			nil,
+		},
+		{
+			"truncate", config.BodyLimitTruncate, 100, bodyOf(10),
+			&bodyInfo{oversized: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, info := fetchBody(t, srv, config.ResponseBodyConfig{
+				MaxSize: 10,
+				OnLimit: tt.onLimit,
+			}, tt.size)
+			if !bytes.Equal(body, tt.want) {
+				t.Fatalf("client got %q, want %q", body, tt.want)
+			}
+			if (info == nil) != (tt.info == nil) ||
+				info != nil && *info != *tt.info {
+				t.Fatalf("body info is %+v, want %+v", info, tt.info)
+			}
+		})
+	}
+}
+
+func TestBodyBlobSpill(t *testing.T) {
+	srv := bodyServer(t)
+	tests := []struct {
+		name    string
+		maxSize int64
+		onLimit string
+		size    int
+		// Size of the blob, zero if the body isn't spilled
+		blob      int
+		truncated bool
+		aborted   bool
+	}{
+		{name: "below threshold", size: 5},
+		{name: "unlimited", size: 100, blob: 100},
+		{name: "within limit", maxSize: 50, size: 50, blob: 50},
+		{
+			name:    "truncate",
+			maxSize: 50,
+			onLimit: config.BodyLimitTruncate,
+			size:    100, blob: 50, truncated: true,
+		},
+		{name: "abort", maxSize: 50, size: 100, aborted: true},
+		// Bodies can't exceed the threshold within the limit, so they're
+		// never spilled
+		{name: "limit at threshold", maxSize: 5, size: 100, aborted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			body, info := fetchBody(t, srv, config.ResponseBodyConfig{
+				MaxSize:       tt.maxSize,
+				OnLimit:       tt.onLimit,
+				BlobDir:       dir,
+				BlobThreshold: 5,
+			}, tt.size)
+			files := blobFiles(t, dir)
+
+			if tt.blob == 0 {
+				if len(files) != 0 {
+					t.Fatalf("blob directory has files %v", files)
+				}
+				if tt.aborted {
+					if len(body) != 0 || info == nil || !info.aborted {
+						t.Fatalf("body of %d bytes isn't aborted", tt.size)
+					}
+					return
+				}
+				if !bytes.Equal(body, bodyOf(tt.size)) || info != nil {
+					t.Fatalf("client got %q with info %+v", body, info)
+				}
+				return
+			}
+
+			// A spilled body isn't passed to the client
+			if len(body) != 0 || info == nil || info.blob == nil ||
+				info.aborted || info.oversized != tt.truncated {
+				t.Fatalf("client got %q with info %+v", body, info)
+			}
+			want := bodyOf(tt.blob)
+			sum := sha256.Sum256(want)
+			hash := hex.EncodeToString(sum[:])
+			path := filepath.Join(dir, hash[:2], hash)
+			if *info.blob != (Blob{
+				Path:      path,
+				SHA256:    hash,
+				Size:      int64(tt.blob),
+				Truncated: tt.truncated,
+			}) {
+				t.Fatalf("blob is %+v", info.blob)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, want) {
+				t.Fatalf("blob has %q, want %q", data, want)
+			}
+			// Temporary files are renamed, so only the blob is left
+			if len(files) != 1 {
+				t.Fatalf("blob directory has files %v", files)
+			}
+		})
+	}
+}
+
+func TestBodyBlobsAreShared(t *testing.T) {
+	srv := bodyServer(t)
+	dir := t.TempDir()
+	cfg := config.ResponseBodyConfig{BlobDir: dir, BlobThreshold: 5}
+	_, first := fetchBody(t, srv, cfg, 100)
+	_, second := fetchBody(t, srv, cfg, 100)
+	if first == nil || second == nil || first.blob.Path != second.blob.Path {
+		t.Fatalf("equal bodies are spilled to %+v and %+v", first, second)
+	}
+	if files := blobFiles(t, dir); len(files) != 1 {
+		t.Fatalf("blob directory has files %v", files)
+	}
+}
+
+func TestBodyTransportSettings(t *testing.T) {
+	base := http.DefaultTransport
+	transport, err := newBodyTransport(base, config.ResponseBodyConfig{})
+	if err != nil || transport != base {
+		t.Fatalf("unlimited bodies wrap the transport: %v", err)
+	}
+	for _, cfg := range []config.ResponseBodyConfig{
+		{MaxSize: 10, OnLimit: "drop"},
+		{MaxSize: -1},
+		{BlobDir: t.TempDir(), BlobThreshold: -1},
+	} {
+		if _, err := newBodyTransport(base, cfg); err == nil {
+			t.Fatalf("settings %+v are accepted", cfg)
+		}
+	}
+}
+
+func blobFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(
+		dir,
+		func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
@@ -0,0 +1,321 @@
+package barash
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kiltia/barash/config"
+)
+
+// Capture is a single upstream interaction stored as a JSONL line.
+type Capture struct {
+	StartedAt time.Time         `json:"started_at"`
+	Duration  time.Duration     `json:"duration"`
+	Request   CapturedRequest   `json:"request"`
+	Response  *CapturedResponse `json:"response,omitempty"`
+	// Transport error, if the request has failed without a response
+	Error string `json:"error,omitempty"`
+}
+
+type CapturedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+type CapturedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+func (c *CapturedRequest) key() string {
+	h := sha256.Sum256(c.Body)
+	return c.Method + " " + c.URL + " " + hex.EncodeToString(h[:8])
+}
+
+// DefaultRedactedHeaders are redacted in recordings unless other headers are
+// set, since they carry credentials.
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+const redactedHeader = "REDACTED"
+
+// RecordingTransport passes requests to the base transport and writes each
+// interaction to the output as a JSONL line. Values of the redacted headers
+// aren't written.
+type RecordingTransport struct {
+	base   http.RoundTripper
+	redact []string
+
+	// Shared by the recorders of the same output
+	mu  *sync.Mutex
+	out io.Writer
+}
+
+func NewRecordingTransport(
+	base http.RoundTripper,
+	out io.Writer,
+) *RecordingTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &RecordingTransport{base: base, mu: &sync.Mutex{}, out: out}
+	t.RedactHeaders(DefaultRedactedHeaders...)
+	return t
+}
+
+// withBase returns a recorder to the same output on top of another
+// transport.
+func (t *RecordingTransport) withBase(
+	base http.RoundTripper,
+) *RecordingTransport {
+	recorder := *t
+	recorder.base = base
+	return &recorder
+}
+
+// RedactHeaders replaces the headers redacted in recordings.
+func (t *RecordingTransport) RedactHeaders(names ...string) {
+	t.redact = make([]string, len(names))
+	for i, name := range names {
+		t.redact[i] = http.CanonicalHeaderKey(name)
+	}
+}
+
+// redacted returns a copy of the header without the values of the redacted
+// headers.
+func (t *RecordingTransport) redacted(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range t.redact {
+		if values, ok := header[name]; ok {
+			for i := range values {
+				values[i] = redactedHeader
+			}
+		}
+	}
+	return header
+}
+
+func (t *RecordingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	capture := Capture{
+		StartedAt: time.Now(),
+		Request: CapturedRequest{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Header: t.redacted(req.Header),
+		},
+	}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %w", err)
+		}
+		capture.Request.Body = body
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		capture.Duration = time.Since(capture.StartedAt)
+		capture.Error = err.Error()
+		t.write(capture)
+		return resp, err
+	}
+
+	body, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	capture.Duration = time.Since(capture.StartedAt)
+	capture.Response = &CapturedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     t.redacted(resp.Header),
+		Body:       body,
+	}
+	if readErr != nil {
+		capture.Error = readErr.Error()
+	}
+	t.write(capture)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, readErr
+}
+
+func (t *RecordingTransport) write(capture Capture) {
+	line, err := json.Marshal(capture)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, _ = t.out.Write(line)
+}
+
+var ErrNoCapture = errors.New("no capture for request")
+
+// ReplayTransport serves recorded interactions back instead of calling the
+// upstream. Requests are matched by method, URL and body; repeated requests
+// get the recorded responses in order, and the last one is served again
+// once they are exhausted.
+type ReplayTransport struct {
+	preserveTiming bool
+
+	mu       sync.Mutex
+	captures map[string][]Capture
+}
+
+func NewReplayTransport(
+	in io.Reader,
+	preserveTiming bool,
+) (*ReplayTransport, error) {
+	t := &ReplayTransport{
+		preserveTiming: preserveTiming,
+		captures:       map[string][]Capture{},
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var capture Capture
+		if err := json.Unmarshal(scanner.Bytes(), &capture); err != nil {
+			return nil, fmt.Errorf("decoding capture: %w", err)
+		}
+		key := capture.Request.key()
+		t.captures[key] = append(t.captures[key], capture)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading captures: %w", err)
+	}
+	return t, nil
+}
+
+func (t *ReplayTransport) next(key string) (Capture, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	queue := t.captures[key]
+	if len(queue) == 0 {
+		return Capture{}, false
+	}
+	if len(queue) > 1 {
+		t.captures[key] = queue[1:]
+	}
+	return queue[0], true
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	request := CapturedRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+	}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %w", err)
+		}
+		request.Body = body
+	}
+
+	capture, ok := t.next(request.key())
+	if !ok {
+		return nil, fmt.Errorf(
+			"%w: %s %s",
+			ErrNoCapture,
+			request.Method,
+			request.URL,
+		)
+	}
+
+	if t.preserveTiming {
+		if err := sleepContext(req.Context(), capture.Duration); err != nil {
+			return nil, err
+		}
+	}
+
+	if capture.Response == nil {
+		return nil, errors.New(capture.Error)
+	}
+	return &http.Response{
+		Status: fmt.Sprintf(
+			"%d %s",
+			capture.Response.StatusCode,
+			http.StatusText(capture.Response.StatusCode),
+		),
+		StatusCode:    capture.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        capture.Response.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(capture.Response.Body)),
+		ContentLength: int64(len(capture.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// initCapture installs recording or replay transport on the client. The
+// returned closer flushes the recording.
+func initCapture(
+	cfg config.CaptureConfig,
+	base http.RoundTripper,
+) (http.RoundTripper, io.Closer, error) {
+	switch cfg.Mode {
+	case "":
+		return nil, nil, nil
+	case config.CaptureModeRecord:
+		file, err := os.Create(cfg.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating capture file: %w", err)
+		}
+		transport := NewRecordingTransport(base, file)
+		if cfg.RedactHeaders != nil {
+			transport.RedactHeaders(cfg.RedactHeaders...)
+		}
+		return transport, file, nil
+	case config.CaptureModeReplay:
+		file, err := os.Open(cfg.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening capture file: %w", err)
+		}
+		defer file.Close()
+		transport, err := NewReplayTransport(file, cfg.PreserveTiming)
+		if err != nil {
+			return nil, nil, err
+		}
+		return transport, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown capture mode: %s", cfg.Mode)
+	}
+}
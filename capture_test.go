@@ -0,0 +1,199 @@
+package barash
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type captureCall struct {
+	method, path, body string
+}
+
+func (c captureCall) do(
+	t *testing.T,
+	client *http.Client,
+	url string,
+) (int, string, error) {
+	t.Helper()
+	req, err := http.NewRequest(c.method, url+c.path, strings.NewReader(c.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// captureUpstream answers with the request and the number of times it has
+// been seen, and sets a cookie.
+func captureUpstream() *httptest.Server {
+	var (
+		mu   sync.Mutex
+		seen = map[string]int{}
+	)
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			key := r.Method + " " + r.URL.String() + " " + string(body)
+			mu.Lock()
+			seen[key]++
+			n := seen[key]
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			w.Header().Set("Set-Cookie", "session=cookie-value")
+			w.Header().Set("X-Seen", "yes")
+			if r.Method == http.MethodPost {
+				w.WriteHeader(http.StatusCreated)
+			}
+			_, _ = io.WriteString(w, key+" #"+strconv.Itoa(n))
+		},
+	))
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	calls := []captureCall{
+		{http.MethodGet, "/a", ""},
+		{http.MethodGet, "/a", ""},
+		{http.MethodGet, "/a?q=1", ""},
+		{http.MethodPost, "/b", "x"},
+		{http.MethodPost, "/b", "y"},
+	}
+	upstream := captureUpstream()
+	var recording bytes.Buffer
+	recorder := &http.Client{
+		Transport: NewRecordingTransport(nil, &recording),
+	}
+	type answer struct {
+		status int
+		body   string
+	}
+	var recorded []answer
+	for _, call := range calls {
+		status, body, err := call.do(t, recorder, upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded = append(recorded, answer{status, body})
+	}
+	url := upstream.URL
+	upstream.Close()
+
+	// Credentials don't get into the recording, other headers do
+	for _, secret := range []string{"secret", "cookie-value"} {
+		if bytes.Contains(recording.Bytes(), []byte(secret)) {
+			t.Fatalf("recording contains %q", secret)
+		}
+	}
+	if !bytes.Contains(recording.Bytes(), []byte(redactedHeader)) ||
+		!bytes.Contains(recording.Bytes(), []byte("X-Seen")) {
+		t.Fatalf("recording has unexpected headers: %s", recording.Bytes())
+	}
+
+	replay, err := NewReplayTransport(bytes.NewReader(recording.Bytes()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: replay}
+	// Responses come back in the order of the matching requests, whatever
+	// order the requests are replayed in
+	order := []int{4, 0, 3, 2, 1}
+	for _, i := range order {
+		start := time.Now()
+		status, body, err := calls[i].do(t, client, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != recorded[i].status || body != recorded[i].body {
+			t.Fatalf(
+				"replayed %d %q for %+v, want %d %q",
+				status,
+				body,
+				calls[i],
+				recorded[i].status,
+				recorded[i].body,
+			)
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Fatalf("replayed %+v in %v without its timing", calls[i], elapsed)
+		}
+	}
+	// The last response is served again once the recorded ones run out
+	if _, body, _ := calls[1].do(t, client, url); body != recorded[1].body {
+		t.Fatalf(
+			"replayed %q after the recorded ones, want %q",
+			body,
+			recorded[1].body,
+		)
+	}
+
+	// Method, URL and body must all match
+	for _, call := range []captureCall{
+		{http.MethodPut, "/b", "x"},
+		{http.MethodGet, "/b", ""},
+		{http.MethodPost, "/b", "z"},
+	} {
+		if _, _, err := call.do(t, client, url); !errors.Is(err, ErrNoCapture) {
+			t.Fatalf("replayed %+v with error %v, want ErrNoCapture", call, err)
+		}
+	}
+}
+
+func TestCaptureTransportError(t *testing.T) {
+	upstream := captureUpstream()
+	url := upstream.URL
+	upstream.Close()
+
+	var recording bytes.Buffer
+	recorder := &http.Client{
+		Transport: NewRecordingTransport(nil, &recording),
+	}
+	call := captureCall{http.MethodGet, "/a", ""}
+	if _, _, err := call.do(t, recorder, url); err == nil {
+		t.Fatal("request to a closed server succeeded")
+	}
+
+	replay, err := NewReplayTransport(&recording, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = call.do(t, &http.Client{Transport: replay}, url)
+	if err == nil || errors.Is(err, ErrNoCapture) {
+		t.Fatalf("replayed a failed request with error %v", err)
+	}
+}
+
+func TestCaptureRedactHeaders(t *testing.T) {
+	transport := NewRecordingTransport(nil, io.Discard)
+	transport.RedactHeaders("x-custom")
+	header := http.Header{
+		"Authorization": {"Bearer secret"},
+		"X-Custom":      {"a", "b"},
+	}
+	redacted := transport.redacted(header)
+	if got := redacted.Get("Authorization"); got != "Bearer secret" {
+		t.Fatalf("Authorization is %q once other headers are redacted", got)
+	}
+	if got := redacted.Values("X-Custom"); len(got) != 2 ||
+		got[0] != redactedHeader || got[1] != redactedHeader {
+		t.Fatalf("X-Custom is %v, want every value redacted", got)
+	}
+	if header.Get("X-Custom") != "a" {
+		t.Fatal("original header is modified")
+	}
+}
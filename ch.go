@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
@@ -15,6 +17,8 @@ import (
 var (
 	_ Sink[StoredResult]   = &ClickhouseSink[StoredResult]{}
 	_ Source[StoredParams] = &ClickhouseSource[StoredParams]{}
+	_ LeasingSource        = &ClickhouseSource[StoredParams]{}
+	_ CheckpointStore      = &ClickhouseCheckpointStore{}
 )
 
 type ClickhouseWrapper struct {
@@ -80,6 +84,10 @@ type ClickhouseSink[S StoredResult] struct {
 type ClickhouseSource[P StoredParams] struct {
 	ClickhouseWrapper
 	selectTable string
+	funcs       template.FuncMap
+
+	leaseTableMu    sync.Mutex
+	leaseTableReady bool
 }
 
 func NewClickhouseSink[S StoredResult](
@@ -119,6 +127,19 @@ func (s *ClickhouseSink[S]) InsertBatch(
 	batch []S,
 ) error {
 	zap.S().Debug("inserting a batch to the database")
+	// Results with idempotency keys are deduplicated within the batch, and
+	// the batch gets a deduplication token, so ClickHouse drops the batch
+	// when the writer retries it. Non-replicated tables need the
+	// non_replicated_deduplication_window setting for the token to work.
+	// Across batches, use a ReplacingMergeTree ordered by the key column.
+	batch, keys := dedupBatch(batch)
+	if len(keys) > 0 && len(keys) == len(batch) {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(
+			clickhouse.Settings{
+				"insert_deduplication_token": NewIdempotencyKey(keys),
+			},
+		))
+	}
 	query := fmt.Sprintf("INSERT INTO %s", s.insertTable)
 	zap.S().Debugw(
 		"Sending query to the database",
@@ -143,7 +164,7 @@ func (client *ClickhouseSource[P]) GetNextBatch(
 	queryBuilder QueryState[P],
 ) (result []P, err error) {
 	zap.S().Debug("retrieving a new batch from the database")
-	tmpl, err := template.New("query").Parse(sql)
+	tmpl, err := template.New("query").Funcs(client.funcs).Parse(sql)
 	if err != nil {
 		return nil, fmt.Errorf("parsing sql: %w", err)
 	}
@@ -163,6 +184,162 @@ func (client *ClickhouseSource[P]) GetNextBatch(
 	return result, client.Conn.Select(ctx, &result, query)
 }
 
+// SetTemplateFuncs registers functions available in the select template.
+func (client *ClickhouseSource[P]) SetTemplateFuncs(funcs template.FuncMap) {
+	client.funcs = funcs
+}
+
+// ensureLeaseTable creates the lease table on first use.
+func (client *ClickhouseSource[P]) ensureLeaseTable(
+	ctx context.Context,
+	table string,
+) error {
+	client.leaseTableMu.Lock()
+	defer client.leaseTableMu.Unlock()
+	if client.leaseTableReady {
+		return nil
+	}
+	query := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (
+			key String,
+			replica String,
+			expires_at DateTime64(3),
+			updated_at DateTime64(6)
+		) ENGINE = ReplacingMergeTree(updated_at) ORDER BY key`,
+		table,
+	)
+	if err := client.Conn.Exec(ctx, query); err != nil {
+		return fmt.Errorf("creating lease table: %w", err)
+	}
+	client.leaseTableReady = true
+	return nil
+}
+
+// Claim leases the tasks in three steps: it skips tasks with live leases of
+// other replicas, writes leases for the rest and reads them back to find out
+// which ones the replica has won. Replicas racing for the same task may both
+// consider it theirs, so leases are best-effort and should be combined with
+// idempotency keys when duplicates matter.
+func (client *ClickhouseSource[P]) Claim(
+	ctx context.Context,
+	keys []string,
+	lease Lease,
+) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if err := client.ensureLeaseTable(ctx, lease.Table); err != nil {
+		return nil, err
+	}
+
+	held, err := client.leaseOwners(ctx, keys, lease.Table)
+	if err != nil {
+		return nil, err
+	}
+	var free []string
+	for _, key := range keys {
+		owner, ok := held[key]
+		if !ok || owner == lease.ReplicaID {
+			free = append(free, key)
+		}
+	}
+	if len(free) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	err = client.writeLeases(
+		ctx,
+		free,
+		lease.ReplicaID,
+		now.Add(lease.TTL),
+		lease.Table,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	held, err = client.leaseOwners(ctx, free, lease.Table)
+	if err != nil {
+		return nil, err
+	}
+	claimed := make([]string, 0, len(free))
+	for _, key := range free {
+		if held[key] == lease.ReplicaID {
+			claimed = append(claimed, key)
+		}
+	}
+	return claimed, nil
+}
+
+// Release expires the leases, so they are free for every replica.
+func (client *ClickhouseSource[P]) Release(
+	ctx context.Context,
+	keys []string,
+	lease Lease,
+) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return client.writeLeases(
+		ctx,
+		keys,
+		lease.ReplicaID,
+		time.Unix(0, 0),
+		lease.Table,
+	)
+}
+
+// leaseOwners returns replicas holding live leases on the given keys.
+func (client *ClickhouseSource[P]) leaseOwners(
+	ctx context.Context,
+	keys []string,
+	table string,
+) (map[string]string, error) {
+	query := fmt.Sprintf(
+		`SELECT key, replica FROM %s FINAL
+		WHERE key IN (?) AND expires_at > now64(3)`,
+		table,
+	)
+	rows, err := client.Conn.Query(ctx, query, keys)
+	if err != nil {
+		return nil, fmt.Errorf("selecting leases: %w", err)
+	}
+	defer rows.Close()
+	owners := make(map[string]string, len(keys))
+	for rows.Next() {
+		var key, replica string
+		if err := rows.Scan(&key, &replica); err != nil {
+			return nil, fmt.Errorf("scanning leases: %w", err)
+		}
+		owners[key] = replica
+	}
+	return owners, rows.Err()
+}
+
+func (client *ClickhouseSource[P]) writeLeases(
+	ctx context.Context,
+	keys []string,
+	replica string,
+	expiresAt time.Time,
+	table string,
+) error {
+	batch, err := client.Conn.PrepareBatch(
+		ctx,
+		fmt.Sprintf("INSERT INTO %s", table),
+	)
+	if err != nil {
+		return fmt.Errorf("preparing leases: %w", err)
+	}
+	now := time.Now()
+	for _, key := range keys {
+		if err := batch.Append(key, replica, expiresAt, now); err != nil {
+			return fmt.Errorf("appending lease: %w", err)
+		}
+	}
+	return batch.Send()
+}
+
 func (s *ClickhouseSink[S]) InitTable(
 	ctx context.Context,
 ) error {
@@ -172,3 +349,100 @@ func (s *ClickhouseSink[S]) InitTable(
 		nilInstance.GetCreateQuery(s.insertTable),
 	)
 }
+
+type ClickhouseCheckpointStore struct {
+	ClickhouseWrapper
+	table string
+	name  string
+}
+
+func NewClickhouseCheckpointStore(
+	cfg config.CheckpointConfig,
+) (*ClickhouseCheckpointStore, error) {
+	w, err := NewClickhouseWrapper(cfg.DatabaseConfig)
+	if err != nil {
+		return nil, err
+	}
+	store := &ClickhouseCheckpointStore{
+		ClickhouseWrapper: *w,
+		table:             cfg.Table,
+		name:              cfg.Name,
+	}
+	query := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (
+			name String,
+			state String,
+			batches UInt64,
+			rows UInt64,
+			completed Bool,
+			updated_at DateTime64(3)
+		) ENGINE = ReplacingMergeTree(updated_at) ORDER BY name`,
+		store.table,
+	)
+	err = store.Conn.Exec(context.Background(), query)
+	if err != nil {
+		return nil, fmt.Errorf("creating checkpoint table: %w", err)
+	}
+	return store, nil
+}
+
+func (s *ClickhouseCheckpointStore) Load(
+	ctx context.Context,
+) (*Checkpoint, error) {
+	query := fmt.Sprintf(
+		`SELECT name, state, batches, rows, completed, updated_at
+		FROM %s WHERE name = ? ORDER BY updated_at DESC LIMIT 1`,
+		s.table,
+	)
+	rows, err := s.Conn.Query(ctx, query, s.name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var (
+		cp    Checkpoint
+		state string
+	)
+	err = rows.Scan(
+		&cp.Name,
+		&state,
+		&cp.Batches,
+		&cp.Rows,
+		&cp.Completed,
+		&cp.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	cp.State = []byte(state)
+	return &cp, nil
+}
+
+func (s *ClickhouseCheckpointStore) Save(
+	ctx context.Context,
+	cp Checkpoint,
+) error {
+	query := fmt.Sprintf("INSERT INTO %s", s.table)
+	batch, err := s.Conn.PrepareBatch(ctx, query)
+	if err != nil {
+		return err
+	}
+	if cp.UpdatedAt.IsZero() {
+		cp.UpdatedAt = time.Now()
+	}
+	err = batch.Append(
+		s.name,
+		string(cp.State),
+		cp.Batches,
+		cp.Rows,
+		cp.Completed,
+		cp.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	return batch.Send()
+}
@@ -0,0 +1,270 @@
+package barash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kiltia/barash/config"
+	"go.uber.org/zap"
+)
+
+var _ CheckpointStore = &FileCheckpointStore{}
+
+// Checkpoint holds the runner progress in two-table mode.
+type Checkpoint struct {
+	Name string `json:"name"`
+	// Serialized QueryState, which is used to select the next batch
+	State json.RawMessage `json:"state"`
+	// High-water mark: number of source batches and rows whose results
+	// have been written to all sinks. Rows count every selected row,
+	// including the ones filtered out by shards and leases
+	Batches uint64 `json:"batches"`
+	Rows    uint64 `json:"rows"`
+	// Completed is set when the source has been drained
+	Completed bool      `json:"completed"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type FileCheckpointStore struct {
+	path string
+}
+
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{path: path}
+}
+
+func (s *FileCheckpointStore) Load(_ context.Context) (*Checkpoint, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint file: %w", err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("decoding checkpoint file: %w", err)
+	}
+	return &cp, nil
+}
+
+// Save writes the checkpoint to a temporary file and renames it, so a crash
+// in the middle of the write never leaves a corrupted checkpoint behind.
+func (s *FileCheckpointStore) Save(_ context.Context, cp Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("encoding checkpoint: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".checkpoint-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary checkpoint file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing checkpoint: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func initCheckpointStore(
+	cfg config.CheckpointConfig,
+) (CheckpointStore, error) {
+	switch cfg.Backend {
+	case config.CheckpointBackendFile:
+		return NewFileCheckpointStore(cfg.Path), nil
+	case config.CheckpointBackendClickhouse:
+		creds, err := loadCreds(cfg.Backend)
+		if err != nil {
+			return nil, fmt.Errorf("loading credentials: %w", err)
+		}
+		cfg.Credentials = *creds
+		return NewClickhouseCheckpointStore(cfg)
+	default:
+		return nil, fmt.Errorf("unknown checkpoint backend: %s", cfg.Backend)
+	}
+}
+
+type pendingBatch struct {
+	// Number of tasks whose results haven't been written yet
+	remaining int
+	// Number of rows selected from the source
+	rows  int
+	state json.RawMessage
+	// Called once all tasks of the batch are written
+	onComplete func()
+}
+
+// batchTracker follows source batches through the pipeline. A batch is
+// committed once the results of all its tasks have been written and all
+// batches selected before it have been committed too. Tasks rejected by the
+// circuit breaker are delayed rather than dropped, so every batch is
+// eventually completed.
+type batchTracker struct {
+	mu sync.Mutex
+	// Sequence number of the first pending batch
+	head    uint64
+	pending []*pendingBatch
+	drained bool
+
+	committed Checkpoint
+}
+
+// register adds a new batch of tasks selected from the given number of rows
+// to the tracker and returns its sequence number. Sequence numbers start
+// from 1, zero is reserved for untracked tasks.
+func (t *batchTracker) register(
+	tasks int,
+	rows int,
+	state json.RawMessage,
+	onComplete func(),
+) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, &pendingBatch{
+		remaining:  tasks,
+		rows:       rows,
+		state:      state,
+		onComplete: onComplete,
+	})
+	return t.head + uint64(len(t.pending))
+}
+
+// done marks one task of the batch as written. If it was the last task of
+// the batch, the completion callback of the batch is returned.
+func (t *batchTracker) done(seq uint64) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq <= t.head || seq > t.head+uint64(len(t.pending)) {
+		return nil
+	}
+	batch := t.pending[seq-t.head-1]
+	batch.remaining--
+	if batch.remaining == 0 {
+		return batch.onComplete
+	}
+	return nil
+}
+
+// extend adds tasks to the batch, so it isn't committed until they are
+// written too.
+func (t *batchTracker) extend(seq uint64, rows int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq <= t.head || seq > t.head+uint64(len(t.pending)) {
+		return
+	}
+	t.pending[seq-t.head-1].remaining += rows
+}
+
+// finish marks the source as drained.
+func (t *batchTracker) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.drained = true
+}
+
+// commit moves the high-water mark over the completed batches. It returns
+// the number of batches committed by the call and reports whether the
+// checkpoint has changed since the last call.
+func (t *batchTracker) commit() (Checkpoint, int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	committed := 0
+	for len(t.pending) > 0 && t.pending[0].remaining <= 0 {
+		batch := t.pending[0]
+		t.pending = t.pending[1:]
+		t.head++
+		t.committed.State = batch.state
+		t.committed.Batches++
+		t.committed.Rows += uint64(batch.rows)
+		committed++
+	}
+	changed := committed > 0
+	if t.drained && len(t.pending) == 0 && !t.committed.Completed {
+		t.committed.Completed = true
+		changed = true
+	}
+	return t.committed, committed, changed
+}
+
+// restoreCheckpoint loads the last checkpoint and applies it to the query
+// state, so the provider continues from where the previous run stopped.
+func (r *Runner[S, R, P, Q]) restoreCheckpoint(ctx context.Context) error {
+	if r.checkpoints == nil {
+		return nil
+	}
+	cp, err := r.checkpoints.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("loading checkpoint: %w", err)
+	}
+	if cp == nil {
+		zap.S().Infow("no checkpoint found, starting from scratch")
+		return nil
+	}
+	if len(cp.State) > 0 {
+		if err := json.Unmarshal(cp.State, &r.queryBuilder); err != nil {
+			return fmt.Errorf("restoring query state: %w", err)
+		}
+	}
+	// Sources which ignore the query state skip the rows read before
+	if src, ok := r.src.(ResumableSource); ok && cp.Rows > 0 {
+		if err := src.Skip(cp.Rows); err != nil {
+			return fmt.Errorf("skipping processed rows: %w", err)
+		}
+	}
+	r.tracker.committed = *cp
+	r.tracker.committed.Completed = false
+	zap.S().Infow(
+		"resuming from checkpoint",
+		"name", cp.Name,
+		"batches", cp.Batches,
+		"rows", cp.Rows,
+		"completed", cp.Completed,
+		"updated_at", cp.UpdatedAt,
+	)
+	return nil
+}
+
+// commitProgress acknowledges completed batches to the source and persists
+// the progress after a successful write.
+func (r *Runner[S, R, P, Q]) commitProgress(ctx context.Context) {
+	cp, committed, changed := r.tracker.commit()
+	if src, ok := r.src.(CommittingSource); ok && committed > 0 {
+		if err := src.Commit(ctx, committed); err != nil {
+			zap.S().Errorw(
+				"committing batches to the source",
+				"batches", committed,
+				"error", err,
+			)
+		}
+	}
+	if r.checkpoints == nil || !changed {
+		return
+	}
+	cp.Name = r.config().Provider.Checkpoint.Name
+	cp.UpdatedAt = time.Now()
+	if err := r.checkpoints.Save(ctx, cp); err != nil {
+		zap.S().Errorw("saving checkpoint", "error", err)
+		return
+	}
+	zap.S().Debugw(
+		"saved checkpoint",
+		"batches", cp.Batches,
+		"rows", cp.Rows,
+		"completed", cp.Completed,
+	)
+}
@@ -0,0 +1,171 @@
+package barash
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestBatchTrackerSequence(t *testing.T) {
+	var tracker batchTracker
+	for want := uint64(1); want <= 3; want++ {
+		if got := tracker.register(1, 1, nil, nil); got != want {
+			t.Fatalf("registered batch %d, want %d", got, want)
+		}
+	}
+	tracker.done(1)
+	tracker.commit()
+	if got := tracker.register(1, 1, nil, nil); got != 4 {
+		t.Fatalf("registered batch %d after a commit, want 4", got)
+	}
+}
+
+func TestBatchTrackerCommitsInOrder(t *testing.T) {
+	var tracker batchTracker
+	first := tracker.register(2, 2, json.RawMessage(`1`), nil)
+	second := tracker.register(1, 1, json.RawMessage(`2`), nil)
+	third := tracker.register(1, 1, json.RawMessage(`3`), nil)
+
+	// A completed batch waits for the ones selected before it
+	tracker.done(second)
+	tracker.done(third)
+	if _, committed, changed := tracker.commit(); committed != 0 || changed {
+		t.Fatalf("committed %d batches before the first one is done", committed)
+	}
+	tracker.done(first)
+	if _, committed, _ := tracker.commit(); committed != 0 {
+		t.Fatalf(
+			"committed %d batches with a task of the first left",
+			committed,
+		)
+	}
+
+	tracker.done(first)
+	cp, committed, changed := tracker.commit()
+	if committed != 3 || !changed {
+		t.Fatalf("committed %d batches, want 3", committed)
+	}
+	if cp.Batches != 3 || cp.Rows != 4 || string(cp.State) != `3` {
+		t.Fatalf(
+			"checkpoint has %d batches, %d rows and state %s, want 3, 4 and 3",
+			cp.Batches,
+			cp.Rows,
+			cp.State,
+		)
+	}
+	if _, committed, changed := tracker.commit(); committed != 0 || changed {
+		t.Fatal("checkpoint has changed without new batches")
+	}
+}
+
+func TestBatchTrackerOnComplete(t *testing.T) {
+	var tracker batchTracker
+	completed := 0
+	seq := tracker.register(2, 2, nil, func() { completed++ })
+
+	if onComplete := tracker.done(seq); onComplete != nil {
+		t.Fatal("callback is returned before the last task is done")
+	}
+	onComplete := tracker.done(seq)
+	if onComplete == nil {
+		t.Fatal("callback isn't returned after the last task is done")
+	}
+	onComplete()
+	if completed != 1 {
+		t.Fatalf("callback is called %d times, want 1", completed)
+	}
+}
+
+func TestBatchTrackerExtend(t *testing.T) {
+	var tracker batchTracker
+	seq := tracker.register(1, 1, nil, nil)
+	// Follow-ups of the task are added before the task itself is written
+	tracker.extend(seq, 2)
+	tracker.done(seq)
+	tracker.done(seq)
+	if _, committed, _ := tracker.commit(); committed != 0 {
+		t.Fatal("batch is committed before its follow-ups are written")
+	}
+	tracker.done(seq)
+	cp, committed, _ := tracker.commit()
+	if committed != 1 {
+		t.Fatalf("committed %d batches, want 1", committed)
+	}
+	// Follow-ups aren't counted as selected rows
+	if cp.Rows != 1 {
+		t.Fatalf("checkpoint has %d rows, want 1", cp.Rows)
+	}
+}
+
+func TestBatchTrackerEmptyBatch(t *testing.T) {
+	var tracker batchTracker
+	// All selected rows belong to other shards
+	empty := tracker.register(0, 3, json.RawMessage(`1`), nil)
+	cp, committed, _ := tracker.commit()
+	if committed != 1 {
+		t.Fatalf("committed %d empty batches, want 1", committed)
+	}
+	// Filtered rows are counted, so resumed sources skip them too
+	if cp.Rows != 3 {
+		t.Fatalf("checkpoint has %d rows, want 3", cp.Rows)
+	}
+	// Sequence numbers of committed batches are ignored
+	if onComplete := tracker.done(empty); onComplete != nil {
+		t.Fatal("callback is returned for a committed batch")
+	}
+	tracker.extend(empty, 1)
+	tracker.done(0)
+	tracker.done(100)
+	if _, committed, changed := tracker.commit(); committed != 0 || changed {
+		t.Fatal("checkpoint has changed after unknown batches are done")
+	}
+}
+
+func TestBatchTrackerCompleted(t *testing.T) {
+	var tracker batchTracker
+	seq := tracker.register(1, 1, nil, nil)
+	tracker.finish()
+	if cp, _, _ := tracker.commit(); cp.Completed {
+		t.Fatal("checkpoint is completed with a pending batch")
+	}
+	tracker.done(seq)
+	cp, committed, changed := tracker.commit()
+	if committed != 1 || !changed || !cp.Completed {
+		t.Fatalf(
+			"committed %d batches and completed is %t, want 1 and true",
+			committed,
+			cp.Completed,
+		)
+	}
+	if _, _, changed := tracker.commit(); changed {
+		t.Fatal("completion is reported twice")
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint"))
+
+	cp, err := store.Load(ctx)
+	if err != nil || cp != nil {
+		t.Fatalf("loaded %v, %v without a file, want nothing", cp, err)
+	}
+	saved := Checkpoint{
+		Name:    "test",
+		State:   json.RawMessage(`{"offset":10}`),
+		Batches: 2,
+		Rows:    10,
+	}
+	if err := store.Save(ctx, saved); err != nil {
+		t.Fatal(err)
+	}
+	cp, err = store.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Name != saved.Name || string(cp.State) != string(saved.State) ||
+		cp.Batches != saved.Batches || cp.Rows != saved.Rows {
+		t.Fatalf("loaded %+v, want %+v", cp, saved)
+	}
+}
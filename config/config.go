@@ -29,17 +29,27 @@ const (
 
 type Config struct {
 	// Configuration of interaction between the runner and the API
-	API APIConfig `yaml:"api"      env:", prefix=API_"`
+	API APIConfig `yaml:"api"        env:", prefix=API_"`
 	// Settings related to the provider - the component that retrieves data from database
-	Provider ProviderConfig `yaml:"provider" env:", prefix=PROVIDER_"`
+	Provider ProviderConfig `yaml:"provider"   env:", prefix=PROVIDER_"`
 	// Settings related to the fetcher - the component that fetches data from the API
-	Fetcher FetcherConfig `yaml:"fetcher"  env:", prefix=FETCHER_"`
+	Fetcher FetcherConfig `yaml:"fetcher"    env:", prefix=FETCHER_"`
 	// Settings related to the writer - the component that saves results to the database
-	Writer WriterConfig `yaml:"writer"   env:", prefix=WRITER_"`
+	Writer WriterConfig `yaml:"writer"     env:", prefix=WRITER_"`
 	// Logger configuration
-	Log LogConfig `yaml:"log"      env:", prefix=LOG_"`
+	Log LogConfig `yaml:"log"        env:", prefix=LOG_"`
 	// Graceful shutdown logic configuration
-	Shutdown ShutdownConfig `yaml:"shutdown" env:", prefix=SHUTDOWN_"`
+	Shutdown ShutdownConfig `yaml:"shutdown"   env:", prefix=SHUTDOWN_"`
+	// Request rendering without sending, can be enabled with -dry-run flag
+	DryRun DryRunConfig `yaml:"dry_run"    env:", prefix=DRY_RUN_"`
+	// Runtime control API
+	Admin AdminConfig `yaml:"admin"      env:", prefix=ADMIN_"`
+	// OpenTelemetry tracing
+	Tracing TracingConfig `yaml:"tracing"    env:", prefix=TRACING_"`
+	// Report written when the run is finished
+	Summary SummaryConfig `yaml:"summary"    env:", prefix=SUMMARY_"`
+	// Service level objectives which fail the run when breached
+	Assertions AssertionsConfig `yaml:"assertions" env:", prefix=ASSERTIONS_"`
 
 	// It can be two-table or continuous mode.
 	// Two-table mode allows to get data from one table and save it to another.
@@ -62,6 +72,145 @@ type APIConfig struct {
 	MaxWaitTime time.Duration `yaml:"max_wait_time"  env:"MAX_WAIT_TIME"`
 	// Request extension
 	BodyFilePath string `yaml:"body_file_path" env:"BODY_FILE_PATH"`
+	// Recording and replay of upstream interactions
+	Capture CaptureConfig `yaml:"capture"        env:", prefix=CAPTURE_"`
+	// Endpoints the traffic is split between instead of the request URL
+	Targets []TargetConfig `yaml:"targets"`
+	// Following paginated responses
+	Pagination PaginationConfig `yaml:"pagination"     env:", prefix=PAGINATION_"`
+	// Checks of the responses, targets may override them
+	Validation ValidationConfig `yaml:"validation"     env:", prefix=VALIDATION_"`
+	// Format responses are decoded from, JSON if empty, or "auto" to choose
+	// it by the Content-Type header
+	Decoder string `yaml:"decoder"        env:"DECODER"`
+	// Limits of response bodies, targets may override them
+	ResponseBody ResponseBodyConfig `yaml:"response_body"  env:", prefix=RESPONSE_BODY_"`
+}
+
+const (
+	BodyLimitAbort    string = "abort"
+	BodyLimitTruncate string = "truncate"
+)
+
+// ResponseBodyConfig limits how much of a response body is read, and which
+// bodies are written to files instead of memory.
+type ResponseBodyConfig struct {
+	// Maximum size of the body in bytes read from the response, unlimited
+	// if zero
+	MaxSize int64 `yaml:"max_size"       env:"MAX_SIZE"`
+	// Either "abort" to fail the request, which is the default, or
+	// "truncate" to keep the body up to the limit
+	OnLimit string `yaml:"on_limit"       env:"ON_LIMIT"`
+	// Directory bodies larger than the threshold are streamed to, named by
+	// their content hash
+	BlobDir string `yaml:"blob_dir"       env:"BLOB_DIR"`
+	// Size in bytes a body has to exceed to be streamed to a file
+	BlobThreshold int64 `yaml:"blob_threshold" env:"BLOB_THRESHOLD"`
+}
+
+const (
+	DecoderJSON     string = "json"
+	DecoderXML      string = "xml"
+	DecoderProtobuf string = "protobuf"
+	DecoderMsgpack  string = "msgpack"
+	DecoderCSV      string = "csv"
+	DecoderNDJSON   string = "ndjson"
+	DecoderText     string = "text"
+	DecoderRaw      string = "raw"
+	// Chooses the decoder by the Content-Type header of the response
+	DecoderAuto string = "auto"
+)
+
+// ValidationConfig describes the checks a response has to pass to be
+// considered successful. Empty fields disable the corresponding checks.
+type ValidationConfig struct {
+	// Accepted status codes. Listed 4xx and 5xx statuses aren't treated as
+	// errors, other statuses fail the validation
+	Statuses []int `yaml:"statuses"      env:"STATUSES"`
+	// Required headers with regular expressions their values must match,
+	// an empty expression only requires the header to be present
+	Headers map[string]string `yaml:"headers"       env:"HEADERS"`
+	// Path of the JSON Schema the body must conform to
+	JSONSchema string `yaml:"json_schema"   env:"JSON_SCHEMA"`
+	// Assertions on the values of the JSON body
+	Assertions []BodyAssertion `yaml:"assertions"`
+	// Regular expression the body must match
+	BodyRegex string `yaml:"body_regex"    env:"BODY_REGEX"`
+	// Maximum size of the body in bytes, checked once the body is read.
+	// ResponseBodyConfig.MaxSize stops reading larger bodies instead.
+	MaxBodySize int64 `yaml:"max_body_size" env:"MAX_BODY_SIZE"`
+}
+
+// BodyAssertion checks the values found by a JSONPath in the JSON body. The
+// path is a subset of JSONPath made of $, .name, ['name'], [index] and [*].
+type BodyAssertion struct {
+	Path string `yaml:"path"`
+	// Value all found values must be equal to
+	Equals any `yaml:"equals"`
+	// Regular expression all found values must match, numbers and booleans
+	// are matched in their JSON form
+	Matches string `yaml:"matches"`
+	// Require the path to find nothing instead of at least one value
+	Absent bool `yaml:"absent"`
+}
+
+const (
+	PaginationModeLink   string = "link"
+	PaginationModeCursor string = "cursor"
+)
+
+type PaginationConfig struct {
+	// Either "link" to follow the next link of the Link header, "cursor" to
+	// send the cursor from the response body, or empty to rely on the
+	// response
+	Mode string `yaml:"mode"         env:"MODE"`
+	// Dot-separated path of the cursor in the JSON body
+	CursorField string `yaml:"cursor_field" env:"CURSOR_FIELD"`
+	// Query parameter the cursor is sent in
+	CursorParam string `yaml:"cursor_param" env:"CURSOR_PARAM"`
+	// Limit of pages requested for a task, including the first one
+	MaxPages int `yaml:"max_pages"    env:"MAX_PAGES"`
+	// Store all pages of a task as a single result
+	Merge bool `yaml:"merge"        env:"MERGE"`
+}
+
+// TargetConfig describes an endpoint of the API. Settings which aren't set
+// are taken from the api section and the circuit breaker of the fetcher.
+type TargetConfig struct {
+	// Results record the name of the target which has served them
+	Name       string           `yaml:"name"`
+	RequestURL string           `yaml:"request_url"`
+	Method     RunnerHTTPMethod `yaml:"method"`
+	// Share of the tasks which aren't routed by their params, relative to
+	// the other targets
+	Weight         float64               `yaml:"weight"`
+	APITimeout     time.Duration         `yaml:"api_timeout"`
+	NumRetries     *int                  `yaml:"num_retries"`
+	MinWaitTime    time.Duration         `yaml:"min_wait_time"`
+	MaxWaitTime    time.Duration         `yaml:"max_wait_time"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Validation     *ValidationConfig     `yaml:"validation"`
+	Decoder        string                `yaml:"decoder"`
+	ResponseBody   *ResponseBodyConfig   `yaml:"response_body"`
+}
+
+type CaptureMode string
+
+const (
+	CaptureModeRecord CaptureMode = "record"
+	CaptureModeReplay CaptureMode = "replay"
+)
+
+type CaptureConfig struct {
+	// Either "record", "replay" or empty to disable captures
+	Mode CaptureMode `yaml:"mode"            env:"MODE"`
+	// JSONL file with captures
+	Path string `yaml:"path"            env:"PATH"`
+	// Replay captures with their original latency
+	PreserveTiming bool `yaml:"preserve_timing" env:"PRESERVE_TIMING"`
+	// Headers whose values are redacted in recordings, credential headers
+	// such as Authorization, Cookie and X-Api-Key if unset
+	RedactHeaders []string `yaml:"redact_headers"  env:"REDACT_HEADERS"`
 }
 
 type DatabaseCredentials struct {
@@ -78,6 +227,47 @@ type CircuitBreakerConfig struct {
 	Timeout                 time.Duration `yaml:"timeout"                    env:"TIMEOUT"`
 }
 
+const (
+	ArrivalModelConstant string = "constant"
+	ArrivalModelPoisson  string = "poisson"
+	ArrivalModelProfile  string = "profile"
+)
+
+type ArrivalConfig struct {
+	// Either "constant", "poisson" or "profile", the worker pool is used if
+	// it's empty
+	Model string `yaml:"model"         env:"MODEL"`
+	// Requests per second for the constant and poisson models
+	Rate float64 `yaml:"rate"          env:"RATE"`
+	// Steps of the profile model, the executor stops after the last one
+	Profile []ArrivalStep `yaml:"profile"`
+	// Requests in flight, arrivals above it are dropped, defaults to 1000
+	MaxInFlight int `yaml:"max_in_flight" env:"MAX_IN_FLIGHT"`
+}
+
+type ArrivalStep struct {
+	Duration time.Duration `yaml:"duration"`
+	// Requests per second
+	Rate float64 `yaml:"rate"`
+	// Change the rate linearly from the previous step instead of stepping
+	Ramp bool `yaml:"ramp"`
+}
+
+type ScenarioConfig struct {
+	// Limit of requests in a scenario including the first one, follow-ups
+	// past it are dropped
+	MaxSteps int `yaml:"max_steps" env:"MAX_STEPS"`
+}
+
+// StageConfig is a step of a multi-stage load profile.
+type StageConfig struct {
+	// Results are tagged with the name of the stage they belong to
+	Name     string        `yaml:"name"`
+	Duration time.Duration `yaml:"duration"`
+	// Requests per second
+	RPS float64 `yaml:"rps"`
+}
+
 type FetcherConfig struct {
 	MinFetcherWorkers int `yaml:"min_fetcher_workers" env:"N_WORKERS"`
 	MaxFetcherWorkers int `yaml:"max_fetcher_workers" env:"MAX_WORKERS"`
@@ -86,6 +276,16 @@ type FetcherConfig struct {
 	EnableWarmup bool          `yaml:"enable_warmup"       env:"ENABLE_WARMUP"`
 	IdleTime     time.Duration `yaml:"idle_time"           env:"IDLE_TIME"`
 	Timeout      time.Duration `yaml:"timeout"             env:"TIMEOUT"`
+	// Limit of requests per second shared by all fetchers, unlimited if zero
+	RPS float64 `yaml:"rps"                 env:"RPS"`
+	// Open-loop executor which starts requests on a schedule instead of
+	// the worker pool
+	Arrival ArrivalConfig `yaml:"arrival"             env:", prefix=ARRIVAL_"`
+	// Load stages which set the rate one after another, the run ends
+	// once they are over
+	Stages []StageConfig `yaml:"stages"`
+	// Follow-up requests emitted by responses
+	Scenario ScenarioConfig `yaml:"scenario"            env:", prefix=SCENARIO_"`
 
 	// Circuit breaker can be configured to prevent Runner from overloading
 	// the API or sending too much bad responses to Clickhouse.
@@ -123,11 +323,61 @@ type SourceConfig struct {
 	DatabaseConfig `       yaml:",inline"`
 	SelectTable    string `yaml:"table"           env:"TABLE"`
 	SelectSQLPath  string `yaml:"select_sql_path" env:"SELECT_SQL"`
+	// Path to the file with tasks, used by file backends
+	Path string `yaml:"path"            env:"PATH"`
+	// Format of the tasks read by the stdin backend: csv or jsonl
+	Format string `yaml:"format"          env:"FORMAT"`
+
+	// Kafka backend configuration
+	Kafka KafkaConfig `yaml:"kafka" env:", prefix=KAFKA_"`
 }
 
 type SinkConfig struct {
 	DatabaseConfig `       yaml:",inline"`
-	InsertTable    string `yaml:"table"   env:"TABLE"`
+	InsertTable    string `yaml:"table"            env:"TABLE"`
+	// Number of recently written idempotency keys to remember in-process.
+	// Used to deduplicate results for sinks without native deduplication.
+	DedupCacheSize int `yaml:"dedup_cache_size" env:"DEDUP_CACHE_SIZE"`
+
+	// File backends configuration
+	File FileSinkConfig `yaml:"file" env:", prefix=FILE_"`
+
+	// Kafka backend configuration
+	Kafka KafkaConfig `yaml:"kafka" env:", prefix=KAFKA_"`
+}
+
+type KafkaConfig struct {
+	Brokers []string `yaml:"brokers"            env:"BROKERS"`
+	Topic   string   `yaml:"topic"              env:"TOPIC"`
+	// Consumer group of the source, offsets are committed to it once
+	// results are written
+	Group string `yaml:"group"              env:"GROUP"`
+	// Field of the task parameters used as the record key by the sink,
+	// matched against json, query and ch tags. Records are not keyed if
+	// it's empty.
+	Key string `yaml:"key"                env:"KEY"`
+	// Time to wait for new records before reporting an empty batch
+	PollTimeout time.Duration `yaml:"poll_timeout"       env:"POLL_TIMEOUT"`
+	// Topic settings used by the sink to create the topic if it's missing
+	Partitions        int32 `yaml:"partitions"         env:"PARTITIONS"`
+	ReplicationFactor int16 `yaml:"replication_factor" env:"REPLICATION_FACTOR"`
+}
+
+const (
+	CompressionGzip string = "gzip"
+	CompressionZstd string = "zstd"
+)
+
+type FileSinkConfig struct {
+	// Path prefix of the result files, a timestamp, a sequence number and
+	// an extension are appended to it
+	Path string `yaml:"path"            env:"PATH"`
+	// Start a new file when the current one exceeds the size in bytes
+	RotateSize int64 `yaml:"rotate_size"     env:"ROTATE_SIZE"`
+	// Start a new file when the current one is older than the interval
+	RotateInterval time.Duration `yaml:"rotate_interval" env:"ROTATE_INTERVAL"`
+	// Either "gzip", "zstd" or empty for no compression
+	Compression string `yaml:"compression"     env:"COMPRESSION"`
 }
 
 type ProviderConfig struct {
@@ -139,11 +389,93 @@ type ProviderConfig struct {
 
 	// Continuous mode specific configuration
 	ContinuousMode ContinuousModeConfig `yaml:"continuous_mode" env:", prefix=CONTINUOUS_"`
+
+	// Two-table mode progress persistence
+	Checkpoint CheckpointConfig `yaml:"checkpoint" env:", prefix=CHECKPOINT_"`
+
+	// Task claiming between several runner replicas
+	Lease LeaseConfig `yaml:"lease" env:", prefix=LEASE_"`
+
+	// Static split of the source between several runner replicas
+	Shard ShardConfig `yaml:"shard" env:", prefix=SHARD_"`
+
+	// Servers which accept tasks pushed by other services
+	Ingest IngestConfig `yaml:"ingest" env:", prefix=INGEST_"`
+}
+
+type IngestConfig struct {
+	// Address of the HTTP server, it's not started if empty
+	HTTPAddr string `yaml:"http_addr"       env:"HTTP_ADDR"`
+	// Address of the gRPC server, it's not started if empty
+	GRPCAddr string `yaml:"grpc_addr"       env:"GRPC_ADDR"`
+	// Bearer token required by both servers. Should be set with INGEST_TOKEN
+	// env var, the servers aren't started without it.
+	Token string `yaml:"token"           env:"TOKEN"`
+	// Maximum number of tasks in a single push, 1000 if zero
+	MaxBatchSize int `yaml:"max_batch_size"  env:"MAX_BATCH_SIZE"`
+	// Maximum size of an HTTP request body or a gRPC message in bytes, 10 MiB
+	// if zero
+	MaxBodySize int64 `yaml:"max_body_size"   env:"MAX_BODY_SIZE"`
+	// Time to wait for room in the fetcher queue before the rest of the
+	// batch is rejected
+	EnqueueTimeout time.Duration `yaml:"enqueue_timeout" env:"ENQUEUE_TIMEOUT"`
+}
+
+type ShardConfig struct {
+	// Index of the shard owned by the replica, starting from zero
+	Index int `yaml:"index"     env:"INDEX"`
+	// Total number of shards, sharding is disabled if it's less than two
+	Count int `yaml:"count"     env:"COUNT"`
+	// Field of the request parameters to hash, matched against json, query
+	// and ch tags
+	Key string `yaml:"key"       env:"KEY"`
+	// Set if the select statement filters the shard itself, using
+	// shardIndex and shardCount template functions
+	PushDown bool `yaml:"push_down" env:"PUSH_DOWN"`
+}
+
+type LeaseConfig struct {
+	Enabled bool `yaml:"enabled"    env:"ENABLED"`
+	// Unique identifier of the replica, defaults to hostname and PID
+	ReplicaID string `yaml:"replica_id" env:"REPLICA_ID"`
+	// Time after which a lease held by a crashed replica can be reclaimed.
+	// It must be set and should be longer than the time needed to process a
+	// batch.
+	TTL time.Duration `yaml:"ttl"        env:"TTL"`
+	// Field of the request parameters which identifies a task, matched
+	// against json, query and ch tags. Required unless the parameters
+	// implement StoredParamsWithKey.
+	Key string `yaml:"key"        env:"KEY"`
+	// Table to store leases in, barash_leases by default
+	Table string `yaml:"table"      env:"TABLE"`
+}
+
+const (
+	CheckpointBackendFile       string = "file"
+	CheckpointBackendClickhouse string = "clickhouse"
+)
+
+type CheckpointConfig struct {
+	Enabled bool `yaml:"enabled" env:"ENABLED"`
+	// Name identifies the job, so several runners can share one
+	// checkpoint table
+	Name string `yaml:"name"    env:"NAME"`
+	// Backend is either "file" or "clickhouse"
+	DatabaseConfig `       yaml:",inline"`
+	// Path to the checkpoint file, used by the file backend
+	Path string `yaml:"path"    env:"PATH"`
+	// Table to store checkpoints in, used by the clickhouse backend
+	Table string `yaml:"table"   env:"TABLE"`
 }
 
 const (
 	BackendClickhouse string = "clickhouse"
 	BackendPostgres   string = "postgres"
+	BackendCSV        string = "csv"
+	BackendJSONL      string = "jsonl"
+	BackendParquet    string = "parquet"
+	BackendStdin      string = "stdin"
+	BackendKafka      string = "kafka"
 )
 
 type WriterConfig struct {
@@ -157,18 +489,152 @@ type WriterConfig struct {
 	Correction CorrectionConfig `yaml:"correction" env:", prefix=CORRECTION_"`
 }
 
+type DryRunConfig struct {
+	Enabled bool `yaml:"enabled" env:"ENABLED"`
+	// Number of requests to render before exiting
+	Limit int `yaml:"limit"   env:"LIMIT"`
+	// File to write rendered requests to, stdout is used if it's empty
+	Output string `yaml:"output"  env:"OUTPUT"`
+}
+
+type AdminConfig struct {
+	// Address of the admin HTTP server, it's not started if empty
+	Addr string `yaml:"addr"  env:"ADDR"`
+	// Bearer token required by the admin API. Should be set with ADMIN_TOKEN
+	// env var, the server isn't started without it.
+	Token string `yaml:"token" env:"TOKEN"`
+}
+
+const (
+	TracingProtocolGRPC string = "grpc"
+	TracingProtocolHTTP string = "http"
+)
+
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"      env:"ENABLED"`
+	// Address of the OTLP collector, host and port
+	Endpoint string `yaml:"endpoint"     env:"ENDPOINT"`
+	// Either "grpc" or "http", defaults to grpc
+	Protocol string `yaml:"protocol"     env:"PROTOCOL"`
+	// Disable TLS for the collector connection
+	Insecure    bool   `yaml:"insecure"     env:"INSECURE"`
+	ServiceName string `yaml:"service_name" env:"SERVICE_NAME"`
+	// Fraction of traces to sample, all traces are sampled if it's zero
+	SampleRatio float64 `yaml:"sample_ratio" env:"SAMPLE_RATIO"`
+}
+
+const (
+	SummaryFormatJSON string = "json"
+	SummaryFormatHTML string = "html"
+)
+
+type SummaryConfig struct {
+	// File to write the summary to, it's only logged if empty
+	Path string `yaml:"path"     env:"PATH"`
+	// Either "json" or "html", taken from the file extension if empty
+	Format string `yaml:"format"   env:"FORMAT"`
+	// Width of the throughput buckets, defaults to 10s
+	Interval time.Duration `yaml:"interval" env:"INTERVAL"`
+}
+
+// AssertionsConfig holds limits checked during and after the run. Zero
+// values disable the corresponding assertions.
+type AssertionsConfig struct {
+	// Attempt latency percentiles
+	MaxP50Latency time.Duration `yaml:"max_p50_latency"  env:"MAX_P50_LATENCY"`
+	MaxP95Latency time.Duration `yaml:"max_p95_latency"  env:"MAX_P95_LATENCY"`
+	MaxP99Latency time.Duration `yaml:"max_p99_latency"  env:"MAX_P99_LATENCY"`
+	// Failed tasks in percent of all tasks, unset disables the assertion
+	MaxErrorRate *float64 `yaml:"max_error_rate"   env:"MAX_ERROR_RATE"`
+	// Completed tasks per second, only checked at the end of the run
+	MinRPS         float64 `yaml:"min_rps"          env:"MIN_RPS"`
+	NoBreakerTrips bool    `yaml:"no_breaker_trips" env:"NO_BREAKER_TRIPS"`
+	// How often the assertions are checked while running, defaults to 10s
+	CheckInterval time.Duration `yaml:"check_interval"   env:"CHECK_INTERVAL"`
+	// Tasks to complete before the assertions are checked while running,
+	// defaults to 100
+	MinTasks int64 `yaml:"min_tasks"        env:"MIN_TASKS"`
+	// Stop the run as soon as an assertion is breached
+	Abort bool `yaml:"abort"            env:"ABORT"`
+}
+
 type LogConfig struct {
 	Level    zapcore.Level `yaml:"level"    env:"LEVEL"`
 	Encoding string        `yaml:"encoding" env:"ENCODING"`
 }
 
-var configPath string
+var (
+	configPath string
+	dryRun     DryRunConfig
+)
 
 func init() {
 	flag.StringVar(&configPath, "config", "", "Path to YAML configuration file")
+	flag.BoolVar(
+		&dryRun.Enabled,
+		"dry-run",
+		false,
+		"Render requests without sending them and exit",
+	)
+	flag.IntVar(
+		&dryRun.Limit,
+		"dry-run-limit",
+		10,
+		"Number of requests to render in dry-run mode",
+	)
+	flag.StringVar(
+		&dryRun.Output,
+		"dry-run-output",
+		"",
+		"File to write rendered requests to in dry-run mode",
+	)
 	_ = godotenv.Load() // load the user-defined `.env` file
 }
 
+// applyFlags overrides the configuration with explicitly set flags.
+func applyFlags(cfg *Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dry-run":
+			cfg.DryRun.Enabled = dryRun.Enabled
+		case "dry-run-limit":
+			cfg.DryRun.Limit = dryRun.Limit
+		case "dry-run-output":
+			cfg.DryRun.Output = dryRun.Output
+		}
+	})
+	if cfg.DryRun.Enabled && cfg.DryRun.Limit <= 0 {
+		cfg.DryRun.Limit = dryRun.Limit
+	}
+}
+
+// Redacted returns a copy of the configuration without credentials and
+// tokens, which is safe to show.
+func (c Config) Redacted() Config {
+	const redacted = "REDACTED"
+	redact := func(creds *DatabaseCredentials) {
+		if creds.Username != "" {
+			creds.Username = redacted
+		}
+		if creds.Password != "" {
+			creds.Password = redacted
+		}
+	}
+	redact(&c.Provider.Source.Credentials)
+	redact(&c.Provider.Checkpoint.Credentials)
+	c.Writer.Sinks = append([]SinkConfig(nil), c.Writer.Sinks...)
+	for i := range c.Writer.Sinks {
+		redact(&c.Writer.Sinks[i].Credentials)
+	}
+	if c.Admin.Token != "" {
+		c.Admin.Token = redacted
+	}
+	if c.Provider.Ingest.Token != "" {
+		c.Provider.Ingest.Token = redacted
+	}
+	return c
+}
+
 func Load() (*Config, error) {
 	flag.Parse()
 	var cfg *Config
@@ -190,6 +656,7 @@ func Load() (*Config, error) {
 			log.Fatalf("loading configuration from %s: %v", configPath, err)
 		}
 	}
+	applyFlags(cfg)
 	return cfg, err
 }
 
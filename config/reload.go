@@ -0,0 +1,165 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WatchInterval is how often Watch checks the configuration file.
+var WatchInterval = 5 * time.Second
+
+// reloadableFields lists YAML paths of the fields which can be changed
+// while the runner is running.
+var reloadableFields = []string{
+	"api.api_timeout",
+	"api.num_retries",
+	"api.min_wait_time",
+	"api.max_wait_time",
+	"api.body_file_path",
+	"provider.sleep_time",
+	"provider.select_retries",
+	"fetcher.max_fetcher_workers",
+	"fetcher.idle_time",
+	"fetcher.rps",
+	"fetcher.circuit_breaker.enabled",
+	"fetcher.circuit_breaker.consecutive_failure",
+	"fetcher.circuit_breaker.total_failure_per_interval",
+	"writer.insert_batch_size",
+	"writer.save_tag",
+	"log.level",
+	"shutdown.grace_period",
+	"shutdown.db_save_timeout",
+}
+
+var logLevel = zap.NewAtomicLevel()
+
+// NewLogger builds a logger from the configuration. Its level follows
+// reloaded configurations.
+func NewLogger(cfg LogConfig) (*zap.Logger, error) {
+	zapCfg := zap.NewProductionConfig()
+	if cfg.Encoding != "" {
+		zapCfg.Encoding = cfg.Encoding
+	}
+	logLevel.SetLevel(cfg.Level)
+	zapCfg.Level = logLevel
+	return zapCfg.Build()
+}
+
+// SetLogLevel changes the level of the loggers built with NewLogger.
+func SetLogLevel(cfg LogConfig) {
+	logLevel.SetLevel(cfg.Level)
+}
+
+// Diff returns YAML paths of the fields which differ between the
+// configurations. Lists are compared as a whole.
+func Diff(old, updated *Config) []string {
+	return diffValues(
+		reflect.ValueOf(old).Elem(),
+		reflect.ValueOf(updated).Elem(),
+		"",
+		nil,
+	)
+}
+
+func diffValues(a, b reflect.Value, prefix string, diff []string) []string {
+	if a.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			diff = append(diff, prefix)
+		}
+		return diff
+	}
+	for i := range a.NumField() {
+		field := a.Type().Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		path := prefix
+		if opts != "inline" {
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if path != "" {
+				path += "."
+			}
+			path += name
+		}
+		diff = diffValues(a.Field(i), b.Field(i), path, diff)
+	}
+	return diff
+}
+
+// CheckReload returns the fields changed by the updated configuration. If
+// any of them can't be changed without a restart, an error listing them is
+// returned instead.
+func CheckReload(old, updated *Config) ([]string, error) {
+	changed := Diff(old, updated)
+	var unsafe []string
+	for _, path := range changed {
+		if !slices.Contains(reloadableFields, path) {
+			unsafe = append(unsafe, path)
+		}
+	}
+	if len(unsafe) > 0 {
+		return nil, fmt.Errorf(
+			"fields can't be changed without a restart: %s",
+			strings.Join(unsafe, ", "),
+		)
+	}
+	return changed, nil
+}
+
+// Path returns the path of the configuration file read by Load.
+func Path() string {
+	return configPath
+}
+
+// Watch reloads the configuration file when it changes or when the process
+// receives SIGHUP, and passes the result to onChange until the context is
+// done. Flags are applied to reloaded configurations as well.
+func Watch(
+	ctx context.Context,
+	path string,
+	onChange func(cfg *Config, err error),
+) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	last, _ := os.ReadFile(path)
+	ticker := time.NewTicker(WatchInterval)
+	defer ticker.Stop()
+	for {
+		forced := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			forced = true
+		case <-ticker.C:
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			onChange(nil, err)
+			continue
+		}
+		if !forced && bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		cfg, err := LoadFromYAML(path)
+		if err != nil {
+			onChange(nil, err)
+			continue
+		}
+		applyFlags(cfg)
+		onChange(cfg, nil)
+	}
+}
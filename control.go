@@ -0,0 +1,235 @@
+package barash
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// fetcherControl holds the runtime state of the fetcher pool which can be
+// changed with the admin API.
+type fetcherControl struct {
+	mu     sync.Mutex
+	paused bool
+	// Fetchers with numbers above the target are parked
+	target int
+	// Number of fetchers started so far
+	started int
+	// Numbers of the fetchers which haven't exited yet
+	alive map[int]struct{}
+	// Set once the pool is shutting down, no fetchers are started after that
+	stopped bool
+	// Closed and replaced on every change, so parked fetchers can wait for
+	// it
+	changed chan struct{}
+	// Starts a fetcher with the given number, set by the pool
+	spawn func(fetcherNum int)
+	// Number of fetchers which are currently running, including parked ones
+	running atomic.Int32
+
+	limiter *rate.Limiter
+
+	drainOnce sync.Once
+	drain     chan struct{}
+}
+
+func newFetcherControl(workers int, rps float64) *fetcherControl {
+	return &fetcherControl{
+		target:  workers,
+		alive:   map[int]struct{}{},
+		changed: make(chan struct{}),
+		limiter: rate.NewLimiter(rpsLimit(rps), 1),
+		drain:   make(chan struct{}),
+	}
+}
+
+func rpsLimit(rps float64) rate.Limit {
+	if rps <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(rps)
+}
+
+// setSpawn is called by the pool to start the fetchers up to the target
+// worker count.
+func (c *fetcherControl) setSpawn(spawn func(fetcherNum int)) {
+	c.mu.Lock()
+	c.spawn = spawn
+	target := c.target
+	c.mu.Unlock()
+	c.setWorkers(target)
+}
+
+// notify wakes up the parked fetchers. Must be called with the mutex held.
+func (c *fetcherControl) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// changes returns a channel which is closed on the next change.
+func (c *fetcherControl) changes() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changed
+}
+
+// acquire blocks while fetching is paused or the fetcher is above the target
+// worker count. It returns false if the fetcher has to exit.
+func (c *fetcherControl) acquire(ctx context.Context, fetcherNum int) bool {
+	for {
+		c.mu.Lock()
+		if c.stopped {
+			c.mu.Unlock()
+			return false
+		}
+		if !c.paused && fetcherNum < c.target {
+			c.mu.Unlock()
+			return true
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// resumed blocks while fetching is paused. It returns false if the context
+// is done.
+func (c *fetcherControl) resumed(ctx context.Context) bool {
+	for {
+		c.mu.Lock()
+		if !c.paused {
+			c.mu.Unlock()
+			return true
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// wait blocks until the rate limit allows another request.
+func (c *fetcherControl) wait(ctx context.Context) error {
+	return c.limiter.Wait(ctx)
+}
+
+// stop is called once there are no more tasks for the pool. Parked fetchers
+// exit as well, and fetchers aren't started anymore.
+func (c *fetcherControl) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopLocked()
+}
+
+func (c *fetcherControl) stopLocked() {
+	if !c.stopped {
+		c.stopped = true
+		c.notify()
+	}
+}
+
+// exit is called by exiting fetchers. Once no fetcher below the target is
+// left, for example after all of them have been idle, parked fetchers would
+// wait forever, so the pool is stopped. Paused fetchers don't exit, so the
+// pool isn't stopped by a pause.
+func (c *fetcherControl) exit(fetcherNum int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.alive, fetcherNum)
+	for num := range c.alive {
+		if num < c.target {
+			return
+		}
+	}
+	c.stopLocked()
+}
+
+func (c *fetcherControl) setPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = paused
+	c.notify()
+}
+
+// setWorkers changes the target worker count, starting new fetchers if
+// there are not enough of them.
+func (c *fetcherControl) setWorkers(workers int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = workers
+	for !c.stopped && c.spawn != nil && c.started < workers {
+		c.alive[c.started] = struct{}{}
+		c.spawn(c.started)
+		c.started++
+	}
+	c.notify()
+}
+
+// expectedInterval returns the interval between requests of a single fetcher
+// implied by the rate limit, or zero if there's no limit.
+func (c *fetcherControl) expectedInterval() time.Duration {
+	limit := c.limiter.Limit()
+	if limit == rate.Inf || limit <= 0 {
+		return 0
+	}
+	workers := max(c.running.Load(), 1)
+	return time.Duration(
+		float64(workers) / float64(limit) * float64(time.Second),
+	)
+}
+
+func (c *fetcherControl) setRPS(rps float64) {
+	c.limiter.SetLimit(rpsLimit(rps))
+}
+
+// startDrain makes the provider stop selecting new tasks. Fetching is
+// resumed, so the queued tasks are processed before the runner exits.
+func (c *fetcherControl) startDrain() {
+	c.drainOnce.Do(func() {
+		close(c.drain)
+	})
+	c.setPaused(false)
+}
+
+func (c *fetcherControl) draining() <-chan struct{} {
+	return c.drain
+}
+
+type controlState struct {
+	Paused   bool    `json:"paused"`
+	Draining bool    `json:"draining"`
+	Workers  int     `json:"workers"`
+	Started  int     `json:"started"`
+	Running  int     `json:"running"`
+	RPS      float64 `json:"rps"`
+}
+
+func (c *fetcherControl) state() controlState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := controlState{
+		Paused:  c.paused,
+		Workers: c.target,
+		Started: c.started,
+		Running: int(c.running.Load()),
+	}
+	if limit := c.limiter.Limit(); limit != rate.Inf {
+		state.RPS = float64(limit)
+	}
+	select {
+	case <-c.drain:
+		state.Draining = true
+	default:
+	}
+	return state
+}
@@ -1,18 +1,77 @@
 package barash
 
 import (
+	"encoding"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 )
 
 const (
 	QueryTag = "query"
 	JSONTag  = "json"
+	CHTag    = "ch"
 )
 
+// ObjectKey returns the string representation of the field identified by
+// key. The key is matched against query, json and ch tags, and then against
+// the field name.
+//
+// If the object implements StoredParamsWithKey interface, it will be used
+// instead and the key is ignored.
+func ObjectKey(obj any, key string) (string, bool) {
+	if p, ok := obj.(StoredParamsWithKey); ok {
+		return p.TaskKey(), true
+	}
+
+	val := reflect.ValueOf(obj)
+	if val.Kind() == reflect.Pointer {
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return "", false
+	}
+	typ := val.Type()
+
+	for i := range val.NumField() {
+		field := typ.Field(i)
+		if !fieldMatches(field, key) {
+			continue
+		}
+		fieldValue := val.Field(i)
+		if isValueNil(fieldValue) {
+			return "", true
+		}
+		return valueToString(fieldValue), true
+	}
+	return "", false
+}
+
+func fieldMatches(field reflect.StructField, key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, tag := range []string{QueryTag, JSONTag, CHTag} {
+		// Fields without the tag have an empty name, and "-" excludes the
+		// field from the format, so neither is a key
+		name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name != "" && name != "-" && name == key {
+			return true
+		}
+	}
+	return field.Name == key
+}
+
+// hasTaskKey reports whether the parameters identify themselves with
+// StoredParamsWithKey, so no key field has to be configured.
+func hasTaskKey[P StoredParams]() bool {
+	_, ok := any(new(P)).(StoredParamsWithKey)
+	return ok
+}
+
 // ObjectToParams converts an object to a map of query parameters.
 //
 // Can work with both concrete and pointer types.
@@ -90,6 +149,117 @@ func ObjectToBody(obj any) (
 	return bytes
 }
 
+// RecordToObject fills the object from a record of named values, such as
+// a CSV row or a Parquet row. Record keys are matched against json and
+// query tags of the object fields.
+//
+// String values are parsed according to the field type, other values are
+// converted through their JSON representation.
+func RecordToObject(record map[string]any, obj any) error {
+	val := reflect.ValueOf(obj)
+	if val.Kind() != reflect.Pointer || val.IsNil() {
+		return fmt.Errorf("expected a non-nil pointer, got %T", obj)
+	}
+	val = val.Elem()
+	if val.Kind() != reflect.Struct {
+		return fmt.Errorf("expected a pointer to struct, got %T", obj)
+	}
+	typ := val.Type()
+
+	for i := range val.NumField() {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value, ok := recordValue(record, field)
+		if !ok || value == nil {
+			continue
+		}
+		err := setValue(val.Field(i), value)
+		if err != nil {
+			return fmt.Errorf("setting field %s: %w", field.Name, err)
+		}
+	}
+	return nil
+}
+
+func recordValue(
+	record map[string]any,
+	field reflect.StructField,
+) (any, bool) {
+	for _, tag := range []string{JSONTag, QueryTag} {
+		name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if value, ok := record[name]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func setValue(v reflect.Value, value any) error {
+	str, ok := value.(string)
+	if !ok {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+
+	// Empty cells are treated as missing values
+	if str == "" && v.Kind() != reflect.String {
+		return nil
+	}
+	if v.Kind() == reflect.Pointer {
+		v.Set(reflect.New(v.Type().Elem()))
+		return setValue(v.Elem(), value)
+	}
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(str))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(str, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint,
+		reflect.Uint8,
+		reflect.Uint16,
+		reflect.Uint32,
+		reflect.Uint64,
+		reflect.Uintptr:
+		n, err := strconv.ParseUint(str, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(str, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		// Slices, maps and nested structs are expected to be JSON-encoded
+		return json.Unmarshal([]byte(str), v.Addr().Interface())
+	}
+	return nil
+}
+
 func isValueNil(v reflect.Value) bool {
 	if !v.IsValid() {
 		return true
@@ -0,0 +1,61 @@
+package barash
+
+import "testing"
+
+type keyedParams struct {
+	ID string
+}
+
+func (p keyedParams) TaskKey() string { return "task-" + p.ID }
+
+func TestObjectKey(t *testing.T) {
+	type params struct {
+		Untagged string
+		ID       int     `json:"id"`
+		Name     string  `query:"name,omitempty"`
+		Column   string  `ch:"column_name"`
+		Optional *string `json:"optional"`
+		Ignored  string  `json:"-"`
+	}
+	obj := params{
+		Untagged: "untagged",
+		ID:       42,
+		Name:     "name",
+		Column:   "column",
+	}
+	tests := []struct {
+		key   string
+		value string
+		found bool
+	}{
+		{"id", "42", true},
+		{"name", "name", true},
+		{"column_name", "column", true},
+		{"Untagged", "untagged", true},
+		{"optional", "", true},
+		// An empty key must not match fields without tags
+		{"", "", false},
+		{"missing", "", false},
+		{"-", "", false},
+	}
+	for _, tt := range tests {
+		value, found := ObjectKey(&obj, tt.key)
+		if value != tt.value || found != tt.found {
+			t.Errorf(
+				"ObjectKey(%q) = %q, %t, want %q, %t",
+				tt.key,
+				value,
+				found,
+				tt.value,
+				tt.found,
+			)
+		}
+	}
+}
+
+func TestObjectKeyWithTaskKey(t *testing.T) {
+	value, found := ObjectKey(&keyedParams{ID: "1"}, "")
+	if value != "task-1" || !found {
+		t.Fatalf("ObjectKey() = %q, %t, want task-1, true", value, found)
+	}
+}
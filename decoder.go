@@ -0,0 +1,269 @@
+package barash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"reflect"
+	"strings"
+
+	"github.com/kiltia/barash/config"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Decoder decodes a response body into the value v points to.
+type Decoder interface {
+	Decode(body []byte, v any) error
+}
+
+// DecoderFunc adapts a function to the Decoder interface.
+type DecoderFunc func(body []byte, v any) error
+
+func (f DecoderFunc) Decode(body []byte, v any) error {
+	return f(body, v)
+}
+
+type namedDecoder struct {
+	decoder      Decoder
+	contentTypes []string
+}
+
+// builtinDecoders are available by name in the api and target settings.
+var builtinDecoders = map[string]namedDecoder{
+	config.DecoderJSON: {
+		decoder:      DecoderFunc(json.Unmarshal),
+		contentTypes: []string{"application/json"},
+	},
+	config.DecoderXML: {
+		decoder:      DecoderFunc(xml.Unmarshal),
+		contentTypes: []string{"application/xml", "text/xml"},
+	},
+	config.DecoderProtobuf: {
+		decoder: DecoderFunc(decodeProtobuf),
+		contentTypes: []string{
+			"application/protobuf",
+			"application/x-protobuf",
+			"application/vnd.google.protobuf",
+		},
+	},
+	config.DecoderMsgpack: {
+		decoder: DecoderFunc(decodeMsgpack),
+		contentTypes: []string{
+			"application/msgpack",
+			"application/x-msgpack",
+			"application/vnd.msgpack",
+		},
+	},
+	config.DecoderCSV: {
+		decoder:      DecoderFunc(decodeCSV),
+		contentTypes: []string{"text/csv"},
+	},
+	config.DecoderNDJSON: {
+		decoder: DecoderFunc(decodeNDJSON),
+		contentTypes: []string{
+			"application/x-ndjson",
+			"application/ndjson",
+			"application/jsonl",
+			"application/x-jsonlines",
+		},
+	},
+	// Plain text isn't chosen by the Content-Type, since it's also sniffed
+	// for JSON bodies sent without one
+	config.DecoderText: {decoder: DecoderFunc(decodeText)},
+	config.DecoderRaw: {
+		decoder:      DecoderFunc(decodeRaw),
+		contentTypes: []string{"application/octet-stream"},
+	},
+}
+
+// decoderSet picks decoders by name or by the media type of responses.
+type decoderSet struct {
+	byName map[string]Decoder
+	// Names of the decoders by media type
+	byType map[string]string
+}
+
+// newDecoderSet returns the built-in decoders along with the custom ones,
+// which replace built-in decoders with the same name or media types.
+func newDecoderSet(custom map[string]namedDecoder) *decoderSet {
+	set := &decoderSet{
+		byName: map[string]Decoder{},
+		byType: map[string]string{},
+	}
+	all := maps.Clone(builtinDecoders)
+	maps.Copy(all, custom)
+	for name, d := range all {
+		set.byName[name] = d.decoder
+	}
+	// Custom media types are added last to take precedence
+	for _, decoders := range []map[string]namedDecoder{builtinDecoders, custom} {
+		for name, d := range decoders {
+			for _, contentType := range d.contentTypes {
+				set.byType[strings.ToLower(contentType)] = name
+			}
+		}
+	}
+	return set
+}
+
+func (s *decoderSet) known(name string) bool {
+	_, ok := s.byName[name]
+	return name == "" || name == config.DecoderAuto || ok
+}
+
+// pick returns the decoder with the given name, JSON if the name is empty,
+// or the one chosen by the Content-Type header if the name is "auto". JSON
+// is used for unknown media types.
+func (s *decoderSet) pick(name string, contentType string) (Decoder, string) {
+	switch name {
+	case "":
+		name = config.DecoderJSON
+	case config.DecoderAuto:
+		name = s.nameByType(contentType)
+	}
+	return s.byName[name], name
+}
+
+func (s *decoderSet) nameByType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return config.DecoderJSON
+	}
+	if name, ok := s.byType[mediaType]; ok {
+		return name
+	}
+	switch {
+	case strings.HasSuffix(mediaType, "+json"):
+		return config.DecoderJSON
+	case strings.HasSuffix(mediaType, "+xml"):
+		return config.DecoderXML
+	}
+	return config.DecoderJSON
+}
+
+func decodeProtobuf(body []byte, v any) error {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf(
+			"protobuf responses must be decoded into a proto.Message, got %T",
+			v,
+		)
+	}
+	return proto.Unmarshal(body, message)
+}
+
+func decodeMsgpack(body []byte, v any) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(body))
+	// Fields without msgpack tags are matched by their json tags
+	decoder.SetCustomStructTag(JSONTag)
+	return decoder.Decode(v)
+}
+
+// decodeCSV decodes rows of a CSV body with a header into the elements of
+// the slice v points to, the same way as CSV sources.
+func decodeCSV(body []byte, v any) error {
+	rows, err := sliceOf(v, config.DecoderCSV)
+	if err != nil {
+		return err
+	}
+	reader, err := newCSVReader(io.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading row %d: %w", rows.Len()+1, err)
+		}
+		row := reflect.New(rows.Type().Elem())
+		if err := RecordToObject(record, row.Interface()); err != nil {
+			return fmt.Errorf("decoding row %d: %w", rows.Len()+1, err)
+		}
+		rows.Set(reflect.Append(rows, row.Elem()))
+	}
+}
+
+// decodeNDJSON decodes every line of the body into an element of the slice
+// v points to.
+func decodeNDJSON(body []byte, v any) error {
+	lines, err := sliceOf(v, config.DecoderNDJSON)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		element := reflect.New(lines.Type().Elem())
+		if err := json.Unmarshal(line, element.Interface()); err != nil {
+			return fmt.Errorf("decoding line %d: %w", lines.Len()+1, err)
+		}
+		lines.Set(reflect.Append(lines, element.Elem()))
+	}
+	return scanner.Err()
+}
+
+// sliceOf returns the slice v points to, for formats with many records.
+func sliceOf(v any, format string) (reflect.Value, error) {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Pointer || value.IsNil() ||
+		value.Elem().Kind() != reflect.Slice {
+		return reflect.Value{}, fmt.Errorf(
+			"%s responses must be decoded into a slice, got %T",
+			format,
+			v,
+		)
+	}
+	return value.Elem(), nil
+}
+
+func decodeText(body []byte, v any) error {
+	if u, ok := v.(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText(body)
+	}
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Pointer || value.IsNil() ||
+		value.Elem().Kind() != reflect.String {
+		return fmt.Errorf(
+			"text responses must be decoded into a string, got %T",
+			v,
+		)
+	}
+	value.Elem().SetString(string(body))
+	return nil
+}
+
+func decodeRaw(body []byte, v any) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Pointer && !value.IsNil() {
+		elem := value.Elem()
+		switch {
+		case elem.Kind() == reflect.Slice &&
+			elem.Type().Elem().Kind() == reflect.Uint8:
+			// The body of the response may be reused
+			elem.SetBytes(bytes.Clone(body))
+			return nil
+		case elem.Kind() == reflect.String:
+			elem.SetString(string(body))
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"raw responses must be decoded into a byte slice or a string, got %T",
+		v,
+	)
+}
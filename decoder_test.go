@@ -0,0 +1,187 @@
+package barash
+
+import (
+	"encoding/xml"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/kiltia/barash/config"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestDecoderPick(t *testing.T) {
+	custom := DecoderFunc(func([]byte, any) error { return nil })
+	set := newDecoderSet(map[string]namedDecoder{
+		"yaml": {decoder: custom, contentTypes: []string{"application/yaml"}},
+		// Custom media types take precedence over the built-in ones
+		"events": {decoder: custom, contentTypes: []string{"text/csv"}},
+	})
+	tests := []struct {
+		name        string
+		contentType string
+		want        string
+	}{
+		// JSON is the default whatever the Content-Type is
+		{"", "application/xml", config.DecoderJSON},
+		{config.DecoderXML, "application/json", config.DecoderXML},
+		{"yaml", "", "yaml"},
+		{config.DecoderAuto, "application/json", config.DecoderJSON},
+		{config.DecoderAuto, "application/xml", config.DecoderXML},
+		{config.DecoderAuto, "text/xml; charset=utf-8", config.DecoderXML},
+		{config.DecoderAuto, "Application/XML", config.DecoderXML},
+		{config.DecoderAuto, "application/problem+json", config.DecoderJSON},
+		{config.DecoderAuto, "application/atom+xml", config.DecoderXML},
+		{config.DecoderAuto, "application/x-protobuf", config.DecoderProtobuf},
+		{config.DecoderAuto, "application/msgpack", config.DecoderMsgpack},
+		{config.DecoderAuto, "application/x-ndjson", config.DecoderNDJSON},
+		{config.DecoderAuto, "application/octet-stream", config.DecoderRaw},
+		{config.DecoderAuto, "application/yaml", "yaml"},
+		{config.DecoderAuto, "text/csv", "events"},
+		// Plain text, unknown and malformed media types fall back to JSON
+		{config.DecoderAuto, "text/plain", config.DecoderJSON},
+		{config.DecoderAuto, "image/png", config.DecoderJSON},
+		{config.DecoderAuto, "", config.DecoderJSON},
+		{config.DecoderAuto, "application/", config.DecoderJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+tt.contentType, func(t *testing.T) {
+			decoder, name := set.pick(tt.name, tt.contentType)
+			if name != tt.want || decoder == nil {
+				t.Fatalf("picked %s, want %s", name, tt.want)
+			}
+		})
+	}
+	for name, want := range map[string]bool{
+		"":                   true,
+		config.DecoderAuto:   true,
+		config.DecoderNDJSON: true,
+		"yaml":               true,
+		"toml":               false,
+	} {
+		if set.known(name) != want {
+			t.Fatalf("decoder %q is known: %t, want %t", name, !want, want)
+		}
+	}
+}
+
+type decodedRow struct {
+	ID   int    `json:"id"   xml:"id"`
+	Name string `json:"name" xml:"name"`
+}
+
+type upperText string
+
+func (u *upperText) UnmarshalText(text []byte) error {
+	*u = upperText("text:" + string(text))
+	return nil
+}
+
+func TestBuiltinDecoders(t *testing.T) {
+	msgpackBody, err := msgpack.Marshal(map[string]any{"id": 1, "name": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := structpb.NewStruct(map[string]any{"id": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	protobufBody, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmlBody, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"row"`
+		decodedRow
+	}{decodedRow: decodedRow{1, "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		decoder string
+		body    []byte
+		// Pointer to the value to decode into
+		into any
+		want any
+		ok   bool
+	}{
+		{
+			config.DecoderJSON, []byte(`{"id": 1, "name": "a"}`),
+			&decodedRow{},
+			decodedRow{1, "a"},
+			true,
+		},
+		{config.DecoderXML, xmlBody, &decodedRow{}, decodedRow{1, "a"}, true},
+		{
+			config.DecoderMsgpack,
+			msgpackBody,
+			&decodedRow{},
+			decodedRow{1, "a"},
+			true,
+		},
+		{
+			config.DecoderCSV, []byte("id,name\n1,a\n2,b\n"),
+			&[]decodedRow{},
+			[]decodedRow{{1, "a"}, {2, "b"}},
+			true,
+		},
+		{
+			config.DecoderCSV, []byte("id,name\n1,a\n"),
+			&decodedRow{}, nil, false,
+		},
+		{
+			config.DecoderNDJSON,
+			[]byte("{\"id\": 1, \"name\": \"a\"}\n\n{\"id\": 2}\n"),
+			&[]decodedRow{},
+			[]decodedRow{{1, "a"}, {2, ""}},
+			true,
+		},
+		{
+			config.DecoderNDJSON, []byte("{\"id\": 1}\nnot json\n"),
+			&[]decodedRow{}, nil, false,
+		},
+		{config.DecoderText, []byte("hello"), new(string), "hello", true},
+		{
+			config.DecoderText, []byte("hello"),
+			new(upperText), upperText("text:hello"), true,
+		},
+		{config.DecoderText, []byte("1"), new(int), nil, false},
+		{config.DecoderRaw, []byte{0, 1}, new([]byte), []byte{0, 1}, true},
+		{config.DecoderRaw, []byte("raw"), new(string), "raw", true},
+		{config.DecoderRaw, []byte("raw"), new(netip.Addr), nil, false},
+		{config.DecoderProtobuf, []byte("garbage"), &decodedRow{}, nil, false},
+	}
+	set := newDecoderSet(nil)
+	for _, tt := range tests {
+		t.Run(tt.decoder, func(t *testing.T) {
+			decoder, _ := set.pick(tt.decoder, "")
+			err := decoder.Decode(tt.body, tt.into)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("decoded %T without an error", tt.into)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := reflect.ValueOf(tt.into).Elem().Interface()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("decoded %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	// Protobuf messages are compared with proto.Equal
+	decoded := &structpb.Struct{}
+	decoder, _ := set.pick(config.DecoderProtobuf, "")
+	if err := decoder.Decode(protobufBody, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(decoded, message) {
+		t.Fatalf("decoded %v, want %v", decoded, message)
+	}
+}
@@ -0,0 +1,119 @@
+package barash
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// dryRunTransport renders outgoing requests instead of sending them.
+type dryRunTransport struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %w", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", req.Method, req.URL.String())
+	for _, name := range slices.Sorted(maps.Keys(req.Header)) {
+		for _, value := range req.Header[name] {
+			fmt.Fprintf(&buf, "%s: %s\n", name, value)
+		}
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(&buf, "\n%s\n", body)
+	}
+	buf.WriteString("\n")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.out.Write(buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("writing rendered request: %w", err)
+	}
+
+	return &http.Response{
+		Status:     "204 No Content",
+		StatusCode: http.StatusNoContent,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+// startDryRun renders the first requests built from the source and exits.
+// Neither the API, the sinks nor the checkpoint and lease tables are touched.
+func (r *Runner[S, R, P, Q]) startDryRun(
+	wg *sync.WaitGroup,
+	ctx context.Context,
+) {
+	out := io.WriteCloser(os.Stdout)
+	if r.config().DryRun.Output != "" {
+		file, err := os.Create(r.config().DryRun.Output)
+		if err != nil {
+			zap.S().Errorw("creating dry run output file", "error", err)
+			r.closeSource()
+			return
+		}
+		out = file
+	}
+	r.setTransport(&dryRunTransport{out: out})
+
+	ctx, cancel := context.WithCancel(ctx)
+	// The source is closed once the provider has stopped
+	var providerWg sync.WaitGroup
+	tasks := r.startProvider(&providerWg, ctx)
+	wg.Go(func() {
+		defer r.closeSource()
+		defer providerWg.Wait()
+		defer cancel()
+		if out != os.Stdout {
+			defer out.Close()
+		}
+		rendered := 0
+		for rendered < r.config().DryRun.Limit {
+			var (
+				task   APIRequest[P]
+				opened bool
+			)
+			select {
+			case task, opened = <-tasks:
+			case <-ctx.Done():
+				return
+			}
+			if !opened {
+				break
+			}
+			_, err := r.newRequest(ctx, task).Send()
+			if err != nil {
+				zap.S().Errorw("rendering request", "error", err)
+				continue
+			}
+			rendered++
+		}
+		zap.S().Infow(
+			"dry run is finished",
+			"rendered", rendered,
+			"output", r.config().DryRun.Output,
+		)
+	})
+}
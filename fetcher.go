@@ -2,7 +2,6 @@ package barash
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand/v2"
@@ -10,17 +9,31 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/kiltia/barash/config"
 	"github.com/sony/gobreaker/v2"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"resty.dev/v3"
 )
 
+// taskResult holds stored values produced by a single task.
+type taskResult[S any] struct {
+	values []S
+	// Sequence number of the source batch the task belongs to
+	batch uint64
+	// Pointer to the parameters of the task, for sinks which need them
+	params any
+}
+
 func (r *Runner[S, R, P, Q]) fetcher(
 	ctx context.Context,
 	input <-chan APIRequest[P],
-	output chan<- S,
+	output chan<- taskResult[S],
 	fetcherNum int,
 ) {
 	logger := zap.S().
@@ -30,7 +43,18 @@ func (r *Runner[S, R, P, Q]) fetcher(
 
 	activeRequests := atomic.Int32{}
 
+	defer r.control.exit(fetcherNum)
 	for {
+		if !r.control.acquire(ctx, fetcherNum) {
+			logger.Debugw("fetcher is stopped")
+			return
+		}
+		// Pushed tasks may arrive at any moment, so fetchers don't exit
+		// when idle if ingestion is enabled
+		var idle <-chan time.Time
+		if !r.ingestEnabled() {
+			idle = time.After(r.config().Fetcher.IdleTime)
+		}
 		select {
 		case <-ctx.Done():
 			return
@@ -40,43 +64,42 @@ func (r *Runner[S, R, P, Q]) fetcher(
 				if !opened {
 					logger.
 						Debugw("fetcher has no work left")
+					r.control.stop()
+					return
+				}
+				if err := r.control.wait(ctx); err != nil {
 					return
 				}
+				task.stage = r.stats.currentStage()
 				logger := logger.With("request", task.GetRequestLink())
 				logger.
 					Debugw("pulling a new task", "task_count", len(input))
 				activeRequests.Add(1)
 				storedValues, err := r.performRequest(ctx, task, logger)
 				activeRequests.Add(-1)
-				if errors.Is(err, gobreaker.ErrOpenState) ||
-					errors.Is(err, gobreaker.ErrTooManyRequests) {
-					zap.S().
-						Warnw("fetcher is paused after too many client/server errors")
-					select {
-					case <-time.After(r.cfg.Fetcher.CircuitBreaker.Timeout):
-					case <-ctx.Done():
-						return
-					}
-					continue
+				if rejected(err) {
+					// The run is cancelled while the task waits for the
+					// breaker, so it has no result
+					return
 				}
-				// It's expected that err is ignored here
-				for _, value := range storedValues {
-					output <- value
+				output <- taskResult[S]{
+					values: storedValues,
+					batch:  task.batch,
+					params: &task.Params,
 				}
-				if err != nil {
-					zap.S().Error(
-						fmt.Errorf(
-							"performing request: %w",
-							err,
-						),
-					)
+			case <-r.control.changes():
+				// Fetching may have been paused or the fetcher parked
+				continue
+			case <-idle:
+				if r.scenarios != nil && r.scenarios.inProgress() {
+					// Follow-ups may still be sent after their delay
+					continue
 				}
-			case <-time.After(r.cfg.Fetcher.IdleTime):
 				logger.
 					Debugw(
 						"no tasks recieved in fetcher idle time, exiting fetcher",
 						"idle_time",
-						r.cfg.Fetcher.IdleTime,
+						r.config().Fetcher.IdleTime,
 					)
 				return
 			}
@@ -84,28 +107,60 @@ func (r *Runner[S, R, P, Q]) fetcher(
 	}
 }
 
+// rejected reports whether the request has been rejected by the circuit
+// breaker without being sent.
+func rejected(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) ||
+		errors.Is(err, gobreaker.ErrTooManyRequests)
+}
+
+// awaitBreaker delays a task rejected by the circuit breaker until the
+// breaker lets requests through again, so the task is sent again instead
+// of being dropped and its batch can still be committed. It returns false
+// if the context is cancelled first.
+func (r *Runner[S, R, P, Q]) awaitBreaker(
+	ctx context.Context,
+	req APIRequest[P],
+	logger *zap.SugaredLogger,
+) bool {
+	r.stats.recordRejected()
+	delay := breakerTimeout(r.config(), req.target.index)
+	logger.Warnw(
+		"task is rejected by the circuit breaker, sending it again later",
+		"delay", delay,
+	)
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func (r *Runner[S, R, P, Q]) startFetchers(
 	globalWg *sync.WaitGroup,
 	ctx context.Context,
 	input chan APIRequest[P],
-) chan S {
-	outputCh := make(chan S, 2*r.cfg.Writer.InsertBatchSize+1)
+) chan taskResult[S] {
+	outputCh := make(chan taskResult[S], 2*r.config().Writer.InsertBatchSize+1)
 	wg := sync.WaitGroup{}
-	fetcherCnt := atomic.Int32{}
-	for i := range r.cfg.Fetcher.MaxFetcherWorkers {
+	initial := r.config().Fetcher.MaxFetcherWorkers
+	// Fetchers added with the admin API start without warmup
+	r.control.setSpawn(func(fetcherNum int) {
 		var rnd time.Duration
-		if i < r.cfg.Fetcher.MinFetcherWorkers || !r.cfg.Fetcher.EnableWarmup {
+		if fetcherNum < r.config().Fetcher.MinFetcherWorkers ||
+			fetcherNum >= initial || !r.config().Fetcher.EnableWarmup {
 			rnd = 0
 		} else {
-			rnd = time.Duration(rand.IntN(int(r.cfg.Fetcher.Duration.Seconds())+1)) * time.Second
+			rnd = time.Duration(rand.IntN(int(r.config().Fetcher.Duration.Seconds())+1)) * time.Second
 		}
 		wg.Go(func() {
 			<-time.After(rnd)
-			fetcherCnt.Add(1)
-			defer fetcherCnt.Add(-1)
-			r.fetcher(ctx, input, outputCh, i)
+			r.control.running.Add(1)
+			defer r.control.running.Add(-1)
+			r.fetcher(ctx, input, outputCh, fetcherNum)
 		})
-	}
+	})
 
 	go func() {
 		for {
@@ -114,7 +169,7 @@ func (r *Runner[S, R, P, Q]) startFetchers(
 				return
 			case <-time.After(time.Second * 10):
 				zap.S().
-					Debugf("%d fetchers are currently running", fetcherCnt.Load())
+					Debugf("%d fetchers are currently running", r.control.running.Load())
 			}
 		}
 	}()
@@ -123,17 +178,29 @@ func (r *Runner[S, R, P, Q]) startFetchers(
 		defer close(outputCh)
 		defer zap.S().Info("all fetchers have been stopped")
 		wg.Wait()
+		r.closeCapture()
 	})
 
 	return outputCh
 }
 
-func (r *Runner[S, R, P, Q]) convertToStored(
+// closeCapture closes the capture file once no more requests are sent.
+func (r *Runner[S, R, P, Q]) closeCapture() {
+	if r.capture == nil {
+		return
+	}
+	if err := r.capture.Close(); err != nil {
+		zap.S().Errorw("closing capture file", "error", err)
+	}
+}
+
+// decodeResponse returns the response decoded from the attempt and the
+// status code to store.
+func (r *Runner[S, R, P, Q]) decodeResponse(
 	req APIRequest[P],
 	attempt AttemptData,
-	attemptNumber int,
 	logger *zap.SugaredLogger,
-) S {
+) (R, int) {
 	resp := attempt.Response
 	var result R
 	statusCode := resp.StatusCode()
@@ -143,15 +210,30 @@ func (r *Runner[S, R, P, Q]) convertToStored(
 	case 429:
 		// do nothing, but not default
 	default:
-		body := resp.Bytes()
+		// Bodies dropped at the size limit or streamed to files aren't
+		// decoded
+		if info := responseBodyInfo(resp); info != nil {
+			if info.aborted {
+				break
+			}
+			if info.blob != nil {
+				if b, ok := any(&result).(ResponseWithBlob); ok {
+					b.SetBlob(*info.blob)
+				}
+				break
+			}
+		}
 		var tmpResult R
-		err := json.Unmarshal(body, &tmpResult)
+		decoder, err := r.unmarshalResponse(req, resp, &tmpResult)
 		if err != nil {
+			body := resp.Bytes()
 			logger.
 				Warnw(
 					"unmarshalling response into a response object failed, saving the status code",
 					"error",
 					err,
+					"decoder",
+					decoder,
 					"status_code",
 					statusCode,
 					"body",
@@ -161,17 +243,63 @@ func (r *Runner[S, R, P, Q]) convertToStored(
 			result = tmpResult
 		}
 	}
+	return result, statusCode
+}
 
+// unmarshalResponse decodes the response with the decoder of the target, or
+// lets the response decode itself. It returns the name of the decoder.
+func (r *Runner[S, R, P, Q]) unmarshalResponse(
+	req APIRequest[P],
+	resp *resty.Response,
+	result *R,
+) (string, error) {
+	if u, ok := any(result).(ResponseUnmarshaler); ok {
+		return "response", u.UnmarshalResponse(resp)
+	}
+	decoder, name := r.decoders.pick(
+		req.target.decoder,
+		resp.Header().Get("Content-Type"),
+	)
+	return name, decoder.Decode(resp.Bytes(), result)
+}
+
+// convertToStored returns the stored value of the attempt and the response
+// it has been decoded from.
+func (r *Runner[S, R, P, Q]) convertToStored(
+	req APIRequest[P],
+	attempt AttemptData,
+	attemptNumber int,
+	logger *zap.SugaredLogger,
+) (S, R) {
+	result, statusCode := r.decodeResponse(req, attempt, logger)
 	storedValue := result.IntoStored(
 		req,
 		attempt.Error,
 		attemptNumber+1,
 		statusCode,
-		resp.Duration(),
-		r.cfg.Writer.SaveTag,
+		attempt.Duration,
+		r.config().Writer.SaveTag,
+		req.stage,
 	)
 
-	return storedValue
+	return storedValue, result
+}
+
+// newRequest prepares an HTTP request for the task.
+func (r *Runner[S, R, P, Q]) newRequest(
+	ctx context.Context,
+	req APIRequest[P],
+) *resty.Request {
+	request := req.target.client.R().WithContext(ctx)
+	// Recorded requests get the span of every attempt injected before it's
+	// sent, the rest pass the sampling decision on
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+	request.SetMethod(string(req.Method))
+	request.SetURL(req.GetRequestLink())
+	if req.Method == config.RunnerHTTPMethodPost {
+		request.SetBody(req.GetRequestBody())
+	}
+	return request
 }
 
 var (
@@ -182,16 +310,30 @@ var (
 type AttemptData struct {
 	Response *resty.Response
 	Error    error
+	// Taken when the attempt is added, because the start time of the request
+	// is reset by the following attempts
+	Duration time.Duration
 }
 
 type RetryTracker struct {
 	attempts []AttemptData
+
+	// Finishes the attempt spans, if the request is traced
+	tracing *attemptTracer
 }
 
 func (r *RetryTracker) Add(resp *resty.Response, err error) {
+	if r.tracing != nil {
+		r.tracing.end(resp, err)
+	}
+	var duration time.Duration
+	if resp != nil && resp.Request != nil {
+		duration = resp.Duration()
+	}
 	r.attempts = append(r.attempts, AttemptData{
 		Response: resp,
 		Error:    err,
+		Duration: duration,
 	})
 }
 
@@ -201,53 +343,162 @@ func (r *RetryTracker) Attempts() []AttemptData {
 	return attempts
 }
 
+// performRequest performs the task, following its pages, and returns the
+// stored values of all attempts. Failed attempts are stored along with their
+// errors, so an error is only returned if the task is still rejected by the
+// circuit breaker when the context is cancelled.
+func (r *Runner[S, R, P, Q]) performRequest(
+	ctx context.Context,
+	req APIRequest[P],
+	logger *zap.SugaredLogger,
+) ([]S, error) {
+	if r.scenarios != nil {
+		defer r.scenarios.done()
+		if req.CorrelationID == "" {
+			req.CorrelationID = uuid.NewString()
+		}
+	}
+	var (
+		results  []S
+		response R
+		merged   mergedPages[S, R, P]
+	)
+	merge := r.config().API.Pagination.Merge
+	for {
+		attempts, err := r.sendRequest(ctx, req, logger)
+		if rejected(err) {
+			if req.Page == 1 {
+				if r.awaitBreaker(ctx, req, logger) {
+					continue
+				}
+				return nil, err
+			}
+			logger.Warnw(
+				"circuit breaker is open, stopping pagination",
+				"page", req.Page,
+			)
+			break
+		}
+		for i, attempt := range attempts {
+			if merge && err == nil && i == len(attempts)-1 {
+				response, _ = r.decodeResponse(req, attempt, logger)
+				merged.add(req, response, attempt, len(attempts))
+				continue
+			}
+			var storedValue S
+			storedValue, response = r.convertToStored(req, attempt, i, logger)
+			results = append(results, storedValue)
+			logger.Debugw("response processed", "attempt", i+1)
+		}
+		if err != nil || len(attempts) == 0 {
+			break
+		}
+		next, ok := r.nextPage(req, response, attempts[len(attempts)-1], logger)
+		if ok {
+			req = next
+			continue
+		}
+		if r.scenarios != nil {
+			if merge {
+				response = merged.response
+			}
+			r.scheduleFollowUps(ctx, req, response, logger)
+		}
+		break
+	}
+	if merged.pages > 0 {
+		results = append(results, merged.intoStored(r.config().Writer.SaveTag))
+	}
+	return results, nil
+}
+
 // NOTE(nrydanov): This function is too complex, I've been thinking about it
 // for a while and I'm not sure how to simplify it, sooo...
 //
 //gocyclo:ignore
-func (r *Runner[S, R, P, Q]) performRequest(
+func (r *Runner[S, R, P, Q]) sendRequest(
 	ctx context.Context,
 	req APIRequest[P],
 	logger *zap.SugaredLogger,
-) ([]S, error) {
-	requestURL := req.GetRequestLink()
-	requestBody := req.GetRequestBody()
-
+) ([]AttemptData, error) {
+	startedAt := time.Now()
 	processResp := func(resp *resty.Response, err error) error {
 		lastStatus := resp.StatusCode()
-		if lastStatus > 399 && lastStatus < 500 {
-			return fmt.Errorf("%w: %v, status_code: %d", ErrClientError, resp.Error(), resp.StatusCode())
+		// Statuses listed in the validation rules are expected
+		accepted := req.target.validator.acceptsStatus(lastStatus)
+		if !accepted && lastStatus > 399 && lastStatus < 500 {
+			return fmt.Errorf(
+				"%w: %v, status_code: %d",
+				ErrClientError,
+				resp.Error(),
+				resp.StatusCode(),
+			)
+		}
+		if !accepted && lastStatus > 499 {
+			return fmt.Errorf(
+				"%w: %v, status_code: %d",
+				ErrServerError,
+				resp.Error(),
+				resp.StatusCode(),
+			)
 		}
-		if lastStatus > 499 {
-			return fmt.Errorf("%w: %v, status_code: %d", ErrServerError, resp.Error(), resp.StatusCode())
+		if err != nil {
+			return err
 		}
-		return err
+		if info := responseBodyInfo(resp); info != nil && info.oversized {
+			if info.aborted {
+				return fmt.Errorf(
+					"%w: status_code: %d",
+					ErrBodyTooLarge,
+					lastStatus,
+				)
+			}
+			logger.Warnw(
+				"response body is truncated at the size limit",
+				"status_code", lastStatus,
+			)
+		}
+		// Failed validation is returned as an error to count it toward the
+		// circuit breaker
+		if err := req.target.validator.validate(resp); err != nil {
+			return fmt.Errorf(
+				"%w: %v, status_code: %d",
+				ErrValidation,
+				err,
+				lastStatus,
+			)
+		}
+		return nil
 	}
 
-	var tracker RetryTracker
-
-	client := r.httpClient.AddRetryHooks(tracker.Add)
+	ctx, span := r.tracer.Start(
+		ctx,
+		"request",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(trace.Link{SpanContext: req.selectSpan}),
+		trace.WithAttributes(
+			attribute.String("http.request.method", string(req.Method)),
+			attribute.String("url.full", req.GetRequestLink()),
+			attribute.String("barash.target", req.Target),
+			attribute.Int("barash.page", req.Page),
+		),
+	)
+	defer span.End()
+	tracker := RetryTracker{tracing: newAttemptTracer(ctx, r.tracer)}
+	if tracker.tracing != nil {
+		ctx = context.WithValue(ctx, attemptTracerKey{}, tracker.tracing)
+	}
 
-	request := client.R().WithContext(ctx)
-	var toBeExecuted func() (*resty.Response, error)
-	switch req.Method {
-	case config.RunnerHTTPMethodGet:
-		toBeExecuted = func() (*resty.Response, error) {
-			resp, err := request.Get(requestURL)
-			return resp, processResp(resp, err)
-		}
-	case config.RunnerHTTPMethodPost:
-		toBeExecuted = func() (*resty.Response, error) {
-			resp, err := request.
-				SetBody(requestBody).
-				Post(requestURL)
-			return resp, processResp(resp, err)
-		}
+	request := r.newRequest(ctx, req).AddRetryHooks(tracker.Add)
+	toBeExecuted := func() (*resty.Response, error) {
+		resp, err := request.Send()
+		return resp, processResp(resp, err)
 	}
-	lastResp, err := r.circuitBreaker.Execute(toBeExecuted)
+	lastResp, err := req.target.breaker.Execute(toBeExecuted)
 	if err != nil {
-		if errors.Is(err, gobreaker.ErrOpenState) ||
-			errors.Is(err, gobreaker.ErrTooManyRequests) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if rejected(err) {
 			return nil, err
 		} else {
 			zap.S().Warn(fmt.Errorf("request is finished with error: %w", err))
@@ -257,14 +508,26 @@ func (r *Runner[S, R, P, Q]) performRequest(
 		tracker.Add(lastResp, err)
 	} else {
 		logger.Warnw("unexpected nil response after error", "error", err)
+		if tracker.tracing != nil {
+			tracker.tracing.end(nil, err)
+		}
 	}
 
-	var results []S
+	timing := taskTiming{
+		latency:          time.Since(startedAt),
+		expectedInterval: r.control.expectedInterval(),
+	}
+	if !req.intendedAt.IsZero() {
+		timing.latency = time.Since(req.intendedAt)
+		timing.scheduled = true
+	}
+	r.stats.recordTask(req.stage, tracker.Attempts(), err, timing)
 
-	for i, resp := range tracker.Attempts() {
-		storedValue := r.convertToStored(req, resp, i, logger)
-		results = append(results, storedValue)
-		logger.Debugw("response processed", "attempt", i+1)
+	span.SetAttributes(attribute.Int("barash.attempts", len(tracker.attempts)))
+	if lastResp != nil && lastResp.RawResponse != nil {
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", lastResp.StatusCode()),
+		)
 	}
-	return results, nil
+	return tracker.Attempts(), err
 }
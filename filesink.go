@@ -0,0 +1,402 @@
+package barash
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiltia/barash/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+	"go.uber.org/zap"
+)
+
+var _ Sink[StoredResult] = &FileSink[StoredResult]{}
+
+// recordEncoder writes results to a file in a specific format.
+type recordEncoder[S any] interface {
+	// WriteHeader is called at the start of every file.
+	WriteHeader() error
+	Encode(batch []S) error
+	Flush() error
+	// Close finalizes the format, but doesn't close the underlying writer.
+	Close() error
+}
+
+type jsonlEncoder[S any] struct {
+	w *bufio.Writer
+}
+
+func (e *jsonlEncoder[S]) WriteHeader() error { return nil }
+
+func (e *jsonlEncoder[S]) Encode(batch []S) error {
+	encoder := json.NewEncoder(e.w)
+	for i := range batch {
+		if err := encoder.Encode(&batch[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *jsonlEncoder[S]) Flush() error { return e.w.Flush() }
+
+func (e *jsonlEncoder[S]) Close() error { return e.w.Flush() }
+
+type csvColumn struct {
+	name  string
+	index int
+}
+
+// csvColumns derives CSV columns from the result fields. Column names are
+// taken from json tags, then from ch tags, then from field names.
+func csvColumns(typ reflect.Type) []csvColumn {
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	var columns []csvColumn
+	if typ.Kind() != reflect.Struct {
+		return columns
+	}
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		for _, tag := range []string{JSONTag, CHTag} {
+			tagName, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+			if tagName != "" {
+				name = tagName
+				break
+			}
+		}
+		if name == "-" {
+			continue
+		}
+		columns = append(columns, csvColumn{name: name, index: i})
+	}
+	return columns
+}
+
+func csvValue(v reflect.Value) (string, error) {
+	if isValueNil(v) {
+		return "", nil
+	}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	if v.Kind() == reflect.Pointer {
+		return csvValue(v.Elem())
+	}
+	switch v.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map,
+		reflect.Interface:
+		data, err := json.Marshal(v.Interface())
+		return string(data), err
+	default:
+		return valueToString(v), nil
+	}
+}
+
+type csvEncoder[S any] struct {
+	w       *csv.Writer
+	columns []csvColumn
+}
+
+func newCSVEncoder[S any](w io.Writer) *csvEncoder[S] {
+	var nilInstance S
+	return &csvEncoder[S]{
+		w:       csv.NewWriter(w),
+		columns: csvColumns(reflect.TypeOf(nilInstance)),
+	}
+}
+
+func (e *csvEncoder[S]) WriteHeader() error {
+	header := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		header[i] = column.name
+	}
+	return e.w.Write(header)
+}
+
+func (e *csvEncoder[S]) Encode(batch []S) error {
+	row := make([]string, len(e.columns))
+	for i := range batch {
+		val := reflect.ValueOf(&batch[i]).Elem()
+		if val.Kind() == reflect.Pointer {
+			val = val.Elem()
+		}
+		for j, column := range e.columns {
+			value, err := csvValue(val.Field(column.index))
+			if err != nil {
+				return fmt.Errorf("encoding %s: %w", column.name, err)
+			}
+			row[j] = value
+		}
+		if err := e.w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *csvEncoder[S]) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvEncoder[S]) Close() error { return e.Flush() }
+
+// parquetEncoder writes a row group per batch. The schema is derived from
+// the result type, see parquet-go documentation for the supported tags.
+type parquetEncoder[S any] struct {
+	w *parquet.GenericWriter[S]
+}
+
+func (e *parquetEncoder[S]) WriteHeader() error { return nil }
+
+func (e *parquetEncoder[S]) Encode(batch []S) error {
+	_, err := e.w.Write(batch)
+	return err
+}
+
+func (e *parquetEncoder[S]) Flush() error { return e.w.Flush() }
+
+func (e *parquetEncoder[S]) Close() error { return e.w.Close() }
+
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// FileSink writes results to local files in JSONL, CSV or Parquet format.
+// Files are rotated by size or age, optionally compressed, and synced to
+// disk after each batch. Files have to be closed with Close, otherwise the
+// last one may miss the compression trailer or the Parquet footer.
+type FileSink[S StoredResult] struct {
+	cfg    config.FileSinkConfig
+	format string
+
+	mu         sync.Mutex
+	file       *os.File
+	counter    *countingWriter
+	compressor flushWriteCloser
+	encoder    recordEncoder[S]
+	openedAt   time.Time
+	seq        int
+}
+
+func NewFileSink[S StoredResult](
+	format string,
+	cfg config.FileSinkConfig,
+) (*FileSink[S], error) {
+	switch format {
+	case config.BackendJSONL, config.BackendCSV, config.BackendParquet:
+	default:
+		return nil, fmt.Errorf("unknown file format: %s", format)
+	}
+	switch cfg.Compression {
+	case "", config.CompressionGzip, config.CompressionZstd:
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", cfg.Compression)
+	}
+	if dir := filepath.Dir(cfg.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating result directory: %w", err)
+		}
+	}
+	return &FileSink[S]{cfg: cfg, format: format}, nil
+}
+
+func (s *FileSink[S]) fileName() string {
+	s.seq++
+	name := fmt.Sprintf(
+		"%s-%s-%04d.%s",
+		s.cfg.Path,
+		time.Now().UTC().Format("20060102T150405"),
+		s.seq,
+		s.format,
+	)
+	// Parquet compresses pages itself
+	if s.format != config.BackendParquet {
+		switch s.cfg.Compression {
+		case config.CompressionGzip:
+			name += ".gz"
+		case config.CompressionZstd:
+			name += ".zst"
+		}
+	}
+	return name
+}
+
+// open creates the next result file. The sink only switches to the file
+// once all its writers are built and the header is written, otherwise the
+// file is closed and the next write tries a new one.
+func (s *FileSink[S]) open() (err error) {
+	name := s.fileName()
+	file, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("creating result file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+		}
+	}()
+	counter := &countingWriter{w: file}
+
+	var (
+		w          io.Writer = counter
+		compressor flushWriteCloser
+	)
+	if s.format != config.BackendParquet {
+		switch s.cfg.Compression {
+		case config.CompressionGzip:
+			compressor = gzip.NewWriter(w)
+		case config.CompressionZstd:
+			compressor, err = zstd.NewWriter(w)
+			if err != nil {
+				return fmt.Errorf("creating zstd writer: %w", err)
+			}
+		}
+		if compressor != nil {
+			w = compressor
+		}
+	}
+
+	var encoder recordEncoder[S]
+	switch s.format {
+	case config.BackendJSONL:
+		encoder = &jsonlEncoder[S]{w: bufio.NewWriter(w)}
+	case config.BackendCSV:
+		encoder = newCSVEncoder[S](w)
+	case config.BackendParquet:
+		var options []parquet.WriterOption
+		switch s.cfg.Compression {
+		case config.CompressionGzip:
+			options = append(options, parquet.Compression(&parquet.Gzip))
+		case config.CompressionZstd:
+			options = append(options, parquet.Compression(&parquet.Zstd))
+		}
+		encoder = &parquetEncoder[S]{
+			w: parquet.NewGenericWriter[S](w, options...),
+		}
+	}
+	if err := encoder.WriteHeader(); err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+
+	s.file = file
+	s.counter = counter
+	s.compressor = compressor
+	s.encoder = encoder
+	s.openedAt = time.Now()
+	zap.S().Infow("opened a new result file", "path", name)
+	return nil
+}
+
+// closeFile finalizes the format and compression and closes the file.
+func (s *FileSink[S]) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	var errs []error
+	errs = append(errs, s.encoder.Close())
+	if s.compressor != nil {
+		errs = append(errs, s.compressor.Close())
+	}
+	errs = append(errs, s.file.Sync(), s.file.Close())
+	s.file = nil
+	return errors.Join(errs...)
+}
+
+func (s *FileSink[S]) needsRotation() bool {
+	if s.file == nil {
+		return false
+	}
+	if s.cfg.RotateSize > 0 && s.counter.count >= s.cfg.RotateSize {
+		return true
+	}
+	return s.cfg.RotateInterval > 0 &&
+		time.Since(s.openedAt) >= s.cfg.RotateInterval
+}
+
+// flush pushes buffered data through the compressor and syncs the file.
+func (s *FileSink[S]) flush() error {
+	if err := s.encoder.Flush(); err != nil {
+		return err
+	}
+	if s.compressor != nil {
+		if err := s.compressor.Flush(); err != nil {
+			return err
+		}
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink[S]) InsertBatch(_ context.Context, batch []S) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	if s.needsRotation() {
+		if err := s.closeFile(); err != nil {
+			return fmt.Errorf("closing rotated file: %w", err)
+		}
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if err := s.encoder.Encode(batch); err != nil {
+		return fmt.Errorf("encoding results: %w", err)
+	}
+	return s.flush()
+}
+
+// InitTable opens the first file and writes a header or schema derived
+// from the result type.
+func (s *FileSink[S]) InitTable(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		return nil
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *FileSink[S]) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFile()
+}
@@ -0,0 +1,369 @@
+package barash
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"sync"
+
+	"github.com/kiltia/barash/config"
+	"github.com/parquet-go/parquet-go"
+	"go.uber.org/zap"
+)
+
+var (
+	_ Source[StoredParams] = &FileSource[StoredParams]{}
+	_ Source[StoredParams] = &SliceSource[StoredParams]{}
+	_ Source[StoredParams] = &IterSource[StoredParams]{}
+
+	_ ResumableSource = &FileSource[StoredParams]{}
+	_ ResumableSource = &SliceSource[StoredParams]{}
+	_ ResumableSource = &IterSource[StoredParams]{}
+)
+
+// recordReader reads named values record by record and returns io.EOF
+// when there are no records left.
+type recordReader interface {
+	Next() (map[string]any, error)
+	Close() error
+}
+
+// objectReader is implemented by readers which decode records straight into
+// the request parameters instead of named values.
+type objectReader interface {
+	NextObject(obj any) error
+}
+
+type csvReader struct {
+	closer io.Closer
+	reader *csv.Reader
+	header []string
+}
+
+func newCSVReader(r io.ReadCloser) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = false
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %w", err)
+	}
+	return &csvReader{closer: r, reader: reader, header: header}, nil
+}
+
+func (r *csvReader) Next() (map[string]any, error) {
+	row, err := r.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	record := make(map[string]any, len(r.header))
+	for i, name := range r.header {
+		if i < len(row) {
+			record[name] = row[i]
+		}
+	}
+	return record, nil
+}
+
+func (r *csvReader) Close() error {
+	return r.closer.Close()
+}
+
+type jsonlReader struct {
+	closer  io.Closer
+	scanner *bufio.Scanner
+}
+
+func newJSONLReader(r io.ReadCloser) *jsonlReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	return &jsonlReader{closer: r, scanner: scanner}
+}
+
+func (r *jsonlReader) Next() (map[string]any, error) {
+	var record map[string]any
+	if err := r.NextObject(&record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// NextObject decodes the next line into obj with encoding/json, so custom
+// UnmarshalJSON methods are called and integers keep their precision.
+func (r *jsonlReader) NextObject(obj any) error {
+	for r.scanner.Scan() {
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		// Numbers are kept as is, so large integers are not rounded
+		decoder.UseNumber()
+		return decoder.Decode(obj)
+	}
+	if err := r.scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (r *jsonlReader) Close() error {
+	return r.closer.Close()
+}
+
+type parquetReader struct {
+	file   *os.File
+	reader *parquet.Reader
+}
+
+func newParquetReader(file *os.File) (*parquetReader, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	pf, err := parquet.OpenFile(file, stat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("opening parquet file: %w", err)
+	}
+	return &parquetReader{file: file, reader: parquet.NewReader(pf)}, nil
+}
+
+func (r *parquetReader) Next() (map[string]any, error) {
+	record := map[string]any{}
+	if err := r.reader.Read(&record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (r *parquetReader) Close() error {
+	return errors.Join(r.reader.Close(), r.file.Close())
+}
+
+// FileSource reads tasks from a CSV, JSONL or Parquet file, or from stdin.
+// CSV and Parquet records are decoded with RecordToObject, so columns are
+// matched against json and query tags of the request parameters. JSONL lines
+// are decoded with encoding/json. The select statement and query state are
+// ignored, rows read by a previous run are skipped on resume.
+type FileSource[P StoredParams] struct {
+	mu        sync.Mutex
+	reader    recordReader
+	batchSize int
+	done      bool
+}
+
+// NewFileSource opens the file in the given format: "csv", "jsonl" or
+// "parquet". Path "-" stands for stdin, which is not supported for Parquet.
+func NewFileSource[P StoredParams](
+	path string,
+	format string,
+	batchSize int,
+) (*FileSource[P], error) {
+	var file *os.File
+	if path == "-" {
+		file = os.Stdin
+	} else {
+		var err error
+		file, err = os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening source file: %w", err)
+		}
+	}
+
+	var (
+		reader recordReader
+		err    error
+	)
+	switch format {
+	case config.BackendCSV:
+		reader, err = newCSVReader(file)
+	case config.BackendJSONL:
+		reader = newJSONLReader(file)
+	case config.BackendParquet:
+		reader, err = newParquetReader(file)
+	default:
+		err = fmt.Errorf("unknown file format: %s", format)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &FileSource[P]{
+		reader:    reader,
+		batchSize: max(batchSize, 1),
+	}, nil
+}
+
+func (s *FileSource[P]) GetNextBatch(
+	_ context.Context,
+	_ string,
+	_ QueryState[P],
+) (result []P, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return nil, nil
+	}
+	for len(result) < s.batchSize {
+		params, err := s.next()
+		if errors.Is(err, io.EOF) {
+			s.finish()
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, params)
+	}
+	return result, nil
+}
+
+// Skip reads and drops the first rows of the file.
+func (s *FileSource[P]) Skip(rows uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ; rows > 0 && !s.done; rows-- {
+		_, err := s.next()
+		if errors.Is(err, io.EOF) {
+			s.finish()
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish marks the file as read and closes it.
+func (s *FileSource[P]) finish() {
+	s.done = true
+	if err := s.reader.Close(); err != nil {
+		zap.S().Warnw("closing source file", "error", err)
+	}
+}
+
+func (s *FileSource[P]) next() (P, error) {
+	var params P
+	if reader, ok := s.reader.(objectReader); ok {
+		err := reader.NextObject(&params)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return params, fmt.Errorf("decoding record: %w", err)
+		}
+		return params, err
+	}
+	record, err := s.reader.Next()
+	if errors.Is(err, io.EOF) {
+		return params, err
+	}
+	if err != nil {
+		return params, fmt.Errorf("reading record: %w", err)
+	}
+	if err := RecordToObject(record, &params); err != nil {
+		return params, fmt.Errorf("decoding record: %w", err)
+	}
+	return params, nil
+}
+
+// SliceSource returns tasks from a slice in batches.
+type SliceSource[P StoredParams] struct {
+	mu        sync.Mutex
+	tasks     []P
+	batchSize int
+}
+
+func NewSliceSource[P StoredParams](
+	tasks []P,
+	batchSize int,
+) *SliceSource[P] {
+	return &SliceSource[P]{tasks: tasks, batchSize: max(batchSize, 1)}
+}
+
+func (s *SliceSource[P]) GetNextBatch(
+	_ context.Context,
+	_ string,
+	_ QueryState[P],
+) ([]P, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := min(s.batchSize, len(s.tasks))
+	batch := s.tasks[:n:n]
+	s.tasks = s.tasks[n:]
+	return batch, nil
+}
+
+// Skip drops the first tasks of the slice.
+func (s *SliceSource[P]) Skip(rows uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = s.tasks[min(rows, uint64(len(s.tasks))):]
+	return nil
+}
+
+// Push adds tasks to the end of the source, which is useful for continuous
+// mode.
+func (s *SliceSource[P]) Push(tasks ...P) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = append(s.tasks, tasks...)
+}
+
+// IterSource returns tasks produced by an iterator in batches. The iterator
+// may be infinite, for example when it generates synthetic load.
+type IterSource[P StoredParams] struct {
+	mu        sync.Mutex
+	next      func() (P, bool)
+	stop      func()
+	batchSize int
+}
+
+func NewIterSource[P StoredParams](
+	seq iter.Seq[P],
+	batchSize int,
+) *IterSource[P] {
+	next, stop := iter.Pull(seq)
+	return &IterSource[P]{
+		next:      next,
+		stop:      stop,
+		batchSize: max(batchSize, 1),
+	}
+}
+
+func (s *IterSource[P]) GetNextBatch(
+	_ context.Context,
+	_ string,
+	_ QueryState[P],
+) ([]P, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var batch []P
+	for len(batch) < s.batchSize {
+		params, ok := s.next()
+		if !ok {
+			s.stop()
+			break
+		}
+		batch = append(batch, params)
+	}
+	return batch, nil
+}
+
+// Skip pulls and drops the first tasks of the iterator.
+func (s *IterSource[P]) Skip(rows uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ; rows > 0; rows-- {
+		if _, ok := s.next(); !ok {
+			s.stop()
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package barash
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+type skipParams struct {
+	ID int `json:"id"`
+}
+
+func ids(batch []skipParams) []int {
+	result := make([]int, len(batch))
+	for i := range batch {
+		result[i] = batch[i].ID
+	}
+	return result
+}
+
+func TestSourcesSkip(t *testing.T) {
+	tasks := []skipParams{{1}, {2}, {3}, {4}, {5}}
+	path := filepath.Join(t.TempDir(), "tasks.jsonl")
+	err := os.WriteFile(
+		path,
+		[]byte("{\"id\":1}\n{\"id\":2}\n{\"id\":3}\n{\"id\":4}\n{\"id\":5}\n"),
+		0o644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		rows uint64
+		want []int
+	}{
+		{"nothing", 0, []int{1, 2, 3}},
+		{"some", 2, []int{3, 4, 5}},
+		{"all", 5, nil},
+		{"past the end", 10, nil},
+	}
+	sources := map[string]func(t *testing.T) Source[skipParams]{
+		"file": func(t *testing.T) Source[skipParams] {
+			source, err := NewFileSource[skipParams](path, "jsonl", 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return source
+		},
+		"slice": func(*testing.T) Source[skipParams] {
+			return NewSliceSource(slices.Clone(tasks), 3)
+		},
+		"iter": func(*testing.T) Source[skipParams] {
+			return NewIterSource(slices.Values(tasks), 3)
+		},
+	}
+	for name, newSource := range sources {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				source := newSource(t)
+				err := source.(ResumableSource).Skip(tt.rows)
+				if err != nil {
+					t.Fatalf("skipping %d rows: %v", tt.rows, err)
+				}
+				batch, err := source.GetNextBatch(
+					context.Background(),
+					"",
+					nil,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := ids(batch); !slices.Equal(got, tt.want) {
+					t.Fatalf(
+						"got tasks %v after skipping, want %v",
+						got,
+						tt.want,
+					)
+				}
+			})
+		}
+	}
+}
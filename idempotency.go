@@ -0,0 +1,167 @@
+package barash
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var _ TaskSink[StoredResult] = &DedupSink[StoredResult]{}
+
+// NewIdempotencyKey builds a deterministic key from the given parts, for
+// example request parameters and a response identifier.
+func NewIdempotencyKey(parts ...any) string {
+	h := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(h, "%v\x1f", part)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// idempotencyKey returns the key of the result, if it has one.
+func idempotencyKey[S any](value *S) (string, bool) {
+	if k, ok := any(value).(StoredResultWithIdempotencyKey); ok {
+		return k.IdempotencyKey(), true
+	}
+	if k, ok := any(*value).(StoredResultWithIdempotencyKey); ok {
+		return k.IdempotencyKey(), true
+	}
+	return "", false
+}
+
+// dedupBatch drops results with repeated idempotency keys from the batch and
+// returns the keys of the remaining ones. Results without a key are kept.
+func dedupBatch[S any](batch []S) ([]S, []string) {
+	seen := make(map[string]struct{}, len(batch))
+	keys := make([]string, 0, len(batch))
+	result := batch[:0:0]
+	for i := range batch {
+		key, ok := idempotencyKey(&batch[i])
+		if ok {
+			if _, dup := seen[key]; dup {
+				continue
+			}
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+		result = append(result, batch[i])
+	}
+	return result, keys
+}
+
+// lruSet is a bounded set which evicts the least recently added keys.
+type lruSet struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+func newLRUSet(capacity int) *lruSet {
+	return &lruSet{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+func (s *lruSet) Contains(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.items[key]
+	return ok
+}
+
+func (s *lruSet) Add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.order.MoveToFront(el)
+		return
+	}
+	s.items[key] = s.order.PushFront(key)
+	if s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(string))
+	}
+}
+
+// DedupSink wraps a sink without native deduplication and filters out
+// results whose idempotency keys have been recently written.
+type DedupSink[S StoredResult] struct {
+	Sink[S]
+	seen *lruSet
+}
+
+func NewDedupSink[S StoredResult](sink Sink[S], capacity int) *DedupSink[S] {
+	return &DedupSink[S]{
+		Sink: sink,
+		seen: newLRUSet(capacity),
+	}
+}
+
+func (s *DedupSink[S]) InsertBatch(ctx context.Context, batch []S) error {
+	return s.InsertTaskBatch(ctx, batch, nil)
+}
+
+// InsertTaskBatch filters the results along with the parameters of their
+// tasks, which are passed on if the wrapped sink needs them.
+func (s *DedupSink[S]) InsertTaskBatch(
+	ctx context.Context,
+	batch []S,
+	params []any,
+) error {
+	fresh := batch[:0:0]
+	var (
+		freshParams []any
+		keys        []string
+	)
+	inBatch := make(map[string]struct{}, len(batch))
+	for i := range batch {
+		key, ok := idempotencyKey(&batch[i])
+		if ok {
+			if _, dup := inBatch[key]; dup || s.seen.Contains(key) {
+				continue
+			}
+			inBatch[key] = struct{}{}
+			keys = append(keys, key)
+		}
+		fresh = append(fresh, batch[i])
+		if params != nil {
+			freshParams = append(freshParams, params[i])
+		}
+	}
+	if dropped := len(batch) - len(fresh); dropped > 0 {
+		zap.S().Debugw("dropped duplicate results", "count", dropped)
+	}
+	var err error
+	if sink, ok := s.Sink.(TaskSink[S]); ok {
+		err = sink.InsertTaskBatch(ctx, fresh, freshParams)
+	} else {
+		err = s.Sink.InsertBatch(ctx, fresh)
+	}
+	if err != nil {
+		return err
+	}
+	// Keys are remembered only after a successful write, so a failed
+	// batch can be retried
+	for _, key := range keys {
+		s.seen.Add(key)
+	}
+	return nil
+}
+
+// Close closes the wrapped sink if it holds resources.
+func (s *DedupSink[S]) Close() error {
+	if closer, ok := s.Sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
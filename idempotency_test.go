@@ -0,0 +1,148 @@
+package barash
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+type keyedResult struct {
+	Key   string
+	Value int
+}
+
+func (r keyedResult) IdempotencyKey() string { return r.Key }
+
+func (keyedResult) GetCreateQuery(string) string { return "" }
+
+// recordingSink keeps the batches it's given and fails if err is set.
+type recordingSink struct {
+	batches [][]keyedResult
+	params  [][]any
+	err     error
+}
+
+func (s *recordingSink) InsertBatch(
+	ctx context.Context,
+	batch []keyedResult,
+) error {
+	return s.InsertTaskBatch(ctx, batch, nil)
+}
+
+func (s *recordingSink) InsertTaskBatch(
+	_ context.Context,
+	batch []keyedResult,
+	params []any,
+) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, batch)
+	s.params = append(s.params, params)
+	return nil
+}
+
+func (s *recordingSink) InitTable(context.Context) error { return nil }
+
+func values(batch []keyedResult) []int {
+	result := make([]int, len(batch))
+	for i := range batch {
+		result[i] = batch[i].Value
+	}
+	return result
+}
+
+func TestDedupBatch(t *testing.T) {
+	batch := []keyedResult{
+		{"a", 1}, {"b", 2}, {"a", 3}, {"c", 4}, {"b", 5},
+	}
+	deduped, keys := dedupBatch(batch)
+	if got := values(deduped); !slices.Equal(got, []int{1, 2, 4}) {
+		t.Fatalf("kept results %v, want the first of every key", got)
+	}
+	if !slices.Equal(keys, []string{"a", "b", "c"}) {
+		t.Fatalf("got keys %v, want a, b and c", keys)
+	}
+	if got := values(batch); !slices.Equal(got, []int{1, 2, 3, 4, 5}) {
+		t.Fatalf("batch is modified to %v", got)
+	}
+
+	// Results without a key are always kept
+	plain, keys := dedupBatch([]int{1, 1, 2})
+	if !slices.Equal(plain, []int{1, 1, 2}) || len(keys) != 0 {
+		t.Fatalf("got %v and keys %v from results without keys", plain, keys)
+	}
+}
+
+func TestLRUSetEviction(t *testing.T) {
+	set := newLRUSet(3)
+	for _, key := range []string{"a", "b", "c"} {
+		set.Add(key)
+	}
+	// Adding a known key again makes it the most recent one
+	set.Add("a")
+	set.Add("d")
+	if set.Contains("b") {
+		t.Fatal("least recently added key isn't evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if !set.Contains(key) {
+			t.Fatalf("key %s is evicted", key)
+		}
+	}
+	set.Add("e")
+	set.Add("f")
+	for key, want := range map[string]bool{
+		"a": false, "c": false, "d": true, "e": true, "f": true,
+	} {
+		if set.Contains(key) != want {
+			t.Fatalf("set contains %s is %t, want %t", key, !want, want)
+		}
+	}
+	if set.order.Len() != 3 || len(set.items) != 3 {
+		t.Fatalf(
+			"set holds %d keys in order and %d in the index, want 3",
+			set.order.Len(),
+			len(set.items),
+		)
+	}
+}
+
+func TestDedupSink(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingSink{}
+	sink := NewDedupSink[keyedResult](inner, 10)
+
+	first := []keyedResult{{"a", 1}, {"b", 2}, {"a", 3}}
+	params := []any{"p1", "p2", "p3"}
+	if err := sink.InsertTaskBatch(ctx, first, params); err != nil {
+		t.Fatal(err)
+	}
+	if got := values(inner.batches[0]); !slices.Equal(got, []int{1, 2}) {
+		t.Fatalf("wrote %v, want duplicates within the batch dropped", got)
+	}
+	// Parameters are filtered along with their results
+	if !slices.Equal(inner.params[0], []any{"p1", "p2"}) {
+		t.Fatalf("passed parameters %v, want p1 and p2", inner.params[0])
+	}
+
+	// Keys are only remembered after a successful write
+	inner.err = errors.New("sink is down")
+	if err := sink.InsertBatch(ctx, []keyedResult{{"c", 4}}); err == nil {
+		t.Fatal("error of the sink is lost")
+	}
+	inner.err = nil
+	if err := sink.InsertBatch(
+		ctx,
+		[]keyedResult{{"a", 5}, {"c", 6}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if got := values(inner.batches[1]); !slices.Equal(got, []int{6}) {
+		t.Fatalf("wrote %v, want keys written before dropped", got)
+	}
+	if inner.params[1] != nil {
+		t.Fatalf("passed parameters %v without any given", inner.params[1])
+	}
+}
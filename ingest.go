@@ -0,0 +1,393 @@
+package barash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// IngestHTTPPath accepts a JSON array of request parameters with POST.
+	IngestHTTPPath = "/tasks"
+	// IngestGRPCMethod accepts a google.protobuf.ListValue of request
+	// parameters and returns a google.protobuf.Struct with the number of
+	// accepted tasks.
+	IngestGRPCMethod = "/barash.Ingest/Push"
+)
+
+const (
+	defaultIngestMaxBatch = 1000
+	defaultIngestMaxBody  = 10 << 20
+)
+
+var ErrIngestBusy = errors.New("fetcher queue is full")
+
+type ingestResponse struct {
+	Accepted int    `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ingester feeds tasks pushed over HTTP and gRPC into the fetcher queue.
+// Pushed tasks aren't tracked by checkpoints and aren't filtered by shards
+// or leases. Accepted tasks are processed when the runner is drained, but
+// are lost if it's stopped by cancelling its context.
+type ingester[P StoredParams] struct {
+	// Closed when the servers are stopping
+	stopping   <-chan struct{}
+	newRequest func(params P) APIRequest[P]
+	maxBatch   int
+	maxBody    int64
+	timeout    time.Duration
+
+	mu     sync.RWMutex
+	out    chan APIRequest[P]
+	closed bool
+}
+
+// enqueue puts tasks into the queue in order. If there's no room for a task
+// within the enqueue timeout, the rest of the batch is rejected and the
+// number of accepted tasks is returned along with ErrIngestBusy.
+func (in *ingester[P]) enqueue(ctx context.Context, params []P) (int, error) {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	if in.closed {
+		return 0, ErrIngestBusy
+	}
+	var deadline <-chan time.Time
+	if in.timeout > 0 {
+		timer := time.NewTimer(in.timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for i := range params {
+		select {
+		case in.out <- in.newRequest(params[i]):
+		case <-deadline:
+			return i, ErrIngestBusy
+		case <-ctx.Done():
+			return i, ctx.Err()
+		case <-in.stopping:
+			return i, ErrIngestBusy
+		}
+	}
+	return len(params), nil
+}
+
+func (in *ingester[P]) close() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.closed = true
+	close(in.out)
+}
+
+func (in *ingester[P]) decode(records []map[string]any) ([]P, error) {
+	if len(records) > in.maxBatch {
+		return nil, fmt.Errorf(
+			"batch of %d tasks exceeds the limit of %d",
+			len(records),
+			in.maxBatch,
+		)
+	}
+	params := make([]P, len(records))
+	for i, record := range records {
+		if err := RecordToObject(record, &params[i]); err != nil {
+			return nil, fmt.Errorf("decoding task %d: %w", i, err)
+		}
+	}
+	return params, nil
+}
+
+func (in *ingester[P]) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeIngestResponse(w, http.StatusMethodNotAllowed, 0, nil)
+		return
+	}
+	var records []map[string]any
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, in.maxBody))
+	// Numbers are kept as is, so large integers are not rounded
+	decoder.UseNumber()
+	if err := decoder.Decode(&records); err != nil {
+		statusCode := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			statusCode = http.StatusRequestEntityTooLarge
+		}
+		writeIngestResponse(w, statusCode, 0, err)
+		return
+	}
+	params, err := in.decode(records)
+	if err != nil {
+		writeIngestResponse(w, http.StatusBadRequest, 0, err)
+		return
+	}
+	accepted, err := in.enqueue(req.Context(), params)
+	if err != nil {
+		writeIngestResponse(w, http.StatusServiceUnavailable, accepted, err)
+		return
+	}
+	writeIngestResponse(w, http.StatusAccepted, accepted, nil)
+}
+
+func writeIngestResponse(
+	w http.ResponseWriter,
+	statusCode int,
+	accepted int,
+	err error,
+) {
+	resp := ingestResponse{Accepted: accepted}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ingestService is the gRPC service implemented by the ingester. There's no
+// generated code, requests and responses are well-known protobuf types.
+type ingestService interface {
+	Push(
+		ctx context.Context,
+		tasks *structpb.ListValue,
+	) (*structpb.Struct, error)
+}
+
+var ingestServiceDesc = grpc.ServiceDesc{
+	ServiceName: "barash.Ingest",
+	HandlerType: (*ingestService)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Push",
+			Handler:    ingestPushHandler,
+		},
+	},
+	Metadata: "barash/ingest",
+}
+
+func ingestPushHandler(
+	srv any,
+	ctx context.Context,
+	dec func(any) error,
+	interceptor grpc.UnaryServerInterceptor,
+) (any, error) {
+	in := new(structpb.ListValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ingestService).Push(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IngestGRPCMethod,
+	}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return srv.(ingestService).Push(ctx, req.(*structpb.ListValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func (in *ingester[P]) Push(
+	ctx context.Context,
+	tasks *structpb.ListValue,
+) (*structpb.Struct, error) {
+	records := make([]map[string]any, len(tasks.GetValues()))
+	for i, value := range tasks.GetValues() {
+		record := value.GetStructValue()
+		if record == nil {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"task %d is not an object",
+				i,
+			)
+		}
+		records[i] = record.AsMap()
+	}
+	params, err := in.decode(records)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	accepted, err := in.enqueue(ctx, params)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.ResourceExhausted,
+			"accepted %d of %d tasks: %v",
+			accepted,
+			len(params),
+			err,
+		)
+	}
+	return structpb.NewStruct(map[string]any{"accepted": accepted})
+}
+
+// ingestToken rejects gRPC calls without the bearer token in the
+// authorization metadata.
+func ingestToken(token string) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		_ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		var authorization string
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+		if !validToken(authorization, token) {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// ingestEnabled reports whether tasks can be pushed to the runner.
+func (r *Runner[S, R, P, Q]) ingestEnabled() bool {
+	cfg := r.config().Provider.Ingest
+	return cfg.HTTPAddr != "" || cfg.GRPCAddr != ""
+}
+
+// startIngest starts the ingestion servers and merges pushed tasks with the
+// ones selected by the provider. The merged queue is closed once the context
+// is done or the runner is drained, so fetchers keep waiting for pushed tasks
+// after the source is exhausted.
+func (r *Runner[S, R, P, Q]) startIngest(
+	wg *sync.WaitGroup,
+	ctx context.Context,
+	tasks chan APIRequest[P],
+) (chan APIRequest[P], error) {
+	cfg := r.config().Provider.Ingest
+	token := cfg.Token
+	if token == "" {
+		token = os.Getenv("INGEST_TOKEN")
+	}
+	if token == "" {
+		return nil, errors.New("ingest token is not set")
+	}
+	if cfg.MaxBatchSize <= 0 {
+		cfg.MaxBatchSize = defaultIngestMaxBatch
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = defaultIngestMaxBody
+	}
+	stopping := make(chan struct{})
+	in := &ingester[P]{
+		stopping: stopping,
+		maxBatch: cfg.MaxBatchSize,
+		maxBody:  cfg.MaxBodySize,
+		timeout:  cfg.EnqueueTimeout,
+		out:      make(chan APIRequest[P], cap(tasks)),
+		newRequest: func(params P) APIRequest[P] {
+			if p, ok := any(&params).(IncludeBodyFromFile); ok {
+				mutator := NewBodyMutator(r.config().API.BodyFilePath)
+				mutator.Mutate(p)
+			}
+			return r.newAPIRequest(params, 0, trace.SpanContext{})
+		},
+	}
+
+	var (
+		httpServer *http.Server
+		grpcServer *grpc.Server
+	)
+	if cfg.HTTPAddr != "" {
+		listener, err := net.Listen("tcp", cfg.HTTPAddr)
+		if err != nil {
+			return nil, fmt.Errorf("listening for http ingestion: %w", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle(IngestHTTPPath, withToken(token, in))
+		httpServer = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		wg.Go(func() {
+			err := httpServer.Serve(listener)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				zap.S().Errorw("serving http ingestion", "error", err)
+			}
+		})
+		zap.S().Infow(
+			"accepting tasks over http",
+			"address", listener.Addr().String(),
+			"path", IngestHTTPPath,
+		)
+	}
+	if cfg.GRPCAddr != "" {
+		listener, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			if httpServer != nil {
+				httpServer.Close()
+			}
+			return nil, fmt.Errorf("listening for grpc ingestion: %w", err)
+		}
+		grpcServer = grpc.NewServer(
+			grpc.UnaryInterceptor(ingestToken(token)),
+			grpc.MaxRecvMsgSize(int(cfg.MaxBodySize)),
+		)
+		grpcServer.RegisterService(&ingestServiceDesc, in)
+		wg.Go(func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				zap.S().Errorw("serving grpc ingestion", "error", err)
+			}
+		})
+		zap.S().Infow(
+			"accepting tasks over grpc",
+			"address", listener.Addr().String(),
+			"method", IngestGRPCMethod,
+		)
+	}
+
+	forwarded := make(chan struct{})
+	wg.Go(func() {
+		defer close(forwarded)
+		for task := range tasks {
+			select {
+			case in.out <- task:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	wg.Go(func() {
+		select {
+		case <-ctx.Done():
+		case <-r.control.draining():
+		}
+		close(stopping)
+		if httpServer != nil {
+			shutdownCtx, cancel := context.WithTimeout(
+				context.Background(),
+				r.config().Shutdown.GracePeriod,
+			)
+			if err := httpServer.Shutdown(shutdownCtx); err != nil {
+				zap.S().Warnw("shutting down http ingestion", "error", err)
+			}
+			cancel()
+		}
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		<-forwarded
+		in.close()
+		zap.S().Infow("ingestion servers are stopped")
+	})
+
+	return in.out, nil
+}
@@ -0,0 +1,301 @@
+package barash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	ingestTestToken   = "token"
+	ingestTestTimeout = 50 * time.Millisecond
+)
+
+type ingestParams struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// newTestIngester returns an ingester with room for the given number of
+// tasks, which accepts up to 3 tasks and 200 bytes in a push.
+func newTestIngester(queue int) *ingester[ingestParams] {
+	return &ingester[ingestParams]{
+		stopping: make(chan struct{}),
+		newRequest: func(params ingestParams) APIRequest[ingestParams] {
+			return APIRequest[ingestParams]{Params: params}
+		},
+		maxBatch: 3,
+		maxBody:  200,
+		timeout:  ingestTestTimeout,
+		out:      make(chan APIRequest[ingestParams], queue),
+	}
+}
+
+func TestIngestHTTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		token    string
+		body     string
+		queue    int
+		status   int
+		accepted int
+	}{
+		{
+			"accepted", http.MethodPost, ingestTestToken,
+			`[{"id": 1, "name": "a"}, {"id": 2}]`, 2,
+			http.StatusAccepted, 2,
+		},
+		{
+			"missing token", http.MethodPost, "",
+			`[{"id": 1}]`, 1,
+			http.StatusUnauthorized, 0,
+		},
+		{
+			"wrong token", http.MethodPost, "other",
+			`[{"id": 1}]`, 1,
+			http.StatusUnauthorized, 0,
+		},
+		{
+			"wrong method", http.MethodGet, ingestTestToken,
+			"", 1,
+			http.StatusMethodNotAllowed, 0,
+		},
+		{
+			"body too large", http.MethodPost, ingestTestToken,
+			`[{"name": "` + strings.Repeat("a", 200) + `"}]`, 1,
+			http.StatusRequestEntityTooLarge, 0,
+		},
+		{
+			"malformed body", http.MethodPost, ingestTestToken,
+			`{"id": 1}`, 1,
+			http.StatusBadRequest, 0,
+		},
+		{
+			"batch too large", http.MethodPost, ingestTestToken,
+			`[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}]`, 4,
+			http.StatusBadRequest, 0,
+		},
+		{
+			"queue full", http.MethodPost, ingestTestToken,
+			`[{"id": 1}, {"id": 2}, {"id": 3}]`, 2,
+			http.StatusServiceUnavailable, 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := newTestIngester(tt.queue)
+			srv := httptest.NewServer(withToken(ingestTestToken, in))
+			defer srv.Close()
+
+			req, err := http.NewRequest(
+				tt.method,
+				srv.URL+IngestHTTPPath,
+				strings.NewReader(tt.body),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			start := time.Now()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var body ingestResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status || body.Accepted != tt.accepted {
+				t.Fatalf(
+					"got %d with %d accepted (%s), want %d with %d",
+					resp.StatusCode,
+					body.Accepted,
+					body.Error,
+					tt.status,
+					tt.accepted,
+				)
+			}
+			if len(in.out) != tt.accepted {
+				t.Fatalf("queued %d tasks, want %d", len(in.out), tt.accepted)
+			}
+			// The rest of the batch waits for room up to the timeout
+			if resp.StatusCode == http.StatusServiceUnavailable &&
+				time.Since(start) < ingestTestTimeout {
+				t.Fatalf("rejected after %v", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestIngestHTTPDecodesTasks(t *testing.T) {
+	in := newTestIngester(2)
+	srv := httptest.NewServer(withToken(ingestTestToken, in))
+	defer srv.Close()
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		srv.URL+IngestHTTPPath,
+		strings.NewReader(`[{"id": 1, "name": "a"}, {"id": 2, "name": "b"}]`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+ingestTestToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, want := range []ingestParams{{1, "a"}, {2, "b"}} {
+		if got := (<-in.out).Params; got != want {
+			t.Fatalf("queued %+v, want %+v", got, want)
+		}
+	}
+}
+
+// newIngestClient serves the ingester over gRPC and returns a client
+// connection to it.
+func newIngestClient(
+	t *testing.T,
+	in *ingester[ingestParams],
+) *grpc.ClientConn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(ingestToken(ingestTestToken)),
+		grpc.MaxRecvMsgSize(int(in.maxBody)),
+	)
+	server.RegisterService(&ingestServiceDesc, in)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(
+		listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestIngestGRPC(t *testing.T) {
+	task := func(id int) any { return map[string]any{"id": id} }
+	tests := []struct {
+		name     string
+		token    string
+		tasks    []any
+		queue    int
+		code     codes.Code
+		accepted int
+	}{
+		{"accepted", ingestTestToken, []any{task(1), task(2)}, 2, codes.OK, 2},
+		{"missing token", "", []any{task(1)}, 1, codes.Unauthenticated, 0},
+		{"wrong token", "other", []any{task(1)}, 1, codes.Unauthenticated, 0},
+		{
+			"message too large", ingestTestToken,
+			[]any{map[string]any{"name": strings.Repeat("a", 200)}},
+			1,
+			codes.ResourceExhausted, 0,
+		},
+		{
+			"not an object", ingestTestToken,
+			[]any{task(1), "task"},
+			2,
+			codes.InvalidArgument, 0,
+		},
+		{
+			"batch too large", ingestTestToken,
+			[]any{task(1), task(2), task(3), task(4)},
+			4,
+			codes.InvalidArgument, 0,
+		},
+		{
+			"queue full", ingestTestToken,
+			[]any{task(1), task(2), task(3)},
+			2,
+			codes.ResourceExhausted, 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := newTestIngester(tt.queue)
+			conn := newIngestClient(t, in)
+
+			tasks, err := structpb.NewList(tt.tasks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = metadata.AppendToOutgoingContext(
+					ctx,
+					"authorization",
+					"Bearer "+tt.token,
+				)
+			}
+			var resp structpb.Struct
+			err = conn.Invoke(ctx, IngestGRPCMethod, tasks, &resp)
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("got code %s (%v), want %s", got, err, tt.code)
+			}
+			if err == nil {
+				accepted := int(resp.GetFields()["accepted"].GetNumberValue())
+				if accepted != tt.accepted {
+					t.Fatalf(
+						"accepted %d tasks, want %d",
+						accepted,
+						tt.accepted,
+					)
+				}
+			}
+			if len(in.out) != tt.accepted {
+				t.Fatalf("queued %d tasks, want %d", len(in.out), tt.accepted)
+			}
+		})
+	}
+}
+
+func TestIngestRejectsAfterStop(t *testing.T) {
+	in := newTestIngester(0)
+	in.timeout = time.Minute
+	stopping := make(chan struct{})
+	in.stopping = stopping
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(stopping)
+	}()
+	// A push waiting for room is rejected once the servers are stopping
+	accepted, err := in.enqueue(context.Background(), []ingestParams{{ID: 1}})
+	if accepted != 0 || !errors.Is(err, ErrIngestBusy) {
+		t.Fatalf("got %d accepted and %v, want ErrIngestBusy", accepted, err)
+	}
+	in.close()
+	if _, err := in.enqueue(context.Background(), nil); !errors.Is(
+		err,
+		ErrIngestBusy,
+	) {
+		t.Fatalf("got %v from a closed ingester, want ErrIngestBusy", err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"net/url"
 	"time"
+
+	"resty.dev/v3"
 )
 
 type (
@@ -13,6 +15,14 @@ type (
 		GetCreateQuery(tableName string) string
 	}
 
+	// StoredResultWithIdempotencyKey interface is used to deduplicate results
+	// that are written more than once because of retries and crash replays.
+	// The key must be deterministic: the same request and response must
+	// always produce the same key.
+	StoredResultWithIdempotencyKey interface {
+		IdempotencyKey() string
+	}
+
 	StoredParams any
 
 	StoredParamsToQuery interface {
@@ -23,6 +33,18 @@ type (
 		GetBody() []byte
 	}
 
+	// StoredParamsWithKey interface is used to identify a task, for example
+	// when it's leased to a runner replica.
+	StoredParamsWithKey interface {
+		TaskKey() string
+	}
+
+	// StoredParamsWithTarget interface routes a task to the API target with
+	// the returned name. Tasks with an empty name are split by weight.
+	StoredParamsWithTarget interface {
+		TargetName() string
+	}
+
 	Response[S StoredResult, P StoredParams] interface {
 		IntoStored(
 			request APIRequest[P],
@@ -31,9 +53,44 @@ type (
 			status int,
 			timeElapsed time.Duration,
 			saveTag string,
+			stage string,
 		) S
 	}
 
+	// ResponseUnmarshaler interface is implemented by responses which decode
+	// themselves from the HTTP response instead of a decoder.
+	ResponseUnmarshaler interface {
+		UnmarshalResponse(resp *resty.Response) error
+	}
+
+	// ResponseWithBlob interface is implemented by responses which keep a
+	// reference to the body streamed to the blob directory. Such bodies
+	// aren't decoded.
+	ResponseWithBlob interface {
+		SetBlob(blob Blob)
+	}
+
+	// ResponseWithFollowUps interface is implemented by responses which
+	// continue a scenario with more requests, such as polling the status of
+	// a created job and fetching its result. It's called after a successful
+	// response, and the follow-ups are sent after their delay.
+	ResponseWithFollowUps[P StoredParams] interface {
+		FollowUps(request APIRequest[P]) []FollowUp[P]
+	}
+
+	// ResponseWithNextPage interface is implemented by paginated responses.
+	// It returns the request of the next page, or false if the page is the
+	// last one.
+	ResponseWithNextPage[P StoredParams] interface {
+		NextPage(request APIRequest[P]) (*APIRequest[P], bool)
+	}
+
+	// MergeableResponse interface is implemented by responses which can
+	// combine pages into a single result.
+	MergeableResponse[R any] interface {
+		MergePage(page R) R
+	}
+
 	// QueryState interface represents an object which holds query state
 	QueryState[P StoredParams] interface {
 		// UpdateState updates inner state based on batch data.
@@ -54,6 +111,48 @@ type (
 		) (result []P, err error)
 	}
 
+	// LeasingSource interface represents task storage which is able to
+	// share tasks between several runner replicas.
+	LeasingSource interface {
+		// Claim leases the tasks with given keys to the replica and returns
+		// the keys it has claimed. Tasks leased by other replicas are
+		// skipped unless their leases are expired.
+		Claim(
+			ctx context.Context,
+			keys []string,
+			lease Lease,
+		) (claimed []string, err error)
+		// Release removes the leases once results of the tasks are written.
+		Release(
+			ctx context.Context,
+			keys []string,
+			lease Lease,
+		) error
+	}
+
+	// CommittingSource interface represents task storage which has to be
+	// notified when tasks are done, for example a message queue.
+	CommittingSource interface {
+		// Commit acknowledges the given number of the oldest uncommitted
+		// batches returned by GetNextBatch. It's called once the results of
+		// all their tasks and of all batches before them are written.
+		Commit(ctx context.Context, batches int) error
+		// Discard forgets the newest batch returned by GetNextBatch. It's
+		// called if the batch can't be registered, so it's never committed
+		// and its tasks are selected again after a restart.
+		Discard()
+	}
+
+	// ResumableSource interface represents task storage which ignores the
+	// query state and returns tasks in the same order on every run, for
+	// example a file.
+	ResumableSource interface {
+		// Skip drops the given number of the first tasks. It's called
+		// before the first select when the runner resumes from a
+		// checkpoint, with the number of rows the checkpoint covers.
+		Skip(rows uint64) error
+	}
+
 	// Sink interface represents result storage.
 	Sink[S any] interface {
 		InsertBatch(
@@ -65,6 +164,27 @@ type (
 		) error
 	}
 
+	// TaskSink interface represents result storage which also needs the
+	// parameters of the tasks the results come from, for example to key
+	// messages by a task field. The writer calls InsertTaskBatch instead of
+	// InsertBatch, params[i] points to the parameters of batch[i].
+	TaskSink[S any] interface {
+		Sink[S]
+		InsertTaskBatch(
+			ctx context.Context,
+			batch []S,
+			params []any,
+		) error
+	}
+
+	// CheckpointStore interface represents storage for the runner progress.
+	CheckpointStore interface {
+		// Load returns the last saved checkpoint or nil if there is none.
+		Load(ctx context.Context) (*Checkpoint, error)
+		// Save persists the checkpoint, replacing the previous one.
+		Save(ctx context.Context, cp Checkpoint) error
+	}
+
 	// IncludeBodyFromFile interface is used to inject body to request
 	IncludeBodyFromFile interface {
 		SetBody(body json.RawMessage)
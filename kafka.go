@@ -0,0 +1,304 @@
+package barash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kiltia/barash/config"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"go.uber.org/zap"
+)
+
+var (
+	_ Source[StoredParams]   = &KafkaSource[StoredParams]{}
+	_ CommittingSource       = &KafkaSource[StoredParams]{}
+	_ TaskSink[StoredResult] = &KafkaSink[StoredResult]{}
+)
+
+const defaultKafkaPollTimeout = 5 * time.Second
+
+func kafkaOptions(
+	cfg config.KafkaConfig,
+	creds config.DatabaseCredentials,
+) []kgo.Opt {
+	opts := []kgo.Opt{kgo.SeedBrokers(cfg.Brokers...)}
+	if creds.Username != "" {
+		opts = append(opts, kgo.SASL(plain.Auth{
+			User: creds.Username,
+			Pass: creds.Password,
+		}.AsMechanism()))
+	}
+	return opts
+}
+
+// KafkaSource consumes tasks from a topic as a member of a consumer group.
+// Record values are JSON objects decoded with RecordToObject, the select
+// statement is ignored.
+//
+// Consumer offsets take the role of the query state: offsets of a batch are
+// committed once the results of all its tasks and of all batches before it
+// are written, so after a restart the source continues from the first batch
+// which hasn't been completely written. Delivery is at-least-once, results
+// can be deduplicated with idempotency keys.
+type KafkaSource[P StoredParams] struct {
+	client      *kgo.Client
+	batchSize   int
+	pollTimeout time.Duration
+
+	mu sync.Mutex
+	// Records of the uncommitted batches in the order they were returned
+	uncommitted [][]*kgo.Record
+}
+
+func NewKafkaSource[P StoredParams](
+	cfg config.SourceConfig,
+	batchSize int,
+) (*KafkaSource[P], error) {
+	if cfg.Kafka.Group == "" {
+		return nil, errors.New("consumer group is not set")
+	}
+	opts := append(
+		kafkaOptions(cfg.Kafka, cfg.Credentials),
+		kgo.ConsumerGroup(cfg.Kafka.Group),
+		kgo.ConsumeTopics(cfg.Kafka.Topic),
+		kgo.DisableAutoCommit(),
+	)
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating kafka client: %w", err)
+	}
+	pollTimeout := cfg.Kafka.PollTimeout
+	if pollTimeout <= 0 {
+		pollTimeout = defaultKafkaPollTimeout
+	}
+	return &KafkaSource[P]{
+		client:      client,
+		batchSize:   max(batchSize, 1),
+		pollTimeout: pollTimeout,
+	}, nil
+}
+
+// GetNextBatch polls up to a batch of records. An empty batch is returned if
+// no records arrive within the poll timeout.
+func (s *KafkaSource[P]) GetNextBatch(
+	ctx context.Context,
+	_ string,
+	_ QueryState[P],
+) ([]P, error) {
+	pollCtx, cancel := context.WithTimeout(ctx, s.pollTimeout)
+	defer cancel()
+	fetches := s.client.PollRecords(pollCtx, s.batchSize)
+	if fetches.IsClientClosed() {
+		return nil, kgo.ErrClientClosed
+	}
+	var errs []error
+	fetches.EachError(func(topic string, partition int32, err error) {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return
+		}
+		errs = append(errs, fmt.Errorf(
+			"fetching %s partition %d: %w",
+			topic,
+			partition,
+			err,
+		))
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	records := fetches.Records()
+	if len(records) == 0 {
+		return nil, nil
+	}
+	result := make([]P, 0, len(records))
+	for _, record := range records {
+		params, err := decodeKafkaRecord[P](record)
+		if err != nil {
+			// A malformed record would block the partition forever, so it's
+			// skipped and committed along with the rest of the batch
+			zap.S().Errorw(
+				"decoding kafka record, skipping",
+				"topic", record.Topic,
+				"partition", record.Partition,
+				"offset", record.Offset,
+				"error", err,
+			)
+			continue
+		}
+		result = append(result, params)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Batches without tasks aren't registered by the runner, so their
+	// offsets are committed with the next batch
+	if len(result) == 0 {
+		if n := len(s.uncommitted); n > 0 {
+			s.uncommitted[n-1] = append(s.uncommitted[n-1], records...)
+			return nil, nil
+		}
+		return nil, s.client.CommitRecords(ctx, records...)
+	}
+	s.uncommitted = append(s.uncommitted, records)
+	return result, nil
+}
+
+func decodeKafkaRecord[P StoredParams](record *kgo.Record) (P, error) {
+	var params P
+	decoder := json.NewDecoder(bytes.NewReader(record.Value))
+	// Numbers are kept as is, so large integers are not rounded
+	decoder.UseNumber()
+	var values map[string]any
+	if err := decoder.Decode(&values); err != nil {
+		return params, err
+	}
+	err := RecordToObject(values, &params)
+	return params, err
+}
+
+// Commit commits offsets of the oldest uncommitted batches. The runner only
+// counts batches whose tasks have all been written, so offsets never move
+// past records without results.
+func (s *KafkaSource[P]) Commit(ctx context.Context, batches int) error {
+	s.mu.Lock()
+	batches = min(batches, len(s.uncommitted))
+	var records []*kgo.Record
+	for _, batch := range s.uncommitted[:batches] {
+		records = append(records, batch...)
+	}
+	s.uncommitted = s.uncommitted[batches:]
+	s.mu.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+	return s.client.CommitRecords(ctx, records...)
+}
+
+// Discard drops records of the newest batch. Records of batches returned
+// after it are committed with higher offsets, so it's only safe to call if
+// no more batches are selected.
+func (s *KafkaSource[P]) Discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.uncommitted); n > 0 {
+		s.uncommitted = s.uncommitted[:n-1]
+	}
+}
+
+// Close leaves the consumer group. Uncommitted records are consumed again by
+// the next group member.
+func (s *KafkaSource[P]) Close() error {
+	s.client.Close()
+	return nil
+}
+
+// KafkaSink produces results to a topic as JSON values, keyed by a field of
+// the parameters of their tasks. Idempotency keys of the results are passed
+// in the idempotency_key header.
+type KafkaSink[S StoredResult] struct {
+	client *kgo.Client
+	cfg    config.KafkaConfig
+}
+
+func NewKafkaSink[S StoredResult](
+	cfg config.SinkConfig,
+) (*KafkaSink[S], error) {
+	client, err := kgo.NewClient(
+		append(
+			kafkaOptions(cfg.Kafka, cfg.Credentials),
+			kgo.DefaultProduceTopic(cfg.Kafka.Topic),
+		)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating kafka client: %w", err)
+	}
+	return &KafkaSink[S]{client: client, cfg: cfg.Kafka}, nil
+}
+
+// InsertBatch produces results without the parameters of their tasks, so
+// it fails if records are keyed.
+func (s *KafkaSink[S]) InsertBatch(ctx context.Context, batch []S) error {
+	return s.InsertTaskBatch(ctx, batch, nil)
+}
+
+func (s *KafkaSink[S]) InsertTaskBatch(
+	ctx context.Context,
+	batch []S,
+	params []any,
+) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	if s.cfg.Key != "" && len(params) != len(batch) {
+		return fmt.Errorf(
+			"records are keyed by the %s parameter, but the parameters "+
+				"of %d results out of %d are passed",
+			s.cfg.Key,
+			len(params),
+			len(batch),
+		)
+	}
+	records := make([]*kgo.Record, 0, len(batch))
+	for i := range batch {
+		value, err := json.Marshal(&batch[i])
+		if err != nil {
+			return fmt.Errorf("encoding result: %w", err)
+		}
+		record := &kgo.Record{Value: value}
+		if s.cfg.Key != "" {
+			key, ok := ObjectKey(params[i], s.cfg.Key)
+			if !ok {
+				return fmt.Errorf(
+					"task parameters have no %s field",
+					s.cfg.Key,
+				)
+			}
+			record.Key = []byte(key)
+		}
+		if key, ok := idempotencyKey(&batch[i]); ok {
+			record.Headers = append(record.Headers, kgo.RecordHeader{
+				Key:   "idempotency_key",
+				Value: []byte(key),
+			})
+		}
+		records = append(records, record)
+	}
+	return s.client.ProduceSync(ctx, records...).FirstErr()
+}
+
+// InitTable creates the topic if partitions are configured. It's not an
+// error if the topic already exists.
+func (s *KafkaSink[S]) InitTable(ctx context.Context) error {
+	if s.cfg.Partitions <= 0 {
+		return nil
+	}
+	replicationFactor := s.cfg.ReplicationFactor
+	if replicationFactor <= 0 {
+		replicationFactor = -1
+	}
+	_, err := kadm.NewClient(s.client).CreateTopic(
+		ctx,
+		s.cfg.Partitions,
+		replicationFactor,
+		nil,
+		s.cfg.Topic,
+	)
+	if errors.Is(err, kerr.TopicAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+func (s *KafkaSink[S]) Close() error {
+	s.client.Close()
+	return nil
+}
@@ -0,0 +1,121 @@
+package barash
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/kiltia/barash/config"
+	"go.uber.org/zap"
+)
+
+// Lease describes the claim of a runner replica on its tasks.
+type Lease struct {
+	ReplicaID string
+	TTL       time.Duration
+	// Table to store leases in, if the source keeps them in a database
+	Table string
+}
+
+func defaultReplicaID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// defaultLeaseTable is used when the lease table isn't set.
+const defaultLeaseTable = "barash_leases"
+
+func validateLease[P StoredParams](cfg config.LeaseConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	// Tasks leased for no time are never claimed, so every task would be
+	// skipped
+	if cfg.TTL <= 0 {
+		return fmt.Errorf("lease ttl must be positive, got %s", cfg.TTL)
+	}
+	if cfg.Key == "" && !hasTaskKey[P]() {
+		return fmt.Errorf(
+			"lease key is required unless the parameters implement " +
+				"StoredParamsWithKey",
+		)
+	}
+	return nil
+}
+
+// leaseTemplateFuncs makes lease settings available in the select template,
+// so the query can skip tasks leased by other replicas.
+func leaseTemplateFuncs(lease Lease) template.FuncMap {
+	return template.FuncMap{
+		"leaseTable": func() string { return lease.Table },
+		"replicaID":  func() string { return lease.ReplicaID },
+	}
+}
+
+// claimTasks leases the batch to the replica and returns the tasks it has
+// claimed together with their keys.
+func (r *Runner[S, R, P, Q]) claimTasks(
+	ctx context.Context,
+	params []P,
+) ([]P, []string, error) {
+	// Leases are not taken in dry-run mode, since tasks are not processed
+	if r.leases == nil || r.config().DryRun.Enabled {
+		return params, nil, nil
+	}
+
+	byKey := make(map[string]int, len(params))
+	keys := make([]string, 0, len(params))
+	for i := range params {
+		key, ok := ObjectKey(&params[i], r.config().Provider.Lease.Key)
+		if !ok {
+			return nil, nil, fmt.Errorf(
+				"request parameters have no lease key %q",
+				r.config().Provider.Lease.Key,
+			)
+		}
+		byKey[key] = i
+		keys = append(keys, key)
+	}
+
+	claimed, err := r.leases.Claim(ctx, keys, r.lease)
+	if err != nil {
+		return nil, nil, fmt.Errorf("claiming tasks: %w", err)
+	}
+
+	result := make([]P, 0, len(claimed))
+	for _, key := range claimed {
+		if i, ok := byKey[key]; ok {
+			result = append(result, params[i])
+		}
+	}
+	zap.S().Debugw(
+		"claimed tasks",
+		"replica_id", r.lease.ReplicaID,
+		"selected", len(params),
+		"claimed", len(result),
+	)
+	return result, claimed, nil
+}
+
+// releaseTasks returns a callback which removes leases of the batch once
+// its results are written.
+func (r *Runner[S, R, P, Q]) releaseTasks(keys []string) func() {
+	if r.leases == nil || len(keys) == 0 {
+		return nil
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			r.config().Shutdown.DBSaveTimeout,
+		)
+		defer cancel()
+		if err := r.leases.Release(ctx, keys, r.lease); err != nil {
+			zap.S().Errorw("releasing leases", "error", err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package barash
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kiltia/barash/config"
+)
+
+func TestValidateLease(t *testing.T) {
+	type params struct {
+		ID int `json:"id"`
+	}
+	tests := []struct {
+		name  string
+		cfg   config.LeaseConfig
+		keyed bool
+		valid bool
+	}{
+		{"disabled", config.LeaseConfig{}, false, true},
+		{
+			"key field",
+			config.LeaseConfig{Enabled: true, TTL: time.Minute, Key: "id"},
+			false,
+			true,
+		},
+		{
+			"task key",
+			config.LeaseConfig{Enabled: true, TTL: time.Minute},
+			true,
+			true,
+		},
+		{
+			"no key",
+			config.LeaseConfig{Enabled: true, TTL: time.Minute},
+			false,
+			false,
+		},
+		{
+			"zero ttl",
+			config.LeaseConfig{Enabled: true, Key: "id"},
+			false,
+			false,
+		},
+		{
+			"negative ttl",
+			config.LeaseConfig{Enabled: true, TTL: -time.Second, Key: "id"},
+			false,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.keyed {
+				err = validateLease[keyedParams](tt.cfg)
+			} else {
+				err = validateLease[params](tt.cfg)
+			}
+			if (err == nil) != tt.valid {
+				t.Fatalf("validateLease() = %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
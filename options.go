@@ -0,0 +1,93 @@
+package barash
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Option overrides runner dependencies which are created from the
+// configuration by default.
+type Option func(*options)
+
+type options struct {
+	source    any
+	sinks     []any
+	transport http.RoundTripper
+	decoders  map[string]namedDecoder
+}
+
+// WithSource makes the runner read tasks from the given source instead of
+// the one described in the provider configuration.
+func WithSource[P StoredParams](src Source[P]) Option {
+	return func(o *options) {
+		o.source = src
+	}
+}
+
+// WithSinks makes the runner write results to the given sinks instead of the
+// ones described in the writer configuration.
+func WithSinks[S StoredResult](sinks ...Sink[S]) Option {
+	return func(o *options) {
+		for _, sink := range sinks {
+			o.sinks = append(o.sinks, sink)
+		}
+	}
+}
+
+// WithHTTPTransport replaces the transport of the HTTP client.
+func WithHTTPTransport(transport http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = transport
+	}
+}
+
+// WithDecoder makes the decoder available by name in the api and target
+// settings, and chooses it for responses with the given media types when the
+// decoder is "auto". It replaces the built-in decoder with the same name.
+func WithDecoder(
+	name string,
+	decoder Decoder,
+	contentTypes ...string,
+) Option {
+	return func(o *options) {
+		if o.decoders == nil {
+			o.decoders = map[string]namedDecoder{}
+		}
+		o.decoders[name] = namedDecoder{
+			decoder:      decoder,
+			contentTypes: contentTypes,
+		}
+	}
+}
+
+func optionSource[P StoredParams](src any) (Source[P], error) {
+	if src == nil {
+		return nil, nil
+	}
+	typed, ok := src.(Source[P])
+	if !ok {
+		return nil, fmt.Errorf(
+			"source %T doesn't match the request parameters type",
+			src,
+		)
+	}
+	return typed, nil
+}
+
+func optionSinks[S StoredResult](sinks []any) ([]Sink[S], error) {
+	if sinks == nil {
+		return nil, nil
+	}
+	typed := make([]Sink[S], 0, len(sinks))
+	for _, sink := range sinks {
+		s, ok := sink.(Sink[S])
+		if !ok {
+			return nil, fmt.Errorf(
+				"sink %T doesn't match the stored result type",
+				sink,
+			)
+		}
+		typed = append(typed, s)
+	}
+	return typed, nil
+}
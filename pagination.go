@@ -0,0 +1,280 @@
+package barash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kiltia/barash/config"
+	"go.uber.org/zap"
+	"resty.dev/v3"
+)
+
+const (
+	defaultMaxPages    = 100
+	defaultCursorParam = "cursor"
+)
+
+func validatePagination[R any](cfg config.PaginationConfig) error {
+	if cfg.Merge {
+		var response R
+		if _, ok := any(&response).(MergeableResponse[R]); !ok {
+			return fmt.Errorf(
+				"merging pages requires %T to implement MergeableResponse",
+				response,
+			)
+		}
+	}
+	switch cfg.Mode {
+	case "", config.PaginationModeLink:
+	case config.PaginationModeCursor:
+		if cfg.CursorField == "" {
+			return errors.New("cursor field must be set")
+		}
+	default:
+		return fmt.Errorf("unknown pagination mode: %s", cfg.Mode)
+	}
+	return nil
+}
+
+// paginationEnabled reports whether responses are followed by their next
+// pages.
+func (r *Runner[S, R, P, Q]) paginationEnabled() bool {
+	var response R
+	_, ok := any(&response).(ResponseWithNextPage[P])
+	return ok || r.config().API.Pagination.Mode != ""
+}
+
+// nextPage returns the request of the page following the response, taken
+// from the response itself if it's paginated, or from the Link header or
+// the cursor in the body otherwise.
+func (r *Runner[S, R, P, Q]) nextPage(
+	req APIRequest[P],
+	response R,
+	attempt AttemptData,
+	logger *zap.SugaredLogger,
+) (APIRequest[P], bool) {
+	if !r.paginationEnabled() {
+		return APIRequest[P]{}, false
+	}
+	cfg := r.config().API.Pagination
+	maxPages := cfg.MaxPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+	if req.Page >= maxPages {
+		logger.Warnw("page limit is reached", "max_pages", maxPages)
+		return APIRequest[P]{}, false
+	}
+
+	var (
+		next APIRequest[P]
+		err  error
+	)
+	if paginated, ok := any(&response).(ResponseWithNextPage[P]); ok {
+		page, ok := paginated.NextPage(req)
+		if !ok || page == nil {
+			return APIRequest[P]{}, false
+		}
+		next = r.nextPageRequest(req, *page)
+	} else {
+		var link string
+		switch cfg.Mode {
+		case config.PaginationModeLink:
+			link, err = nextLink(attempt.Response)
+		case config.PaginationModeCursor:
+			link, err = cursorLink(req, attempt.Response, cfg)
+		}
+		if err != nil {
+			logger.Warnw("finding the next page", "error", err)
+			return APIRequest[P]{}, false
+		}
+		if link == "" {
+			return APIRequest[P]{}, false
+		}
+		next, err = linkRequest(req, link)
+		if err != nil {
+			logger.Warnw("finding the next page", "error", err)
+			return APIRequest[P]{}, false
+		}
+	}
+	next.Page = req.Page + 1
+	return next, true
+}
+
+// nextPageRequest fills the request of the next page, built by the response,
+// with the internal state of the current one.
+func (r *Runner[S, R, P, Q]) nextPageRequest(
+	req APIRequest[P],
+	page APIRequest[P],
+) APIRequest[P] {
+	// The page is usually a modified copy of the request, so the cached
+	// link and body may be stale
+	page.cachedRequestLink = ""
+	page.cachedRequestBody = nil
+	page.intendedAt = time.Time{}
+	page.batch = req.batch
+	page.selectSpan = req.selectSpan
+	page.stage = req.stage
+	page.target = req.target
+	if page.Target == "" {
+		page.Target = req.Target
+	}
+	for _, target := range r.targets {
+		if target.name == page.Target {
+			page.target = target
+		}
+	}
+	if page.CorrelationID == "" {
+		page.CorrelationID = req.CorrelationID
+	}
+	if page.Step == 0 {
+		page.Step = req.Step
+	}
+	return page
+}
+
+// linkRequest returns a copy of the request sent to the given link instead
+// of the one built from the params.
+func linkRequest[P StoredParams](
+	req APIRequest[P],
+	link string,
+) (APIRequest[P], error) {
+	next := req
+	base, err := url.Parse(req.GetRequestLink())
+	if err != nil {
+		return next, fmt.Errorf("parsing request url: %w", err)
+	}
+	nextURL, err := base.Parse(link)
+	if err != nil {
+		return next, fmt.Errorf("parsing next page url: %w", err)
+	}
+	next.RequestURL = *nextURL
+	next.cachedRequestLink = nextURL.String()
+	next.intendedAt = time.Time{}
+	return next, nil
+}
+
+// nextLink returns the URL of the link with the "next" relation from the
+// Link header, or an empty string if there's none.
+func nextLink(resp *resty.Response) (string, error) {
+	for _, header := range resp.Header().Values("Link") {
+		for link := range strings.SplitSeq(header, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			target = strings.TrimSpace(target)
+			if !ok || !strings.HasPrefix(target, "<") ||
+				!strings.HasSuffix(target, ">") {
+				continue
+			}
+			for param := range strings.SplitSeq(params, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(name, "rel") {
+					continue
+				}
+				rels := strings.Fields(strings.Trim(value, `"`))
+				if slices.Contains(rels, "next") {
+					return target[1 : len(target)-1], nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// cursorLink returns the URL of the current request with the cursor from
+// the body, or an empty string if there's no cursor.
+func cursorLink[P StoredParams](
+	req APIRequest[P],
+	resp *resty.Response,
+	cfg config.PaginationConfig,
+) (string, error) {
+	var body any
+	if err := json.Unmarshal(resp.Bytes(), &body); err != nil {
+		return "", fmt.Errorf("decoding body: %w", err)
+	}
+	for key := range strings.SplitSeq(cfg.CursorField, ".") {
+		switch value := body.(type) {
+		case map[string]any:
+			body = value[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(value) {
+				return "", nil
+			}
+			body = value[i]
+		default:
+			return "", nil
+		}
+	}
+	var cursor string
+	switch value := body.(type) {
+	case string:
+		cursor = value
+	case float64:
+		cursor = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	if cursor == "" {
+		return "", nil
+	}
+
+	link, err := url.Parse(req.GetRequestLink())
+	if err != nil {
+		return "", fmt.Errorf("parsing request url: %w", err)
+	}
+	param := cfg.CursorParam
+	if param == "" {
+		param = defaultCursorParam
+	}
+	query := link.Query()
+	query.Set(param, cursor)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+// mergedPages combines the pages of a task into a single result.
+type mergedPages[S StoredResult, R Response[S, P], P StoredParams] struct {
+	pages    int
+	first    APIRequest[P]
+	response R
+	attempts int
+	status   int
+	elapsed  time.Duration
+}
+
+func (m *mergedPages[S, R, P]) add(
+	req APIRequest[P],
+	response R,
+	attempt AttemptData,
+	attempts int,
+) {
+	if m.pages == 0 {
+		m.first = req
+		m.response = response
+	} else if mergeable, ok := any(&m.response).(MergeableResponse[R]); ok {
+		m.response = mergeable.MergePage(response)
+	}
+	m.pages++
+	m.attempts += attempts
+	m.status = attempt.Response.StatusCode()
+	m.elapsed += attempt.Duration
+}
+
+// intoStored returns the stored value of the merged pages. It's stored with
+// the request of the first page, the total number of attempts, the status of
+// the last page and the time taken by the final attempts of all pages.
+func (m *mergedPages[S, R, P]) intoStored(saveTag string) S {
+	return m.response.IntoStored(
+		m.first,
+		nil,
+		m.attempts,
+		m.status,
+		m.elapsed,
+		saveTag,
+		m.first.stage,
+	)
+}
@@ -0,0 +1,184 @@
+package barash
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kiltia/barash/config"
+	"resty.dev/v3"
+)
+
+type pageParams struct {
+	ID int `json:"id" query:"id"`
+}
+
+func pageResponse(header http.Header, body string) *resty.Response {
+	return &resty.Response{
+		Request:     &resty.Request{},
+		RawResponse: &http.Response{Header: header},
+		Body:        io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	tests := []struct {
+		name  string
+		links []string
+		want  string
+	}{
+		{"none", nil, ""},
+		{"next", []string{`</items?page=2>; rel="next"`}, "/items?page=2"},
+		{"unquoted", []string{`</items?page=2>; rel=next`}, "/items?page=2"},
+		{
+			"several relations",
+			[]string{`</items?page=2>; rel="prev next last"`},
+			"/items?page=2",
+		},
+		{
+			"several links",
+			[]string{
+				`</items?page=1>; rel="prev", </items?page=3>; title="x"; ` +
+					`REL="next"`,
+			},
+			"/items?page=3",
+		},
+		{
+			"several headers",
+			[]string{
+				`</items?page=1>; rel="first"`,
+				`</items?page=4>; rel="next"`,
+			},
+			"/items?page=4",
+		},
+		{
+			"other relations",
+			[]string{`</items?page=9>; rel="last nextpage"`},
+			"",
+		},
+		{"malformed target", []string{`/items?page=2; rel="next"`}, ""},
+		{"no parameters", []string{`</items?page=2>`}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, link := range tt.links {
+				header.Add("Link", link)
+			}
+			link, err := nextLink(pageResponse(header, ""))
+			if err != nil || link != tt.want {
+				t.Fatalf("next link is %q, %v, want %q", link, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCursorLink(t *testing.T) {
+	base, err := url.Parse("http://upstream/items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		cfg   config.PaginationConfig
+		body  string
+		want  string
+		fails bool
+	}{
+		{
+			name: "nested",
+			cfg:  config.PaginationConfig{CursorField: "meta.next"},
+			body: `{"meta": {"next": "abc"}}`,
+			want: "http://upstream/items?cursor=abc&id=1",
+		},
+		{
+			name: "array",
+			cfg:  config.PaginationConfig{CursorField: "pages.1"},
+			body: `{"pages": ["a", "b"]}`,
+			want: "http://upstream/items?cursor=b&id=1",
+		},
+		{
+			name: "number",
+			cfg: config.PaginationConfig{
+				CursorField: "next",
+				CursorParam: "after",
+			},
+			body: `{"next": 42}`,
+			want: "http://upstream/items?after=42&id=1",
+		},
+		{
+			name: "missing",
+			cfg:  config.PaginationConfig{CursorField: "meta.next"},
+			body: `{"meta": {}}`,
+		},
+		{
+			name: "empty",
+			cfg:  config.PaginationConfig{CursorField: "next"},
+			body: `{"next": ""}`,
+		},
+		{
+			name: "out of range",
+			cfg:  config.PaginationConfig{CursorField: "pages.2"},
+			body: `{"pages": ["a", "b"]}`,
+		},
+		{
+			name:  "malformed body",
+			cfg:   config.PaginationConfig{CursorField: "next"},
+			body:  `{"next":`,
+			fails: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := APIRequest[pageParams]{
+				RequestURL: *base,
+				Params:     pageParams{ID: 1},
+			}
+			link, err := cursorLink(req, pageResponse(nil, tt.body), tt.cfg)
+			if (err != nil) != tt.fails || link != tt.want {
+				t.Fatalf("cursor link is %q, %v, want %q", link, err, tt.want)
+			}
+		})
+	}
+
+	// The cursor of the next page replaces the one of the current page
+	req := APIRequest[pageParams]{RequestURL: *base, Params: pageParams{ID: 1}}
+	req, err = linkRequest(req, "?cursor=abc&id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := cursorLink(
+		req,
+		pageResponse(nil, `{"next": "def"}`),
+		config.PaginationConfig{CursorField: "next"},
+	)
+	if err != nil || link != "http://upstream/items?cursor=def&id=1" {
+		t.Fatalf("cursor link of the second page is %q, %v", link, err)
+	}
+}
+
+func TestLinkRequest(t *testing.T) {
+	base, err := url.Parse("http://upstream/v1/items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := APIRequest[pageParams]{
+		RequestURL: *base,
+		Params:     pageParams{ID: 1},
+	}
+	for link, want := range map[string]string{
+		"?page=2":                   "http://upstream/v1/items?page=2",
+		"/v2/items?page=2":          "http://upstream/v2/items?page=2",
+		"http://other/items?page=2": "http://other/items?page=2",
+	} {
+		next, err := linkRequest(req, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := next.GetRequestLink(); got != want {
+			t.Fatalf("link %s is resolved to %s, want %s", link, got, want)
+		}
+	}
+}
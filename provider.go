@@ -2,24 +2,48 @@ package barash
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"net/url"
+	"maps"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/avast/retry-go/v4"
 	"github.com/kiltia/barash/config"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// templateSource is implemented by sources which render the select
+// statement as a template.
+type templateSource interface {
+	SetTemplateFuncs(funcs template.FuncMap)
+}
+
+// setTemplateFuncs makes runner settings available in the select template.
+func (r *Runner[S, R, P, Q]) setTemplateFuncs() {
+	src, ok := r.src.(templateSource)
+	if !ok {
+		return
+	}
+	funcs := template.FuncMap{}
+	maps.Copy(funcs, leaseTemplateFuncs(r.lease))
+	maps.Copy(funcs, shardTemplateFuncs(r.config().Provider.Shard))
+	src.SetTemplateFuncs(funcs)
+}
+
 func (r *Runner[S, R, P, Q]) startProvider(
 	wg *sync.WaitGroup,
 	ctx context.Context,
 ) chan APIRequest[P] {
-	out := make(chan APIRequest[P], 2*r.cfg.Provider.SelectBatchSize)
+	out := make(chan APIRequest[P], 2*r.config().Provider.SelectBatchSize)
 
 	var requestsCh chan APIRequest[P]
+	// Number of selects in a row whose tasks have all been filtered out
+	empty := 0
 	wg.Go(func() {
 		defer close(out)
 		for {
@@ -32,6 +56,14 @@ func (r *Runner[S, R, P, Q]) startProvider(
 					return
 				}
 			default:
+				// Buffered tasks are forwarded by now, so the provider can
+				// stop without dropping them
+				select {
+				case <-r.control.draining():
+					zap.S().Infow("draining, no more tasks will be selected")
+					return
+				default:
+				}
 				var err error
 				requestsCh, err = r.gatherRequests(ctx)
 				if err != nil {
@@ -41,25 +73,49 @@ func (r *Runner[S, R, P, Q]) startProvider(
 
 				// If there're more tasks to be completed, we continue
 				if requestsCh != nil {
+					if len(requestsCh) > 0 {
+						empty = 0
+						continue
+					}
+					// The tasks belong to other shards or are leased by
+					// other replicas, the query state has moved past them
+					empty++
+					wait := filteredBackoff(
+						empty,
+						r.config().Provider.SleepTime,
+					)
+					zap.S().Debugw(
+						"all selected tasks are filtered out, waiting",
+						"wait", wait,
+					)
+					select {
+					case <-ctx.Done():
+						return
+					case <-r.control.draining():
+					case <-time.After(wait):
+					}
 					continue
 				}
 
 				// Otherwise, depending on the mode, we either exit or enter standby mode
-				switch r.cfg.Mode {
+				switch r.config().Mode {
 				case config.TwoTableMode:
+					r.tracker.finish()
 					zap.S().Infow("data is processed, exiting")
 					return
 				case config.ContinuousMode:
 					r.queryBuilder.ResetState()
 					zap.S().Infow(
 						"provider has nothing to do, entering standby mode",
-						"sleep_time", r.cfg.Provider.SleepTime,
+						"sleep_time", r.config().Provider.SleepTime,
 						"tasks_left", len(out),
 					)
 					select {
 					case <-ctx.Done():
 						return
-					case <-time.After(r.cfg.Provider.SleepTime):
+					case <-r.control.draining():
+						continue
+					case <-time.After(r.config().Provider.SleepTime):
 						continue
 					}
 				}
@@ -72,50 +128,89 @@ func (r *Runner[S, R, P, Q]) startProvider(
 
 func (r *Runner[S, R, P, Q]) gatherRequests(
 	ctx context.Context,
-) (chan APIRequest[P], error) {
+) (_ chan APIRequest[P], err error) {
+	ctx, span := r.tracer.Start(ctx, "select batch")
+	defer func() { endSpan(span, err) }()
 	zap.S().Debug("trying to get more tasks for fetchers")
 	params, err := r.fetchParams(
 		ctx,
 	)
 	for i := range params {
 		if p, ok := any(&params[i]).(IncludeBodyFromFile); ok {
-			mutator := NewBodyMutator(r.cfg.API.BodyFilePath)
+			mutator := NewBodyMutator(r.config().API.BodyFilePath)
 			mutator.Mutate(p)
 		}
 	}
+	// The state is updated with all selected tasks, so the next select moves
+	// past the ones filtered out below
 	r.queryBuilder.UpdateState(params)
 	if err != nil {
 		return nil, err
 	}
-
-	requestURL, err := url.Parse(r.cfg.API.RequestURL)
+	selected := len(params)
+	var leased []string
+	params, err = r.filterShard(params)
+	if err == nil {
+		params, leased, err = r.claimTasks(ctx, params)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("parsing request url: %w", err)
+		// The batch isn't registered and the provider stops, so the source
+		// mustn't commit the batch along with the ones before it
+		if src, ok := r.src.(CommittingSource); ok && selected > 0 {
+			src.Discard()
+		}
+		return nil, err
 	}
 
-	if len(params) > 0 {
-		requestsCh := r.createRequestStream(params, requestURL)
-		return requestsCh, nil
+	if selected == 0 {
+		return nil, nil
 	}
 
-	return nil, nil
+	var state json.RawMessage
+	if r.checkpoints != nil {
+		state, err = json.Marshal(r.queryBuilder)
+		if err != nil {
+			return nil, fmt.Errorf("serializing query state: %w", err)
+		}
+	}
+	// Batches are registered even if all their tasks belong to other shards
+	// or are leased by other replicas, so they are committed in order
+	batch := r.tracker.register(
+		len(params),
+		selected,
+		state,
+		r.releaseTasks(leased),
+	)
+	span.SetAttributes(
+		attribute.Int64("barash.batch", int64(batch)),
+		attribute.Int("barash.selected", selected),
+		attribute.Int("barash.tasks", len(params)),
+	)
+	// An empty stream makes the provider select again after a backoff
+	return r.createRequestStream(params, batch, span.SpanContext()), nil
+}
+
+// filteredBackoff returns how long the provider waits after a number of
+// selects in a row whose tasks have all been filtered out. It doubles from
+// 10ms up to the sleep time, or a second if it's unset, so sparse shards are
+// still scanned quickly.
+func filteredBackoff(empty int, sleepTime time.Duration) time.Duration {
+	if sleepTime <= 0 {
+		sleepTime = time.Second
+	}
+	return min(10*time.Millisecond<<min(empty-1, 16), sleepTime)
 }
 
 // Forms requests using runner's configuration ([api] section in the config
 // file) and a set of request parameters fetched from the database.
 func (r *Runner[S, R, P, Q]) createRequestStream(
 	params []P,
-	requestURL *url.URL,
+	batch uint64,
+	selectSpan trace.SpanContext,
 ) chan APIRequest[P] {
 	ch := make(chan APIRequest[P], len(params))
 	for i := range params {
-		p := &params[i]
-		ch <- APIRequest[P]{
-			RequestURL: *requestURL,
-			Method:     r.cfg.API.Method,
-			Params:     *p,
-		}
-
+		ch <- r.newAPIRequest(params[i], batch, selectSpan)
 	}
 	return ch
 }
@@ -147,7 +242,7 @@ func (r *Runner[S, R, P, Q]) fetchParams(
 		},
 		retry.Attempts(
 			uint(
-				r.cfg.Provider.SelectRetries,
+				r.config().Provider.SelectRetries,
 			)+1,
 		),
 	)
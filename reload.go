@@ -0,0 +1,88 @@
+package barash
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kiltia/barash/config"
+	"go.uber.org/zap"
+)
+
+// Reload applies the updated configuration to the running runner. Only the
+// fields which are safe to change are allowed to differ, otherwise the whole
+// configuration is rejected and the runner keeps the current one.
+func (r *Runner[S, R, P, Q]) Reload(cfg *config.Config) error {
+	current := r.config()
+	changed, err := config.CheckReload(current, cfg)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if cfg.Fetcher.MaxFetcherWorkers < 1 {
+		return fmt.Errorf(
+			"invalid worker count: %d",
+			cfg.Fetcher.MaxFetcherWorkers,
+		)
+	}
+
+	r.reloadTargets(cfg)
+	if cfg.Fetcher.MaxFetcherWorkers != current.Fetcher.MaxFetcherWorkers {
+		r.control.setWorkers(cfg.Fetcher.MaxFetcherWorkers)
+	}
+	// The rate is set by the stages if there are any
+	if cfg.Fetcher.RPS != current.Fetcher.RPS &&
+		len(cfg.Fetcher.Stages) == 0 {
+		r.control.setRPS(cfg.Fetcher.RPS)
+	}
+	config.SetLogLevel(cfg.Log)
+	// Everything else is read from the configuration on use
+	r.cfg.Store(cfg)
+
+	zap.S().Infow("configuration is reloaded", "changed", changed)
+	return nil
+}
+
+// startWatcher reloads the configuration when the file changes or on SIGHUP
+// until the context is done or the runner has finished.
+func (r *Runner[S, R, P, Q]) startWatcher(
+	wg *sync.WaitGroup,
+	ctx context.Context,
+	path string,
+	finished <-chan struct{},
+) {
+	ctx, cancel := context.WithCancel(ctx)
+	wg.Go(func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+		case <-finished:
+		}
+	})
+	wg.Go(func() {
+		config.Watch(ctx, path, func(cfg *config.Config, err error) {
+			if err != nil {
+				zap.S().Errorw(
+					"reading configuration, keeping the current one",
+					"path", path,
+					"error", err,
+				)
+				return
+			}
+			if err := r.Reload(cfg); err != nil {
+				zap.S().Errorw(
+					"configuration is rejected, keeping the current one",
+					"path", path,
+					"error", err,
+				)
+			}
+		})
+	})
+	zap.S().Infow(
+		"watching configuration for changes",
+		"path", path,
+		"interval", config.WatchInterval,
+	)
+}
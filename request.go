@@ -2,14 +2,38 @@ package barash
 
 import (
 	"net/url"
+	"time"
 
 	"github.com/kiltia/barash/config"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type APIRequest[P StoredParams] struct {
 	RequestURL url.URL
 	Method     config.RunnerHTTPMethod
 	Params     P
+	// Name of the API target the request is sent to, empty if there are
+	// no targets
+	Target string
+	// Requests of a scenario share the correlation ID, which is set if the
+	// response supports follow-ups
+	CorrelationID string
+	// Number of the request in its scenario, starting from 1
+	Step int
+	// Number of the page, starting from 1
+	Page int
+
+	// Sequence number of the source batch the request belongs to
+	batch uint64
+	// Span of the select the request comes from, linked to the request span
+	selectSpan trace.SpanContext
+	// Time the request is meant to be sent at, latency is measured from it
+	// if it's set
+	intendedAt time.Time
+	// Name of the load stage the request is sent in, if there are stages
+	stage string
+	// Client and circuit breaker of the target
+	target *apiTarget
 
 	cachedRequestLink string
 	cachedRequestBody []byte
@@ -5,15 +5,16 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/kiltia/barash/config"
 
-	"github.com/sony/gobreaker/v2"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
-	"resty.dev/v3"
 )
 
 type ContextKey int
@@ -23,12 +24,33 @@ const (
 )
 
 type Runner[S StoredResult, R Response[S, P], P StoredParams, Q QueryState[P]] struct {
-	sinks          []Sink[S]
-	src            Source[P]
-	httpClient     *resty.Client
-	cfg            *config.Config
-	circuitBreaker *gobreaker.CircuitBreaker[*resty.Response]
-	queryBuilder   Q
+	sinks []Sink[S]
+	src   Source[P]
+	// Endpoints of the API, with the request url of the api section if
+	// there are no targets
+	targets []*apiTarget
+	// Decoders of response bodies by name and media type
+	decoders *decoderSet
+	// Replaced on reload, use config() to read it
+	cfg          atomic.Pointer[config.Config]
+	queryBuilder Q
+	checkpoints  CheckpointStore
+	tracker      *batchTracker
+	leases       LeasingSource
+	lease        Lease
+	capture      io.Closer
+	control      *fetcherControl
+	taskQueue    chan APIRequest[P]
+	resultQueue  chan taskResult[S]
+	tracer       trace.Tracer
+	// Flushes the spans which haven't been exported yet
+	shutdownTracing func(context.Context) error
+	stats           *runStats
+	// Schedule of the open-loop executor, nil if the worker pool is used
+	arrivals arrivalSchedule
+	// Follow-ups of the responses, nil if they aren't supported
+	scenarios  *scenarioQueue[P]
+	assertions assertionState
 
 	selectSQL string
 }
@@ -41,78 +63,210 @@ func New[
 ](
 	cfg *config.Config,
 	qb Q,
+	opts ...Option,
 ) (*Runner[S, R, P, Q], error) {
-	sinks, err := initSinks[S](cfg.Writer.Sinks)
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	sinks, err := optionSinks[S](o.sinks)
 	if err != nil {
-		return nil, fmt.Errorf("initializing sinks: %w", err)
+		return nil, err
+	}
+	if sinks == nil {
+		sinks, err = initSinks[S](cfg.Writer.Sinks)
+		if err != nil {
+			return nil, fmt.Errorf("initializing sinks: %w", err)
+		}
 	}
-	source, err := initSource[P](cfg.Provider.Source)
+	source, err := optionSource[P](o.source)
 	if err != nil {
 		return nil, err
 	}
+	if source == nil {
+		source, err = initSource[P](cfg.Provider)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	httpClient := resty.New().
-		SetRetryCount(cfg.API.NumRetries).
-		SetTimeout(cfg.API.APITimeout).
-		SetRetryWaitTime(cfg.API.MinWaitTime).
-		SetRetryMaxWaitTime(cfg.API.MaxWaitTime).
-		AddRetryConditions(func(r *resty.Response, err error) bool {
-			ctx := r.Request.Context()
-			fetcherNum := ctx.Value(ContextKeyFetcherNum).(int)
-			if r.StatusCode() >= 500 {
-				zap.S().
-					Debugw(
-						"retrying request",
-						"fetcher_num",
-						fetcherNum,
-						"status_code",
-						r.StatusCode(),
-						"url",
-						r.Request.URL,
-					)
-				return true
-			}
-			return false
-		}).SetLogger(zap.S())
+	// Clients of all targets share the transport
+	transport := newHTTPClient().Transport()
+	if o.transport != nil {
+		transport = o.transport
+	}
+	captureTransport, capture, err := initCapture(cfg.API.Capture, transport)
+	if err != nil {
+		return nil, fmt.Errorf("initializing captures: %w", err)
+	}
+	if captureTransport != nil {
+		transport = captureTransport
+		zap.S().Infow(
+			"capturing upstream interactions",
+			"mode", cfg.API.Capture.Mode,
+			"path", cfg.API.Capture.Path,
+		)
+	}
 
-	selectSQL, err := os.ReadFile(cfg.Provider.Source.SelectSQLPath)
+	tracer, shutdownTracing, err := initTracing(cfg.Tracing)
 	if err != nil {
-		return nil, fmt.Errorf("reading select sql statement: %w", err)
+		return nil, fmt.Errorf("initializing tracing: %w", err)
+	}
+	if cfg.Tracing.Enabled {
+		zap.S().Infow(
+			"exporting traces",
+			"endpoint", cfg.Tracing.Endpoint,
+			"protocol", cfg.Tracing.Protocol,
+		)
+	}
+
+	// Sources that don't use SQL may leave the path empty
+	var selectSQL []byte
+	if cfg.Provider.Source.SelectSQLPath != "" {
+		selectSQL, err = os.ReadFile(cfg.Provider.Source.SelectSQLPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading select sql statement: %w", err)
+		}
+	}
+
+	sinkNames := make([]string, len(sinks))
+	for i, sink := range sinks {
+		sinkNames[i] = sinkName(sink)
 	}
 
 	runner := Runner[S, R, P, Q]{
-		httpClient: httpClient,
-		src:        source,
-		cfg:        cfg,
+		src: source,
 		// TODO(nrydanov): Remove hardcode when others backends become available
-		sinks:        sinks,
-		selectSQL:    string(selectSQL),
-		queryBuilder: qb,
-	}
-
-	runner.circuitBreaker = gobreaker.NewCircuitBreaker[*resty.Response](
-		gobreaker.Settings{
-			Name:        "outgoing_requests",
-			MaxRequests: cfg.Fetcher.CircuitBreaker.MaxRequests,
-			Interval:    cfg.Fetcher.CircuitBreaker.Interval,
-			ReadyToTrip: func(counts gobreaker.Counts) bool {
-				if cfg.Fetcher.CircuitBreaker.Enabled {
-					tooManyTotal := counts.TotalFailures > cfg.Fetcher.CircuitBreaker.TotalFailurePerInterval
-					tooManyConsecutive := counts.ConsecutiveFailures > cfg.Fetcher.CircuitBreaker.ConsecutiveFailure
-					return tooManyTotal || tooManyConsecutive
-				} else {
-					return false
-				}
-			},
-		})
+		sinks:           sinks,
+		selectSQL:       string(selectSQL),
+		queryBuilder:    qb,
+		tracker:         &batchTracker{},
+		decoders:        newDecoderSet(o.decoders),
+		capture:         capture,
+		tracer:          tracer,
+		shutdownTracing: shutdownTracing,
+		stats:           newRunStats(cfg.Summary.Interval, sinkNames),
+		control: newFetcherControl(
+			cfg.Fetcher.MaxFetcherWorkers,
+			cfg.Fetcher.RPS,
+		),
+	}
+	runner.cfg.Store(cfg)
+
+	if err := validateLease[P](cfg.Provider.Lease); err != nil {
+		return nil, fmt.Errorf("validating lease settings: %w", err)
+	}
+	if cfg.Provider.Lease.Enabled {
+		leases, ok := source.(LeasingSource)
+		if !ok {
+			return nil, fmt.Errorf(
+				"%s source doesn't support leases",
+				cfg.Provider.Source.Backend,
+			)
+		}
+		runner.leases = leases
+		runner.lease = Lease{
+			ReplicaID: cfg.Provider.Lease.ReplicaID,
+			TTL:       cfg.Provider.Lease.TTL,
+			Table:     cfg.Provider.Lease.Table,
+		}
+		if runner.lease.ReplicaID == "" {
+			runner.lease.ReplicaID = defaultReplicaID()
+		}
+		if runner.lease.Table == "" {
+			runner.lease.Table = defaultLeaseTable
+		}
+		zap.S().Infow(
+			"leasing tasks to the replica",
+			"replica_id", runner.lease.ReplicaID,
+			"ttl", runner.lease.TTL,
+		)
+	}
+	if err := validatePagination[R](cfg.API.Pagination); err != nil {
+		return nil, fmt.Errorf("validating pagination settings: %w", err)
+	}
+	if err := validateStages(cfg.Fetcher.Stages); err != nil {
+		return nil, fmt.Errorf("validating stages: %w", err)
+	}
+	if cfg.Fetcher.Arrival.Model != "" {
+		runner.arrivals, err = newArrivalSchedule(
+			cfg.Fetcher.Arrival,
+			cfg.Fetcher.Stages,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("validating arrival settings: %w", err)
+		}
+	}
+	if err := validateShard[P](cfg.Provider.Shard); err != nil {
+		return nil, fmt.Errorf("validating shard settings: %w", err)
+	}
+	if cfg.Provider.Shard.Count > 1 {
+		zap.S().Infow(
+			"owning a shard of the source",
+			"shard_index", cfg.Provider.Shard.Index,
+			"shard_count", cfg.Provider.Shard.Count,
+			"shard_key", cfg.Provider.Shard.Key,
+			"push_down", cfg.Provider.Shard.PushDown,
+		)
+	}
+	runner.setTemplateFuncs()
+
+	if cfg.Provider.Checkpoint.Enabled {
+		// The checkpoint store may create its table, and a dry run must
+		// leave the database untouched
+		if cfg.DryRun.Enabled {
+			zap.S().Infow(
+				"checkpoints are disabled in dry-run mode, starting from scratch",
+			)
+		} else if cfg.Mode != config.TwoTableMode {
+			zap.S().Warnw(
+				"checkpoints are only supported in two-table mode, ignoring",
+				"mode", cfg.Mode,
+			)
+		} else {
+			runner.checkpoints, err = initCheckpointStore(
+				cfg.Provider.Checkpoint,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("initializing checkpoints: %w", err)
+			}
+			err = runner.restoreCheckpoint(context.Background())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := runner.initTargets(transport); err != nil {
+		return nil, fmt.Errorf("initializing targets: %w", err)
+	}
 	return &runner, nil
 }
 
+// config returns the current configuration.
+func (r *Runner[S, R, P, Q]) config() *config.Config {
+	return r.cfg.Load()
+}
+
 // Run the runner's job within a given context.
 func (r *Runner[S, R, P, Q]) Run(
 	ctx context.Context,
 	globalWg *sync.WaitGroup,
 ) {
+	if r.config().DryRun.Enabled {
+		zap.S().Infow(
+			"running in dry-run mode, requests won't be sent",
+			"limit", r.config().DryRun.Limit,
+		)
+		r.startDryRun(globalWg, ctx)
+		return
+	}
+
+	// Cancelled when a breached assertion aborts the run
+	ctx, abort := context.WithCancel(ctx)
+	r.stats.start()
+
 	// initialize storage in two-table mode
 	err := r.initTable(ctx)
 	if err != nil {
@@ -122,15 +276,86 @@ func (r *Runner[S, R, P, Q]) Run(
 		zap.S().Infow("successfully initialized table for the Runner results")
 	}
 
-	tasks := r.startProvider(globalWg, ctx)
-	results := r.startFetchers(globalWg, ctx, tasks)
-	r.startWriter(globalWg, results)
+	// The source is closed once both the provider and the writer are done,
+	// because tasks are committed to it after their results are written
+	var storageWg sync.WaitGroup
+	tasks := r.startProvider(&storageWg, ctx)
+	if r.ingestEnabled() {
+		merged, err := r.startIngest(globalWg, ctx, tasks)
+		if err != nil {
+			zap.S().Errorw("starting ingestion servers", "error", err)
+		} else {
+			tasks = merged
+		}
+	}
+	if r.scenariosEnabled() {
+		tasks = r.startScenarios(globalWg, ctx, tasks)
+	}
+	var results chan taskResult[S]
+	if r.arrivalsEnabled() {
+		results = r.startArrivals(globalWg, ctx, tasks, abort)
+	} else {
+		if len(r.config().Fetcher.Stages) > 0 {
+			r.runStages(globalWg, ctx)
+		}
+		results = r.startFetchers(globalWg, ctx, tasks)
+	}
+	r.startWriter(&storageWg, results)
+	r.taskQueue, r.resultQueue = tasks, results
+
+	finished := make(chan struct{})
+	if r.config().Admin.Addr != "" {
+		err := r.startAdmin(globalWg, ctx, finished)
+		if err != nil {
+			zap.S().Errorw("starting admin api", "error", err)
+		}
+	}
+	if path := config.Path(); path != "" {
+		r.startWatcher(globalWg, ctx, path, finished)
+	}
+	if assertionsEnabled(r.config().Assertions) {
+		r.watchAssertions(globalWg, finished, abort)
+	}
+	globalWg.Go(func() {
+		defer abort()
+		storageWg.Wait()
+		r.closeSource()
+		r.stats.finish()
+		r.checkFinalAssertions()
+		r.reportSummary()
+		r.flushTraces()
+		close(finished)
+	})
+}
+
+// flushTraces exports the remaining spans once the work is done.
+func (r *Runner[S, R, P, Q]) flushTraces() {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		r.config().Shutdown.GracePeriod,
+	)
+	defer cancel()
+	if err := r.shutdownTracing(ctx); err != nil {
+		zap.S().Errorw("flushing traces", "error", err)
+	}
+}
+
+// closeSource releases the source if it holds resources, such as
+// connections.
+func (r *Runner[S, R, P, Q]) closeSource() {
+	closer, ok := r.src.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		zap.S().Errorw("closing source", "error", err)
+	}
 }
 
 func (r *Runner[S, R, P, Q]) initTable(
 	ctx context.Context,
 ) error {
-	if r.cfg.Mode == config.ContinuousMode {
+	if r.config().Mode == config.ContinuousMode {
 		zap.S().
 			Infow("running in continuous mode, skipping table initialization")
 		return nil
@@ -173,23 +398,22 @@ func initSinks[S StoredResult](cfgs []config.SinkConfig) ([]Sink[S], error) {
 	var clients []Sink[S]
 	var errs []error
 	for _, cfg := range cfgs {
-		creds, err := loadCreds(cfg.Backend)
-		if err != nil {
-			errs = append(
-				errs,
-				fmt.Errorf(
-					"loading credentials for backend %s: %w",
-					cfg.Backend,
-					err,
-				),
-			)
-			continue
-		}
 		var client Sink[S]
-		cfg.Credentials = *creds
 		switch cfg.Backend {
 		case config.BackendClickhouse:
-			var err error
+			creds, err := loadCreds(cfg.Backend)
+			if err != nil {
+				errs = append(
+					errs,
+					fmt.Errorf(
+						"loading credentials for backend %s: %w",
+						cfg.Backend,
+						err,
+					),
+				)
+				continue
+			}
+			cfg.Credentials = *creds
 			client, err = NewClickhouseSink[S](
 				cfg,
 			)
@@ -203,24 +427,74 @@ func initSinks[S StoredResult](cfgs []config.SinkConfig) ([]Sink[S], error) {
 			zap.S().Infow(
 				"created a new clickhouse client",
 			)
+		case config.BackendJSONL, config.BackendCSV, config.BackendParquet:
+			var err error
+			client, err = NewFileSink[S](cfg.Backend, cfg.File)
+			if err != nil {
+				errs = append(
+					errs,
+					fmt.Errorf("initializing %s sink: %w", cfg.Backend, err),
+				)
+				continue
+			}
+			zap.S().Infow(
+				"created a new file sink",
+				"format", cfg.Backend,
+				"path", cfg.File.Path,
+			)
+		case config.BackendKafka:
+			creds, err := loadCreds(cfg.Backend)
+			if err != nil {
+				errs = append(
+					errs,
+					fmt.Errorf(
+						"loading credentials for backend %s: %w",
+						cfg.Backend,
+						err,
+					),
+				)
+				continue
+			}
+			cfg.Credentials = *creds
+			client, err = NewKafkaSink[S](cfg)
+			if err != nil {
+				errs = append(
+					errs,
+					fmt.Errorf("initializing %s sink: %w", cfg.Backend, err),
+				)
+				continue
+			}
+			zap.S().Infow(
+				"created a new kafka producer",
+				"topic", cfg.Kafka.Topic,
+			)
 		default:
 			zap.S().Fatalw("unknown source backend", "backend", cfg)
 		}
+		if cfg.DedupCacheSize > 0 {
+			client = NewDedupSink(client, cfg.DedupCacheSize)
+		}
 		clients = append(clients, client)
 	}
 	return clients, errors.Join(errs...)
 }
 
-func initSource[P StoredParams](cfg config.SourceConfig) (Source[P], error) {
-	creds, err := loadCreds(cfg.Backend)
-	if err != nil {
-		return nil, fmt.Errorf("initializing %s source: %w", cfg.Backend, err)
-	}
+func initSource[P StoredParams](
+	providerCfg config.ProviderConfig,
+) (Source[P], error) {
+	cfg := providerCfg.Source
 	var client Source[P]
-	cfg.Credentials = *creds
 	switch cfg.Backend {
 	case config.BackendClickhouse:
-		var err error
+		creds, err := loadCreds(cfg.Backend)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"initializing %s source: %w",
+				cfg.Backend,
+				err,
+			)
+		}
+		cfg.Credentials = *creds
 		client, err = NewClickhouseSource[P](
 			cfg,
 		)
@@ -234,6 +508,58 @@ func initSource[P StoredParams](cfg config.SourceConfig) (Source[P], error) {
 		zap.S().Infow(
 			"created a new clickhouse client",
 		)
+	case config.BackendCSV, config.BackendJSONL, config.BackendParquet:
+		var err error
+		client, err = NewFileSource[P](
+			cfg.Path,
+			cfg.Backend,
+			providerCfg.SelectBatchSize,
+		)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"initializing %s source: %w",
+				cfg.Backend,
+				err,
+			)
+		}
+		zap.S().Infow("opened source file", "path", cfg.Path)
+	case config.BackendStdin:
+		var err error
+		client, err = NewFileSource[P](
+			"-",
+			cfg.Format,
+			providerCfg.SelectBatchSize,
+		)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"initializing %s source: %w",
+				cfg.Backend,
+				err,
+			)
+		}
+	case config.BackendKafka:
+		creds, err := loadCreds(cfg.Backend)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"initializing %s source: %w",
+				cfg.Backend,
+				err,
+			)
+		}
+		cfg.Credentials = *creds
+		client, err = NewKafkaSource[P](cfg, providerCfg.SelectBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"initializing %s source: %w",
+				cfg.Backend,
+				err,
+			)
+		}
+		zap.S().Infow(
+			"joined kafka consumer group",
+			"topic", cfg.Kafka.Topic,
+			"group", cfg.Kafka.Group,
+		)
 	default:
 		zap.S().Fatalw("unknown source backend", "backend", cfg)
 	}
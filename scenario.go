@@ -0,0 +1,150 @@
+package barash
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultMaxSteps = 10
+
+// FollowUp is a request which continues a scenario after a response.
+type FollowUp[P StoredParams] struct {
+	Params P
+	// Time to wait before sending the request, for example between polls
+	Delay time.Duration
+}
+
+// scenarioQueue sends follow-up requests back to the fetchers. The queue is
+// closed once the source is exhausted and no task which may still emit
+// follow-ups is in progress.
+type scenarioQueue[P StoredParams] struct {
+	mu sync.Mutex
+	// Tasks sent to the fetchers or waiting for their delay which haven't
+	// been performed yet
+	pending int
+	// Signalled when pending drops to zero
+	idle chan struct{}
+	out  chan APIRequest[P]
+}
+
+// add accounts tasks which are about to be sent to the fetchers.
+func (q *scenarioQueue[P]) add(tasks int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending += tasks
+}
+
+// done is called once a task is performed and its follow-ups are added.
+func (q *scenarioQueue[P]) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending--
+	if q.pending == 0 {
+		select {
+		case q.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *scenarioQueue[P]) inProgress() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending > 0
+}
+
+// scenariosEnabled reports whether responses may emit follow-ups.
+func (r *Runner[S, R, P, Q]) scenariosEnabled() bool {
+	var response R
+	_, ok := any(&response).(ResponseWithFollowUps[P])
+	return ok
+}
+
+// startScenarios forwards the tasks to the fetchers along with the
+// follow-ups of their responses.
+func (r *Runner[S, R, P, Q]) startScenarios(
+	wg *sync.WaitGroup,
+	ctx context.Context,
+	tasks chan APIRequest[P],
+) chan APIRequest[P] {
+	queue := &scenarioQueue[P]{
+		idle: make(chan struct{}, 1),
+		out:  make(chan APIRequest[P], cap(tasks)),
+	}
+	r.scenarios = queue
+	wg.Go(func() {
+		for task := range tasks {
+			queue.add(1)
+			select {
+			case queue.out <- task:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for queue.inProgress() {
+			select {
+			case <-queue.idle:
+			case <-ctx.Done():
+				return
+			}
+		}
+		zap.S().Infow("all scenarios are finished")
+		close(queue.out)
+	})
+	return queue.out
+}
+
+// scheduleFollowUps sends the follow-ups of the response after their delay.
+// They belong to the batch of the request, so it's committed once the whole
+// scenario is written.
+func (r *Runner[S, R, P, Q]) scheduleFollowUps(
+	ctx context.Context,
+	req APIRequest[P],
+	response R,
+	logger *zap.SugaredLogger,
+) {
+	scenario, ok := any(&response).(ResponseWithFollowUps[P])
+	if !ok {
+		return
+	}
+	followUps := scenario.FollowUps(req)
+	if len(followUps) == 0 {
+		return
+	}
+	maxSteps := r.config().Fetcher.Scenario.MaxSteps
+	if maxSteps <= 0 {
+		maxSteps = defaultMaxSteps
+	}
+	if req.Step >= maxSteps {
+		logger.Warnw(
+			"scenario has reached the step limit, dropping follow-ups",
+			"correlation_id", req.CorrelationID,
+			"max_steps", maxSteps,
+			"follow_ups", len(followUps),
+		)
+		r.stats.recordFollowUps(0, len(followUps))
+		return
+	}
+	r.stats.recordFollowUps(len(followUps), 0)
+	r.tracker.extend(req.batch, len(followUps))
+	r.scenarios.add(len(followUps))
+	for _, followUp := range followUps {
+		next := r.newAPIRequest(followUp.Params, req.batch, req.selectSpan)
+		next.CorrelationID = req.CorrelationID
+		next.Step = req.Step + 1
+		go func() {
+			select {
+			case <-time.After(followUp.Delay):
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case r.scenarios.out <- next:
+			case <-ctx.Done():
+			}
+		}()
+	}
+}
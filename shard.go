@@ -0,0 +1,67 @@
+package barash
+
+import (
+	"fmt"
+	"hash/fnv"
+	"text/template"
+
+	"github.com/kiltia/barash/config"
+)
+
+// ShardOf returns the shard of the task key. It uses FNV-1a, so the result
+// is stable across processes and versions.
+func ShardOf(key string, count int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(count))
+}
+
+// shardTemplateFuncs makes shard settings available in the select template.
+func shardTemplateFuncs(cfg config.ShardConfig) template.FuncMap {
+	return template.FuncMap{
+		"shardIndex": func() int { return cfg.Index },
+		"shardCount": func() int { return max(cfg.Count, 1) },
+	}
+}
+
+func validateShard[P StoredParams](cfg config.ShardConfig) error {
+	if cfg.Count < 2 {
+		return nil
+	}
+	if cfg.Index < 0 || cfg.Index >= cfg.Count {
+		return fmt.Errorf(
+			"shard index %d is out of range [0, %d)",
+			cfg.Index,
+			cfg.Count,
+		)
+	}
+	if cfg.Key == "" && !cfg.PushDown && !hasTaskKey[P]() {
+		return fmt.Errorf(
+			"shard key is required unless the parameters implement " +
+				"StoredParamsWithKey",
+		)
+	}
+	return nil
+}
+
+// filterShard keeps only the tasks which belong to the replica shard.
+func (r *Runner[S, R, P, Q]) filterShard(params []P) ([]P, error) {
+	cfg := r.config().Provider.Shard
+	if cfg.Count < 2 || cfg.PushDown {
+		return params, nil
+	}
+	result := params[:0:0]
+	for i := range params {
+		key, ok := ObjectKey(&params[i], cfg.Key)
+		if !ok {
+			return nil, fmt.Errorf(
+				"request parameters have no shard key %q",
+				cfg.Key,
+			)
+		}
+		if ShardOf(key, cfg.Count) == cfg.Index {
+			result = append(result, params[i])
+		}
+	}
+	return result, nil
+}
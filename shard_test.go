@@ -0,0 +1,163 @@
+package barash
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kiltia/barash/config"
+)
+
+type shardParams struct {
+	ID int `json:"id"`
+}
+
+type shardResponse struct{}
+
+func (shardResponse) IntoStored(
+	APIRequest[shardParams],
+	error,
+	int,
+	int,
+	time.Duration,
+	string,
+	string,
+) keyedResult {
+	return keyedResult{}
+}
+
+type shardState struct{}
+
+func (*shardState) UpdateState([]shardParams) {}
+
+func (*shardState) ResetState() {}
+
+func TestShardOfIsStable(t *testing.T) {
+	// FNV-1a of the keys, computed independently
+	tests := []struct {
+		key  string
+		want [4]int
+	}{
+		{"", [4]int{1, 2, 2, 5}},
+		{"a", [4]int{0, 1, 5, 12}},
+		{"task-1", [4]int{0, 2, 6, 6}},
+		{"12345", [4]int{0, 1, 1, 8}},
+		{"https://example.com/?id=42", [4]int{1, 0, 4, 13}},
+	}
+	for _, tt := range tests {
+		for i, count := range []int{2, 3, 7, 16} {
+			if got := ShardOf(tt.key, count); got != tt.want[i] {
+				t.Fatalf(
+					"ShardOf(%q, %d) = %d, want %d",
+					tt.key,
+					count,
+					got,
+					tt.want[i],
+				)
+			}
+		}
+	}
+}
+
+func TestShardsCoverEveryTask(t *testing.T) {
+	const (
+		tasks = 1000
+		count = 7
+	)
+	params := make([]shardParams, tasks)
+	for i := range params {
+		params[i].ID = i
+	}
+	owners := make(map[int]int, tasks)
+	for index := range count {
+		r := &Runner[keyedResult, shardResponse, shardParams, *shardState]{}
+		cfg := &config.Config{}
+		cfg.Provider.Shard = config.ShardConfig{
+			Index: index,
+			Count: count,
+			Key:   "id",
+		}
+		r.cfg.Store(cfg)
+		owned, err := r.filterShard(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every shard gets a fair part of the tasks
+		if len(owned) < tasks/count/2 {
+			t.Fatalf(
+				"shard %d owns %d tasks out of %d",
+				index,
+				len(owned),
+				tasks,
+			)
+		}
+		for _, p := range owned {
+			if owner, ok := owners[p.ID]; ok {
+				t.Fatalf(
+					"task %d is owned by shards %d and %d",
+					p.ID,
+					owner,
+					index,
+				)
+			}
+			owners[p.ID] = index
+			if want := ShardOf(strconv.Itoa(p.ID), count); want != index {
+				t.Fatalf(
+					"task %d of shard %d is owned by %d",
+					p.ID,
+					want,
+					index,
+				)
+			}
+		}
+	}
+	if len(owners) != tasks {
+		t.Fatalf("shards own %d tasks out of %d", len(owners), tasks)
+	}
+}
+
+func TestValidateShard(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   config.ShardConfig
+		keyed bool
+		valid bool
+	}{
+		{"disabled", config.ShardConfig{}, false, true},
+		{"single shard", config.ShardConfig{Count: 1}, false, true},
+		{"key field", config.ShardConfig{Count: 2, Key: "id"}, false, true},
+		{"task key", config.ShardConfig{Count: 2}, true, true},
+		{
+			"push down",
+			config.ShardConfig{Count: 2, PushDown: true},
+			false,
+			true,
+		},
+		{"no key", config.ShardConfig{Count: 2}, false, false},
+		{
+			"index out of range",
+			config.ShardConfig{Index: 2, Count: 2, Key: "id"},
+			false,
+			false,
+		},
+		{
+			"negative index",
+			config.ShardConfig{Index: -1, Count: 2, Key: "id"},
+			false,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.keyed {
+				err = validateShard[keyedParams](tt.cfg)
+			} else {
+				err = validateShard[shardParams](tt.cfg)
+			}
+			if (err == nil) != tt.valid {
+				t.Fatalf("validateShard() = %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package barash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/kiltia/barash/config"
+	"go.uber.org/zap"
+)
+
+func validateStages(stages []config.StageConfig) error {
+	names := map[string]bool{}
+	for i, stage := range stages {
+		if stage.Name == "" {
+			return fmt.Errorf("stage %d: name must be set", i)
+		}
+		if names[stage.Name] {
+			return fmt.Errorf("stage %d: duplicate name %q", i, stage.Name)
+		}
+		names[stage.Name] = true
+		if stage.Duration <= 0 {
+			return fmt.Errorf("stage %s: duration must be positive", stage.Name)
+		}
+		if stage.RPS <= 0 {
+			return fmt.Errorf("stage %s: rps must be positive", stage.Name)
+		}
+	}
+	return nil
+}
+
+// stageAt returns the index of the stage at the given time since the start
+// of the first one and the end of that stage. The last stage is returned if
+// the time is past all of them.
+func stageAt(
+	stages []config.StageConfig,
+	at time.Duration,
+) (int, time.Duration) {
+	var end time.Duration
+	for i, stage := range stages {
+		end += stage.Duration
+		if at < end {
+			return i, end
+		}
+	}
+	return len(stages) - 1, end
+}
+
+// newStagedSchedule starts requests at the rate of the current stage, at
+// fixed or exponentially distributed intervals.
+func newStagedSchedule(
+	model string,
+	stages []config.StageConfig,
+) (arrivalSchedule, error) {
+	var poisson bool
+	switch model {
+	case config.ArrivalModelConstant:
+	case config.ArrivalModelPoisson:
+		poisson = true
+	case config.ArrivalModelProfile:
+		return nil, errors.New("arrival profile can't be used with stages")
+	default:
+		return nil, fmt.Errorf("unknown arrival model: %s", model)
+	}
+	var total time.Duration
+	for _, stage := range stages {
+		total += stage.Duration
+	}
+	return func(at time.Duration) (time.Duration, bool) {
+		for at < total {
+			i, end := stageAt(stages, at)
+			interval := rateInterval(stages[i].RPS)
+			if poisson {
+				interval = time.Duration(
+					rand.ExpFloat64() / stages[i].RPS * float64(time.Second),
+				)
+			}
+			next := at + interval
+			if next <= end {
+				return next, next < total
+			}
+			// The next request is sent at the rate of the next stage
+			at = end
+		}
+		return 0, false
+	}, nil
+}
+
+// startStage marks the beginning of a load stage.
+func (r *Runner[S, R, P, Q]) startStage(stage config.StageConfig) {
+	r.stats.startStage(stage.Name)
+	zap.S().Infow(
+		"starting load stage",
+		"stage", stage.Name,
+		"duration", stage.Duration,
+		"rps", stage.RPS,
+	)
+}
+
+// runStages changes the rate limit of the fetchers as the stages go on. The
+// first stage is started right away, so it has to be called before the
+// fetchers are started. Time spent paused isn't counted towards the stage.
+// Once the last stage is over, the runner is drained.
+func (r *Runner[S, R, P, Q]) runStages(
+	wg *sync.WaitGroup,
+	ctx context.Context,
+) {
+	stages := r.config().Fetcher.Stages
+	r.control.setRPS(stages[0].RPS)
+	r.startStage(stages[0])
+	wg.Go(func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for i, stage := range stages {
+			if i > 0 {
+				r.control.setRPS(stage.RPS)
+				r.startStage(stage)
+			}
+			remaining := stage.Duration
+			for remaining > 0 {
+				if !r.control.resumed(ctx) {
+					return
+				}
+				changes := r.control.changes()
+				startedAt := time.Now()
+				timer.Reset(remaining)
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+					remaining = 0
+				case <-changes:
+					// Fetching may have been paused
+					timer.Stop()
+					remaining -= time.Since(startedAt)
+				}
+			}
+		}
+		zap.S().Infow("load stages are over, draining")
+		r.control.startDrain()
+	})
+}
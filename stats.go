@@ -0,0 +1,686 @@
+package barash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/kiltia/barash/config"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSummaryInterval = 10 * time.Second
+	// Latencies are recorded in microseconds, from 1µs to an hour
+	maxLatency       = time.Hour
+	latencySigFigs   = 3
+	statusClassError = "error"
+)
+
+// Summary describes the results of a run. It's written to the log when the
+// run is finished, and can be read from the runner at any time.
+type Summary struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+	// Seconds since the start, until the finish if the run is finished
+	Duration float64 `json:"duration_seconds"`
+
+	Tasks     int64 `json:"tasks"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	// Tasks by the status class of the last attempt, such as "2xx", or
+	// "error" if there was no response
+	StatusClasses map[string]int64 `json:"status_classes"`
+	Attempts      int64            `json:"attempts"`
+	Retries       int64            `json:"retries"`
+	// Number of times the circuit breaker has opened
+	BreakerTrips int64 `json:"breaker_trips"`
+	// Requests rejected while the circuit breaker was open, their tasks are
+	// sent again once it lets requests through
+	BreakerRejections int64 `json:"breaker_rejections"`
+	// Tasks whose responses have failed the validation rules, counted as
+	// failed
+	ValidationFailures int64 `json:"validation_failures"`
+	// Tasks whose response bodies have exceeded the size limit, either
+	// truncated or aborted
+	OversizedBodies int64 `json:"oversized_bodies"`
+	// Scheduled arrivals dropped because too many requests were in flight,
+	// their tasks are sent by the following arrivals
+	Dropped int64 `json:"dropped"`
+	// Follow-up requests emitted by responses, and the ones dropped because
+	// their scenario has reached the step limit
+	FollowUps        int64 `json:"follow_ups"`
+	DroppedFollowUps int64 `json:"dropped_follow_ups"`
+
+	// Completed tasks per second
+	RPS        float64            `json:"rps"`
+	Throughput []ThroughputSample `json:"throughput"`
+	Latency    LatencySummary     `json:"latency"`
+	// Attempt latencies by the status class of the attempt
+	LatencyByStatusClass map[string]LatencySummary `json:"latency_by_status_class"`
+	// Task latencies including the time the task should have been sent
+	// earlier, set if there's a schedule or a rate limit to compare with
+	CorrectedLatency *LatencySummary `json:"corrected_latency,omitempty"`
+	Sinks            []SinkSummary   `json:"sinks"`
+	// Results of every load stage in order, if there are stages
+	Stages []StageSummary `json:"stages,omitempty"`
+	// Assertions breached by the run, see the assertions config
+	FailedAssertions []AssertionFailure `json:"failed_assertions,omitempty"`
+}
+
+type ThroughputSample struct {
+	// Seconds since the start of the run to the start of the interval
+	Offset float64 `json:"offset_seconds"`
+	Tasks  int64   `json:"tasks"`
+	RPS    float64 `json:"rps"`
+}
+
+// LatencySummary holds attempt latencies in milliseconds.
+type LatencySummary struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min_ms"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+	P999  float64 `json:"p999_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// StageSummary holds the results of the tasks sent in a load stage.
+type StageSummary struct {
+	Name      string    `json:"name"`
+	StartedAt time.Time `json:"started_at"`
+	// Seconds from the start of the stage to the start of the next one
+	Duration  float64        `json:"duration_seconds"`
+	Tasks     int64          `json:"tasks"`
+	Succeeded int64          `json:"succeeded"`
+	Failed    int64          `json:"failed"`
+	RPS       float64        `json:"rps"`
+	Latency   LatencySummary `json:"latency"`
+}
+
+type SinkSummary struct {
+	Name     string `json:"name"`
+	Rows     int64  `json:"rows"`
+	Batches  int64  `json:"batches"`
+	Failures int64  `json:"failures"`
+	// Seconds spent inserting batches
+	Duration float64 `json:"duration_seconds"`
+}
+
+// runStats collects the counters of a run for the summary.
+type runStats struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	startedAt  time.Time
+	finishedAt time.Time
+
+	tasks              int64
+	succeeded          int64
+	statusClasses      map[string]int64
+	attempts           int64
+	breakerTrips       int64
+	breakerRejections  int64
+	validationFailures int64
+	oversizedBodies    int64
+	dropped            int64
+	followUps          int64
+	droppedFollowUps   int64
+	// Completed tasks per interval since the start
+	completed []int64
+	latency   *hdrhistogram.Histogram
+	// Attempt latencies by status class
+	classLatency map[string]*hdrhistogram.Histogram
+	// Task latencies corrected for coordinated omission, nil until there's
+	// a task with a known schedule
+	corrected *hdrhistogram.Histogram
+	sinks     []SinkSummary
+	// Time spent by every sink, converted to seconds in the summary
+	sinkDurations    []time.Duration
+	failedAssertions []AssertionFailure
+	// Load stages in the order they have started
+	stages []*stageStats
+}
+
+type stageStats struct {
+	name       string
+	startedAt  time.Time
+	finishedAt time.Time
+	tasks      int64
+	succeeded  int64
+	// Attempt latencies of the tasks sent in the stage
+	latency *hdrhistogram.Histogram
+}
+
+func newRunStats(interval time.Duration, sinks []string) *runStats {
+	if interval <= 0 {
+		interval = defaultSummaryInterval
+	}
+	stats := &runStats{
+		interval:      interval,
+		startedAt:     time.Now(),
+		statusClasses: map[string]int64{},
+		latency:       newLatencyHistogram(),
+		classLatency:  map[string]*hdrhistogram.Histogram{},
+		sinks:         make([]SinkSummary, len(sinks)),
+		sinkDurations: make([]time.Duration, len(sinks)),
+	}
+	for i, name := range sinks {
+		stats.sinks[i].Name = name
+	}
+	return stats
+}
+
+func newLatencyHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(1, maxLatency.Microseconds(), latencySigFigs)
+}
+
+// sinkName returns the type name of the sink without the package and type
+// parameters.
+func sinkName(sink any) string {
+	name := fmt.Sprintf("%T", sink)
+	name, _, _ = strings.Cut(name, "[")
+	name = strings.TrimPrefix(name, "*")
+	if _, after, ok := strings.Cut(name, "."); ok {
+		name = after
+	}
+	return name
+}
+
+func statusClass(statusCode int) string {
+	if statusCode < 100 {
+		return statusClassError
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// start resets the start time once the runner starts working.
+func (s *runStats) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startedAt = time.Now()
+}
+
+func (s *runStats) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finishedAt = time.Now()
+	if len(s.stages) > 0 {
+		s.stages[len(s.stages)-1].finishedAt = s.finishedAt
+	}
+}
+
+// startStage finishes the current load stage and starts the next one.
+func (s *runStats) startStage(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if len(s.stages) > 0 {
+		s.stages[len(s.stages)-1].finishedAt = now
+	}
+	s.stages = append(s.stages, &stageStats{
+		name:      name,
+		startedAt: now,
+		latency:   newLatencyHistogram(),
+	})
+}
+
+// currentStage returns the name of the current load stage, or an empty
+// string if there are no stages.
+func (s *runStats) currentStage() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stages) == 0 {
+		return ""
+	}
+	return s.stages[len(s.stages)-1].name
+}
+
+// stage returns the load stage with the given name, or nil if there's no
+// such stage. Must be called with the mutex held.
+func (s *runStats) stage(name string) *stageStats {
+	if name == "" {
+		return nil
+	}
+	for _, stage := range s.stages {
+		if stage.name == name {
+			return stage
+		}
+	}
+	return nil
+}
+
+// countCompleted must be called with the mutex held.
+func (s *runStats) countCompleted() {
+	bucket := int(time.Since(s.startedAt) / s.interval)
+	for len(s.completed) <= bucket {
+		s.completed = append(s.completed, 0)
+	}
+	s.completed[bucket]++
+}
+
+// taskTiming describes how long a task took compared to its schedule.
+type taskTiming struct {
+	// Time from the intended send time, or from the start of the first
+	// attempt if the task isn't scheduled, to the last response
+	latency time.Duration
+	// Whether the latency is measured from the intended send time
+	scheduled bool
+	// Interval between requests of a fetcher implied by the rate limit, zero
+	// if there's no limit
+	expectedInterval time.Duration
+}
+
+// recordTask accounts a task with all its attempts.
+func (s *runStats) recordTask(
+	stageName string,
+	attempts []AttemptData,
+	err error,
+	timing taskTiming,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks++
+	s.attempts += int64(len(attempts))
+	s.countCompleted()
+	stage := s.stage(stageName)
+	if stage != nil {
+		stage.tasks++
+	}
+	for _, attempt := range attempts {
+		if attempt.Response == nil {
+			continue
+		}
+		recordLatency(s.latency, attempt.Duration)
+		if stage != nil {
+			recordLatency(stage.latency, attempt.Duration)
+		}
+		class := statusClass(attempt.Response.StatusCode())
+		h, ok := s.classLatency[class]
+		if !ok {
+			h = newLatencyHistogram()
+			s.classLatency[class] = h
+		}
+		recordLatency(h, attempt.Duration)
+	}
+	s.recordCorrected(timing)
+
+	statusCode := 0
+	if len(attempts) > 0 && attempts[len(attempts)-1].Response != nil {
+		last := attempts[len(attempts)-1].Response
+		statusCode = last.StatusCode()
+		if info := responseBodyInfo(last); info != nil && info.oversized {
+			s.oversizedBodies++
+		}
+	}
+	class := statusClass(statusCode)
+	s.statusClasses[class]++
+	if errors.Is(err, ErrValidation) {
+		s.validationFailures++
+	}
+	// Client and server errors are successful if the validation rules
+	// expect them
+	if err == nil && statusCode >= 200 {
+		s.succeeded++
+		if stage != nil {
+			stage.succeeded++
+		}
+	}
+}
+
+func clampLatency(h *hdrhistogram.Histogram, d time.Duration) int64 {
+	// Values out of range are clamped, so they still show up in the max
+	return min(max(d.Microseconds(), 1), h.HighestTrackableValue())
+}
+
+func recordLatency(h *hdrhistogram.Histogram, d time.Duration) {
+	_ = h.RecordValue(clampLatency(h, d))
+}
+
+// recordCorrected accounts the task latency corrected for coordinated
+// omission. Scheduled tasks already include the delay before sending, and
+// for the rest the requests which should have been sent while waiting are
+// backfilled from the rate limit. Must be called with the mutex held.
+func (s *runStats) recordCorrected(timing taskTiming) {
+	if !timing.scheduled && timing.expectedInterval <= 0 {
+		return
+	}
+	if s.corrected == nil {
+		s.corrected = newLatencyHistogram()
+	}
+	if timing.scheduled {
+		recordLatency(s.corrected, timing.latency)
+		return
+	}
+	_ = s.corrected.RecordCorrectedValue(
+		clampLatency(s.corrected, timing.latency),
+		timing.expectedInterval.Microseconds(),
+	)
+}
+
+// recordRejected accounts a request rejected by the circuit breaker. The
+// task is sent again later, so it isn't completed yet.
+func (s *runStats) recordRejected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.breakerRejections++
+}
+
+func (s *runStats) recordDropped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped++
+}
+
+func (s *runStats) recordFollowUps(scheduled, dropped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.followUps += int64(scheduled)
+	s.droppedFollowUps += int64(dropped)
+}
+
+func (s *runStats) recordBreakerTrip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.breakerTrips++
+}
+
+// recordInsert accounts a batch inserted into the sink with the given index.
+func (s *runStats) recordInsert(
+	sink int,
+	rows int,
+	duration time.Duration,
+	err error,
+) {
+	if rows == 0 && err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sinkDurations[sink] += duration
+	if err != nil {
+		s.sinks[sink].Failures++
+		return
+	}
+	s.sinks[sink].Batches++
+	s.sinks[sink].Rows += int64(rows)
+}
+
+func (s *runStats) setFailedAssertions(failures []AssertionFailure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failedAssertions = failures
+}
+
+func (s *runStats) summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := s.finishedAt
+	if end.IsZero() {
+		end = time.Now()
+	}
+	duration := end.Sub(s.startedAt)
+
+	summary := Summary{
+		StartedAt:          s.startedAt,
+		FinishedAt:         s.finishedAt,
+		Duration:           duration.Seconds(),
+		Tasks:              s.tasks,
+		Succeeded:          s.succeeded,
+		Failed:             s.tasks - s.succeeded,
+		StatusClasses:      make(map[string]int64, len(s.statusClasses)),
+		Attempts:           s.attempts,
+		Retries:            s.attempts - s.tasks,
+		BreakerTrips:       s.breakerTrips,
+		BreakerRejections:  s.breakerRejections,
+		ValidationFailures: s.validationFailures,
+		OversizedBodies:    s.oversizedBodies,
+		Dropped:            s.dropped,
+		FollowUps:          s.followUps,
+		DroppedFollowUps:   s.droppedFollowUps,
+		Throughput:         make([]ThroughputSample, len(s.completed)),
+		Latency:            summarizeLatency(s.latency),
+		LatencyByStatusClass: make(
+			map[string]LatencySummary,
+			len(s.classLatency),
+		),
+		Sinks:            make([]SinkSummary, len(s.sinks)),
+		FailedAssertions: s.failedAssertions,
+	}
+	for class, count := range s.statusClasses {
+		summary.StatusClasses[class] = count
+	}
+	for class, h := range s.classLatency {
+		summary.LatencyByStatusClass[class] = summarizeLatency(h)
+	}
+	if s.corrected != nil {
+		corrected := summarizeLatency(s.corrected)
+		summary.CorrectedLatency = &corrected
+	}
+	if duration > 0 {
+		summary.RPS = float64(s.tasks) / duration.Seconds()
+	}
+	for i, tasks := range s.completed {
+		summary.Throughput[i] = ThroughputSample{
+			Offset: (time.Duration(i) * s.interval).Seconds(),
+			Tasks:  tasks,
+			RPS:    float64(tasks) / s.interval.Seconds(),
+		}
+	}
+	for i, sink := range s.sinks {
+		sink.Duration = s.sinkDurations[i].Seconds()
+		summary.Sinks[i] = sink
+	}
+	for _, stage := range s.stages {
+		summary.Stages = append(summary.Stages, stage.summary(end))
+	}
+	return summary
+}
+
+// summary returns the results of the stage, which is treated as running
+// until the given time if it isn't finished.
+func (s *stageStats) summary(end time.Time) StageSummary {
+	if !s.finishedAt.IsZero() {
+		end = s.finishedAt
+	}
+	duration := end.Sub(s.startedAt)
+	summary := StageSummary{
+		Name:      s.name,
+		StartedAt: s.startedAt,
+		Duration:  duration.Seconds(),
+		Tasks:     s.tasks,
+		Succeeded: s.succeeded,
+		Failed:    s.tasks - s.succeeded,
+		Latency:   summarizeLatency(s.latency),
+	}
+	if duration > 0 {
+		summary.RPS = float64(s.tasks) / duration.Seconds()
+	}
+	return summary
+}
+
+func summarizeLatency(h *hdrhistogram.Histogram) LatencySummary {
+	ms := func(us int64) float64 {
+		return float64(us) / 1000
+	}
+	if h.TotalCount() == 0 {
+		return LatencySummary{}
+	}
+	return LatencySummary{
+		Count: h.TotalCount(),
+		Min:   ms(h.Min()),
+		Mean:  h.Mean() / 1000,
+		P50:   ms(h.ValueAtQuantile(50)),
+		P90:   ms(h.ValueAtQuantile(90)),
+		P95:   ms(h.ValueAtQuantile(95)),
+		P99:   ms(h.ValueAtQuantile(99)),
+		P999:  ms(h.ValueAtQuantile(99.9)),
+		Max:   ms(h.Max()),
+	}
+}
+
+// Summary returns the results of the run so far.
+func (r *Runner[S, R, P, Q]) Summary() Summary {
+	return r.stats.summary()
+}
+
+// reportSummary logs the summary of the finished run and writes it to the
+// configured file.
+func (r *Runner[S, R, P, Q]) reportSummary() {
+	summary := r.Summary()
+	zap.S().Infow(
+		"run is finished",
+		"tasks", summary.Tasks,
+		"succeeded", summary.Succeeded,
+		"failed", summary.Failed,
+		"status_classes", summary.StatusClasses,
+		"retries", summary.Retries,
+		"breaker_trips", summary.BreakerTrips,
+		"validation_failures", summary.ValidationFailures,
+		"oversized_bodies", summary.OversizedBodies,
+		"dropped", summary.Dropped,
+		"rps", summary.RPS,
+		"latency", summary.Latency,
+		"sinks", summary.Sinks,
+		"stages", summary.Stages,
+		"failed_assertions", summary.FailedAssertions,
+		"duration", time.Duration(summary.Duration*float64(time.Second)),
+	)
+	cfg := r.config().Summary
+	if cfg.Path == "" {
+		return
+	}
+	if err := writeSummary(cfg, summary); err != nil {
+		zap.S().Errorw("writing summary", "path", cfg.Path, "error", err)
+		return
+	}
+	zap.S().Infow("summary is written", "path", cfg.Path)
+}
+
+func writeSummary(cfg config.SummaryConfig, summary Summary) error {
+	format := cfg.Format
+	if format == "" {
+		format = config.SummaryFormatJSON
+		if ext := filepath.Ext(cfg.Path); ext == ".html" || ext == ".htm" {
+			format = config.SummaryFormatHTML
+		}
+	}
+	file, err := os.Create(cfg.Path)
+	if err != nil {
+		return fmt.Errorf("creating summary file: %w", err)
+	}
+	defer file.Close()
+
+	switch format {
+	case config.SummaryFormatJSON:
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(summary)
+	case config.SummaryFormatHTML:
+		err = summaryTemplate.Execute(file, summary)
+	default:
+		return fmt.Errorf("unknown summary format: %s", format)
+	}
+	if err != nil {
+		return fmt.Errorf("encoding summary: %w", err)
+	}
+	return file.Close()
+}
+
+// latencyRow is a row of the latency table in the HTML summary.
+type latencyRow struct {
+	Name string
+	LatencySummary
+}
+
+func newLatencyRow(name string, latency any) latencyRow {
+	switch latency := latency.(type) {
+	case LatencySummary:
+		return latencyRow{Name: name, LatencySummary: latency}
+	case *LatencySummary:
+		return latencyRow{Name: name, LatencySummary: *latency}
+	}
+	return latencyRow{Name: name}
+}
+
+var summaryTemplate = template.Must(
+	template.New("summary").
+		Funcs(template.FuncMap{"latencyRow": newLatencyRow}).
+		Parse(summaryHTML),
+)
+
+const summaryHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Barash run summary</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 12px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Run summary</h1>
+<table>
+<tr><th>Started at</th><td>{{.StartedAt.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Finished at</th><td>{{.FinishedAt.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Duration, s</th><td>{{printf "%.1f" .Duration}}</td></tr>
+<tr><th>Tasks</th><td>{{.Tasks}}</td></tr>
+<tr><th>Succeeded</th><td>{{.Succeeded}}</td></tr>
+<tr><th>Failed</th><td>{{.Failed}}</td></tr>
+<tr><th>Attempts</th><td>{{.Attempts}}</td></tr>
+<tr><th>Retries</th><td>{{.Retries}}</td></tr>
+<tr><th>Breaker trips</th><td>{{.BreakerTrips}}</td></tr>
+<tr><th>Breaker rejections</th><td>{{.BreakerRejections}}</td></tr>
+<tr><th>Validation failures</th><td>{{.ValidationFailures}}</td></tr>
+<tr><th>Oversized bodies</th><td>{{.OversizedBodies}}</td></tr>
+<tr><th>Dropped arrivals</th><td>{{.Dropped}}</td></tr>
+<tr><th>Follow-ups</th><td>{{.FollowUps}}</td></tr>
+<tr><th>Dropped follow-ups</th><td>{{.DroppedFollowUps}}</td></tr>
+<tr><th>RPS</th><td>{{printf "%.1f" .RPS}}</td></tr>
+</table>
+{{with .FailedAssertions}}<h2>Failed assertions</h2>
+<table>
+<tr><th>Assertion</th><th>Limit</th><th>Actual</th></tr>
+{{range .}}<tr><td>{{.Assertion}}</td><td>{{.Limit}}</td><td>{{.Actual}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Status classes</h2>
+<table>
+<tr><th>Class</th><th>Tasks</th></tr>
+{{range $class, $count := .StatusClasses}}<tr><td>{{$class}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+<h2>Latency, ms</h2>
+<table>
+<tr><th></th><th>Count</th><th>Min</th><th>Mean</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>p99.9</th><th>Max</th></tr>
+{{template "latency" (latencyRow "all" .Latency)}}
+{{range $class, $latency := .LatencyByStatusClass}}{{template "latency" (latencyRow $class $latency)}}
+{{end}}{{with .CorrectedLatency}}{{template "latency" (latencyRow "corrected" .)}}
+{{end}}</table>
+<h2>Sinks</h2>
+<table>
+<tr><th>Sink</th><th>Rows</th><th>Batches</th><th>Failures</th><th>Duration, s</th></tr>
+{{range .Sinks}}<tr><td>{{.Name}}</td><td>{{.Rows}}</td><td>{{.Batches}}</td><td>{{.Failures}}</td><td>{{printf "%.3f" .Duration}}</td></tr>
+{{end}}</table>
+{{with .Stages}}<h2>Stages</h2>
+<table>
+<tr><th>Stage</th><th>Duration, s</th><th>Tasks</th><th>Succeeded</th><th>Failed</th><th>RPS</th><th>p50, ms</th><th>p95, ms</th><th>p99, ms</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{printf "%.1f" .Duration}}</td><td>{{.Tasks}}</td><td>{{.Succeeded}}</td><td>{{.Failed}}</td><td>{{printf "%.1f" .RPS}}</td><td>{{.Latency.P50}}</td><td>{{.Latency.P95}}</td><td>{{.Latency.P99}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Throughput</h2>
+<table>
+<tr><th>Offset, s</th><th>Tasks</th><th>RPS</th></tr>
+{{range .Throughput}}<tr><td>{{.Offset}}</td><td>{{.Tasks}}</td><td>{{printf "%.1f" .RPS}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+{{define "latency"}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{.Min}}</td><td>{{printf "%.3f" .Mean}}</td><td>{{.P50}}</td><td>{{.P90}}</td><td>{{.P95}}</td><td>{{.P99}}</td><td>{{.P999}}</td><td>{{.Max}}</td></tr>{{end}}`
@@ -0,0 +1,348 @@
+package barash
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kiltia/barash/config"
+	"github.com/sony/gobreaker/v2"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"resty.dev/v3"
+)
+
+// apiTarget is an endpoint of the API with its own client and circuit
+// breaker.
+type apiTarget struct {
+	name   string
+	url    *url.URL
+	method config.RunnerHTTPMethod
+	weight float64
+	// Index in the api.targets list, or -1 if the target is the request url
+	// of the api section
+	index     int
+	client    *resty.Client
+	breaker   *gobreaker.CircuitBreaker[*resty.Response]
+	validator *responseValidator
+	// Name of the decoder, JSON if empty
+	decoder string
+}
+
+// targetSettings returns the targets of the configuration with the unset
+// settings taken from the api section. Without targets, the request url of
+// the api section is the only target.
+func targetSettings(cfg *config.Config) []config.TargetConfig {
+	targets := cfg.API.Targets
+	if len(targets) == 0 {
+		targets = []config.TargetConfig{{
+			RequestURL: cfg.API.RequestURL,
+			Method:     cfg.API.Method,
+		}}
+	}
+	resolved := make([]config.TargetConfig, len(targets))
+	for i, target := range targets {
+		if target.Method == "" {
+			target.Method = cfg.API.Method
+		}
+		if target.APITimeout == 0 {
+			target.APITimeout = cfg.API.APITimeout
+		}
+		if target.NumRetries == nil {
+			target.NumRetries = &cfg.API.NumRetries
+		}
+		if target.MinWaitTime == 0 {
+			target.MinWaitTime = cfg.API.MinWaitTime
+		}
+		if target.MaxWaitTime == 0 {
+			target.MaxWaitTime = cfg.API.MaxWaitTime
+		}
+		if target.Validation == nil {
+			target.Validation = &cfg.API.Validation
+		}
+		if target.Decoder == "" {
+			target.Decoder = cfg.API.Decoder
+		}
+		if target.ResponseBody == nil {
+			target.ResponseBody = &cfg.API.ResponseBody
+		}
+		resolved[i] = target
+	}
+	return resolved
+}
+
+// defaultBreakerTimeout is how long the circuit breaker stays open if the
+// timeout isn't set, the same as the gobreaker default.
+const defaultBreakerTimeout = 60 * time.Second
+
+// breakerTimeout returns how long the circuit breaker of the target stays
+// open before it lets requests through again.
+func breakerTimeout(cfg *config.Config, index int) time.Duration {
+	timeout := breakerSettings(cfg, index).Timeout
+	if timeout <= 0 {
+		return defaultBreakerTimeout
+	}
+	return timeout
+}
+
+// breakerSettings returns the circuit breaker settings of the target with
+// the given index.
+func breakerSettings(
+	cfg *config.Config,
+	index int,
+) config.CircuitBreakerConfig {
+	if index >= 0 && cfg.API.Targets[index].CircuitBreaker != nil {
+		return *cfg.API.Targets[index].CircuitBreaker
+	}
+	return cfg.Fetcher.CircuitBreaker
+}
+
+func validateTargets(targets []config.TargetConfig) error {
+	names := map[string]bool{}
+	for i, target := range targets {
+		if target.Name == "" {
+			return fmt.Errorf("target %d: name must be set", i)
+		}
+		if names[target.Name] {
+			return fmt.Errorf("target %d: duplicate name %q", i, target.Name)
+		}
+		names[target.Name] = true
+		if target.Weight < 0 {
+			return fmt.Errorf(
+				"target %s: weight must not be negative",
+				target.Name,
+			)
+		}
+	}
+	return nil
+}
+
+func newHTTPClient() *resty.Client {
+	return resty.New().
+		AddRetryConditions(func(r *resty.Response, err error) bool {
+			ctx := r.Request.Context()
+			fetcherNum, _ := ctx.Value(ContextKeyFetcherNum).(int)
+			if r.StatusCode() >= 500 {
+				zap.S().
+					Debugw(
+						"retrying request",
+						"fetcher_num",
+						fetcherNum,
+						"status_code",
+						r.StatusCode(),
+						"url",
+						r.Request.URL,
+					)
+				return true
+			}
+			return false
+		}).
+		AddRequestMiddleware(traceAttempts).
+		SetLogger(zap.S())
+}
+
+// configureClient applies the settings which can be reloaded to the client.
+func configureClient(client *resty.Client, target config.TargetConfig) {
+	client.
+		SetTimeout(target.APITimeout).
+		SetRetryCount(*target.NumRetries).
+		SetRetryWaitTime(target.MinWaitTime).
+		SetRetryMaxWaitTime(target.MaxWaitTime)
+}
+
+// initTargets creates a client and a circuit breaker for every target. The
+// clients share the transport.
+func (r *Runner[S, R, P, Q]) initTargets(transport http.RoundTripper) error {
+	cfg := r.config()
+	if err := validateTargets(cfg.API.Targets); err != nil {
+		return err
+	}
+	settings := targetSettings(cfg)
+	var totalWeight float64
+	for _, target := range settings {
+		totalWeight += target.Weight
+	}
+	for i, target := range settings {
+		requestURL, err := url.Parse(target.RequestURL)
+		if err != nil {
+			return fmt.Errorf(
+				"parsing request url of target %s: %w",
+				target.Name,
+				err,
+			)
+		}
+		index := i
+		if len(cfg.API.Targets) == 0 {
+			index = -1
+		}
+		validator, err := newResponseValidator(*target.Validation)
+		if err != nil {
+			return fmt.Errorf(
+				"compiling validation rules of target %s: %w",
+				target.Name,
+				err,
+			)
+		}
+		if !r.decoders.known(target.Decoder) {
+			return fmt.Errorf(
+				"unknown decoder of target %s: %s",
+				target.Name,
+				target.Decoder,
+			)
+		}
+		weight := target.Weight
+		// Without weights, tasks are split evenly
+		if totalWeight == 0 {
+			weight = 1
+		}
+		targetTransport, err := newTargetTransport(
+			transport,
+			*target.ResponseBody,
+		)
+		if err != nil {
+			return fmt.Errorf(
+				"limiting response bodies of target %s: %w",
+				target.Name,
+				err,
+			)
+		}
+		client := newHTTPClient().SetTransport(targetTransport)
+		configureClient(client, target)
+		r.targets = append(r.targets, &apiTarget{
+			name:      target.Name,
+			url:       requestURL,
+			method:    target.Method,
+			weight:    weight,
+			index:     index,
+			client:    client,
+			breaker:   r.newBreaker(target.Name, index),
+			validator: validator,
+			decoder:   target.Decoder,
+		})
+	}
+	if len(cfg.API.Targets) > 0 {
+		zap.S().Infow("splitting traffic between targets", "targets", settings)
+	}
+	return nil
+}
+
+func (r *Runner[S, R, P, Q]) newBreaker(
+	name string,
+	index int,
+) *gobreaker.CircuitBreaker[*resty.Response] {
+	settings := breakerSettings(r.config(), index)
+	if name == "" {
+		name = "outgoing_requests"
+	}
+	return gobreaker.NewCircuitBreaker[*resty.Response](
+		gobreaker.Settings{
+			Name:        name,
+			MaxRequests: settings.MaxRequests,
+			Interval:    settings.Interval,
+			// Fixed when the breaker is created, rejected tasks are delayed
+			// by the same timeout
+			Timeout: breakerTimeout(r.config(), index),
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				// Thresholds are read on every call, so they can be reloaded
+				cbCfg := breakerSettings(r.config(), index)
+				if cbCfg.Enabled {
+					tooManyTotal := counts.TotalFailures > cbCfg.TotalFailurePerInterval
+					tooManyConsecutive := counts.ConsecutiveFailures > cbCfg.ConsecutiveFailure
+					return tooManyTotal || tooManyConsecutive
+				} else {
+					return false
+				}
+			},
+			OnStateChange: func(name string, _, to gobreaker.State) {
+				if to == gobreaker.StateOpen {
+					zap.S().Warnw("circuit breaker is open", "target", name)
+					r.stats.recordBreakerTrip()
+				}
+			},
+		})
+}
+
+// reloadTargets applies reloaded client settings to the targets.
+func (r *Runner[S, R, P, Q]) reloadTargets(cfg *config.Config) {
+	settings := targetSettings(cfg)
+	for i, target := range r.targets {
+		configureClient(target.client, settings[i])
+	}
+}
+
+// setTransport replaces the transport of all targets.
+func (r *Runner[S, R, P, Q]) setTransport(transport http.RoundTripper) {
+	for _, target := range r.targets {
+		target.client.SetTransport(transport)
+	}
+}
+
+var errUnknownTarget = errors.New("unknown target")
+
+// pickTarget returns the target the params are routed to, or a random one
+// by weight if they aren't routed.
+func (r *Runner[S, R, P, Q]) pickTarget(params *P) (*apiTarget, error) {
+	p, ok := any(params).(StoredParamsWithTarget)
+	if !ok || p.TargetName() == "" {
+		return r.pickWeighted(), nil
+	}
+	for _, target := range r.targets {
+		if target.name == p.TargetName() {
+			return target, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownTarget, p.TargetName())
+}
+
+func (r *Runner[S, R, P, Q]) pickWeighted() *apiTarget {
+	if len(r.targets) == 1 {
+		return r.targets[0]
+	}
+	var totalWeight float64
+	for _, target := range r.targets {
+		totalWeight += target.weight
+	}
+	point := rand.Float64() * totalWeight
+	var picked *apiTarget
+	for _, target := range r.targets {
+		if target.weight == 0 {
+			continue
+		}
+		picked = target
+		if point < target.weight {
+			break
+		}
+		point -= target.weight
+	}
+	return picked
+}
+
+// newAPIRequest forms a request to the target picked for the params.
+func (r *Runner[S, R, P, Q]) newAPIRequest(
+	params P,
+	batch uint64,
+	selectSpan trace.SpanContext,
+) APIRequest[P] {
+	target, err := r.pickTarget(&params)
+	if err != nil {
+		zap.S().Warnw(
+			"routing request, picking a target by weight",
+			"error", err,
+		)
+		target = r.pickWeighted()
+	}
+	return APIRequest[P]{
+		RequestURL: *target.url,
+		Method:     target.method,
+		Params:     params,
+		Target:     target.name,
+		Step:       1,
+		Page:       1,
+		batch:      batch,
+		selectSpan: selectSpan,
+		target:     target,
+	}
+}
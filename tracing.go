@@ -0,0 +1,177 @@
+package barash
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kiltia/barash/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"resty.dev/v3"
+)
+
+const (
+	tracerName         = "github.com/kiltia/barash"
+	defaultServiceName = "barash"
+)
+
+// tracePropagator writes W3C trace context headers to upstream requests.
+var tracePropagator = propagation.TraceContext{}
+
+// initTracing creates a tracer which exports spans to the OTLP collector,
+// along with a function that flushes and stops the exporter. A no-op tracer
+// is returned if tracing is disabled.
+func initTracing(
+	cfg config.TracingConfig,
+) (trace.Tracer, func(context.Context) error, error) {
+	if !cfg.Enabled {
+		return noop.NewTracerProvider().Tracer(tracerName),
+			func(context.Context) error { return nil },
+			nil
+	}
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	ctx := context.Background()
+	switch cfg.Protocol {
+	case config.TracingProtocolGRPC, "":
+		var opts []otlptracegrpc.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	case config.TracingProtocolHTTP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, nil, fmt.Errorf(
+			"unknown tracing protocol: %s",
+			cfg.Protocol,
+		)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating otlp exporter: %w", err)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", serviceName)),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating tracing resource: %w", err)
+	}
+	ratio := cfg.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(
+			sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)),
+		),
+	)
+	return provider.Tracer(tracerName), provider.Shutdown, nil
+}
+
+// endSpan marks the span as failed if there's an error and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// attemptTracerKey is the request context key of the attemptTracer.
+type attemptTracerKey struct{}
+
+// attemptTracer traces every attempt of a request as a child span of the
+// request span. The span of an attempt is started right before it's sent, so
+// the traceparent header of each attempt points to its own span.
+type attemptTracer struct {
+	tracer trace.Tracer
+	// Context of the request span
+	ctx context.Context
+	// Span of the attempt in flight
+	span trace.Span
+}
+
+// newAttemptTracer returns nil if the request span isn't recorded.
+func newAttemptTracer(ctx context.Context, tracer trace.Tracer) *attemptTracer {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return nil
+	}
+	return &attemptTracer{tracer: tracer, ctx: ctx}
+}
+
+// start starts the span of the attempt and injects it into the headers.
+func (t *attemptTracer) start(r *resty.Request) {
+	// An attempt which has failed before it was sent is never finished
+	t.end(nil, nil)
+	var ctx context.Context
+	ctx, t.span = t.tracer.Start(
+		t.ctx,
+		"attempt",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.Int("http.request.resend_count", r.Attempt-1),
+		),
+	)
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+}
+
+// end finishes the span of the attempt in flight, if there's one.
+func (t *attemptTracer) end(resp *resty.Response, err error) {
+	if t.span == nil {
+		return
+	}
+	span := t.span
+	t.span = nil
+	var opts []trace.SpanEndOption
+	if resp != nil && resp.RawResponse != nil {
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", resp.StatusCode()),
+		)
+		if resp.IsError() {
+			span.SetStatus(codes.Error, resp.Status())
+		}
+		opts = append(opts, trace.WithTimestamp(resp.ReceivedAt()))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(opts...)
+}
+
+// traceAttempts is a request middleware which starts the span of every
+// attempt of the requests carrying an attemptTracer in their context.
+func traceAttempts(_ *resty.Client, r *resty.Request) error {
+	if t, ok := r.Context().Value(attemptTracerKey{}).(*attemptTracer); ok {
+		t.start(r)
+	}
+	return nil
+}
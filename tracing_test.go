@@ -0,0 +1,88 @@
+package barash
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestAttemptSpansAreInjected(t *testing.T) {
+	const retries = 2
+	var (
+		mu      sync.Mutex
+		parents []trace.SpanContext
+	)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracePropagator.Extract(
+				context.Background(),
+				propagation.HeaderCarrier(r.Header),
+			)
+			mu.Lock()
+			defer mu.Unlock()
+			parents = append(parents, trace.SpanContextFromContext(ctx))
+			if len(parents) <= retries {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		},
+	))
+	defer srv.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).
+		Tracer(tracerName)
+	client := newHTTPClient().
+		SetRetryCount(retries).
+		SetRetryWaitTime(time.Millisecond).
+		SetRetryMaxWaitTime(time.Millisecond)
+
+	ctx, span := tracer.Start(context.Background(), "request")
+	tracker := RetryTracker{tracing: newAttemptTracer(ctx, tracer)}
+	ctx = context.WithValue(ctx, attemptTracerKey{}, tracker.tracing)
+	resp, err := client.R().
+		WithContext(ctx).
+		AddRetryHooks(tracker.Add).
+		Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Add(resp, err)
+	span.End()
+
+	var attempts []sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Name() == "attempt" {
+			attempts = append(attempts, s)
+		}
+	}
+	if len(attempts) != retries+1 || len(parents) != retries+1 {
+		t.Fatalf(
+			"got %d attempt spans and %d requests, want %d",
+			len(attempts),
+			len(parents),
+			retries+1,
+		)
+	}
+	for i, attempt := range attempts {
+		if attempt.Parent().SpanID() != span.SpanContext().SpanID() {
+			t.Fatalf("attempt %d isn't a child of the request span", i)
+		}
+		// Every attempt carries its own span as the parent
+		if parents[i].SpanID() != attempt.SpanContext().SpanID() {
+			t.Fatalf(
+				"attempt %d is sent with parent %s, want %s",
+				i,
+				parents[i].SpanID(),
+				attempt.SpanContext().SpanID(),
+			)
+		}
+	}
+}
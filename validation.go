@@ -0,0 +1,358 @@
+package barash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kiltia/barash/config"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"resty.dev/v3"
+)
+
+// ErrValidation is wrapped by the error passed to IntoStored when the
+// response fails the validation rules of its target.
+var ErrValidation = errors.New("response validation failed")
+
+// responseValidator checks responses against the validation settings of a
+// target. A nil validator accepts every response.
+type responseValidator struct {
+	statuses    []int
+	headers     map[string]*regexp.Regexp
+	schema      *jsonschema.Schema
+	assertions  []bodyAssertion
+	bodyRegex   *regexp.Regexp
+	maxBodySize int64
+}
+
+type bodyAssertion struct {
+	path  string
+	steps []pathStep
+	// Expected value decoded the same way as the body, nil if unset
+	equals  any
+	matches *regexp.Regexp
+	absent  bool
+}
+
+// newResponseValidator compiles the validation settings, or returns nil if
+// there's nothing to check.
+func newResponseValidator(
+	cfg config.ValidationConfig,
+) (*responseValidator, error) {
+	if len(cfg.Statuses) == 0 && len(cfg.Headers) == 0 &&
+		cfg.JSONSchema == "" && len(cfg.Assertions) == 0 &&
+		cfg.BodyRegex == "" && cfg.MaxBodySize <= 0 {
+		return nil, nil
+	}
+	v := &responseValidator{
+		statuses:    cfg.Statuses,
+		headers:     make(map[string]*regexp.Regexp, len(cfg.Headers)),
+		maxBodySize: cfg.MaxBodySize,
+	}
+	for name, pattern := range cfg.Headers {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"compiling pattern of header %s: %w",
+				name,
+				err,
+			)
+		}
+		v.headers[name] = re
+	}
+	if cfg.BodyRegex != "" {
+		re, err := regexp.Compile(cfg.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("compiling body regex: %w", err)
+		}
+		v.bodyRegex = re
+	}
+	if cfg.JSONSchema != "" {
+		schema, err := jsonschema.NewCompiler().Compile(cfg.JSONSchema)
+		if err != nil {
+			return nil, fmt.Errorf("compiling json schema: %w", err)
+		}
+		v.schema = schema
+	}
+	for i, assertion := range cfg.Assertions {
+		compiled, err := newBodyAssertion(assertion)
+		if err != nil {
+			return nil, fmt.Errorf("assertion %d: %w", i, err)
+		}
+		v.assertions = append(v.assertions, compiled)
+	}
+	return v, nil
+}
+
+func newBodyAssertion(cfg config.BodyAssertion) (bodyAssertion, error) {
+	steps, err := parseJSONPath(cfg.Path)
+	if err != nil {
+		return bodyAssertion{}, fmt.Errorf("parsing path %q: %w", cfg.Path, err)
+	}
+	assertion := bodyAssertion{
+		path:   cfg.Path,
+		steps:  steps,
+		absent: cfg.Absent,
+	}
+	if cfg.Equals != nil {
+		// The expected value is decoded from YAML, so it's converted to the
+		// types the body is decoded into
+		data, err := json.Marshal(cfg.Equals)
+		if err != nil {
+			return bodyAssertion{}, fmt.Errorf(
+				"encoding expected value: %w",
+				err,
+			)
+		}
+		if err := json.Unmarshal(data, &assertion.equals); err != nil {
+			return bodyAssertion{}, fmt.Errorf(
+				"decoding expected value: %w",
+				err,
+			)
+		}
+	}
+	if cfg.Matches != "" {
+		re, err := regexp.Compile(cfg.Matches)
+		if err != nil {
+			return bodyAssertion{}, fmt.Errorf("compiling pattern: %w", err)
+		}
+		assertion.matches = re
+	}
+	return assertion, nil
+}
+
+// acceptsStatus reports whether the status is listed as expected, so it
+// isn't treated as a client or server error.
+func (v *responseValidator) acceptsStatus(statusCode int) bool {
+	return v != nil && slices.Contains(v.statuses, statusCode)
+}
+
+// validate returns the first check failed by the response.
+func (v *responseValidator) validate(resp *resty.Response) error {
+	if v == nil {
+		return nil
+	}
+	if len(v.statuses) > 0 && !v.acceptsStatus(resp.StatusCode()) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode())
+	}
+	if err := v.validateHeaders(resp.Header()); err != nil {
+		return err
+	}
+	// Bodies streamed to files aren't in memory to be checked
+	if info := responseBodyInfo(resp); info != nil && info.blob != nil {
+		return nil
+	}
+	body := resp.Bytes()
+	if v.maxBodySize > 0 && int64(len(body)) > v.maxBodySize {
+		return fmt.Errorf(
+			"body of %d bytes exceeds the limit of %d",
+			len(body),
+			v.maxBodySize,
+		)
+	}
+	if v.bodyRegex != nil && !v.bodyRegex.Match(body) {
+		return fmt.Errorf("body doesn't match %s", v.bodyRegex)
+	}
+	if v.schema == nil && len(v.assertions) == 0 {
+		return nil
+	}
+	var document any
+	if err := json.Unmarshal(body, &document); err != nil {
+		return fmt.Errorf("decoding body: %w", err)
+	}
+	if v.schema != nil {
+		if err := v.schema.Validate(document); err != nil {
+			// Schema errors list every failed keyword on its own line
+			return fmt.Errorf(
+				"body doesn't conform to the schema: %s",
+				strings.ReplaceAll(err.Error(), "\n", "; "),
+			)
+		}
+	}
+	for _, assertion := range v.assertions {
+		if err := assertion.check(document); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *responseValidator) validateHeaders(header http.Header) error {
+	for name, re := range v.headers {
+		values := header.Values(name)
+		if len(values) == 0 {
+			return fmt.Errorf("header %s is missing", name)
+		}
+		if !slices.ContainsFunc(values, re.MatchString) {
+			return fmt.Errorf(
+				"header %s: %q doesn't match %s",
+				name,
+				values[0],
+				re,
+			)
+		}
+	}
+	return nil
+}
+
+func (a bodyAssertion) check(document any) error {
+	found := findJSONPath(document, a.steps)
+	if a.absent {
+		if len(found) > 0 {
+			return fmt.Errorf(
+				"%s: %s is found, expected nothing",
+				a.path,
+				formatJSONValue(found[0]),
+			)
+		}
+		return nil
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("%s: nothing is found", a.path)
+	}
+	for _, value := range found {
+		if a.equals != nil && !reflect.DeepEqual(value, a.equals) {
+			return fmt.Errorf(
+				"%s: %s is not equal to %s",
+				a.path,
+				formatJSONValue(value),
+				formatJSONValue(a.equals),
+			)
+		}
+		if a.matches != nil {
+			text, ok := value.(string)
+			if !ok {
+				text = formatJSONValue(value)
+			}
+			if !a.matches.MatchString(text) {
+				return fmt.Errorf(
+					"%s: %s doesn't match %s",
+					a.path,
+					formatJSONValue(value),
+					a.matches,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+func formatJSONValue(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// pathStep is a step of a JSONPath, selecting a member by name, an element
+// by index or all members and elements.
+type pathStep struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses a path made of $, .name, .*, ['name'], [index] and
+// [*]. Negative indexes count from the end of the array.
+func parseJSONPath(path string) ([]pathStep, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, errors.New("path must start with $")
+	}
+	var steps []pathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			switch name {
+			case "":
+				return nil, errors.New("empty member name")
+			case "*":
+				steps = append(steps, pathStep{wildcard: true})
+			default:
+				steps = append(steps, pathStep{name: name})
+			}
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.New("unclosed bracket")
+			}
+			selector := rest[1:end]
+			rest = rest[end+1:]
+			step, err := parseSelector(selector)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+		default:
+			return nil, fmt.Errorf("unexpected character %q", rest[0])
+		}
+	}
+	return steps, nil
+}
+
+func parseSelector(selector string) (pathStep, error) {
+	if selector == "*" {
+		return pathStep{wildcard: true}, nil
+	}
+	if len(selector) >= 2 &&
+		(selector[0] == '\'' || selector[0] == '"') &&
+		selector[len(selector)-1] == selector[0] {
+		return pathStep{name: selector[1 : len(selector)-1]}, nil
+	}
+	index, err := strconv.Atoi(selector)
+	if err != nil {
+		return pathStep{}, fmt.Errorf("invalid selector [%s]", selector)
+	}
+	return pathStep{index: index, isIndex: true}, nil
+}
+
+// findJSONPath returns the values selected by the path in the document.
+func findJSONPath(document any, steps []pathStep) []any {
+	if len(steps) == 0 {
+		return []any{document}
+	}
+	step := steps[0]
+	var selected []any
+	switch value := document.(type) {
+	case map[string]any:
+		if step.wildcard {
+			for _, member := range value {
+				selected = append(selected, member)
+			}
+		} else if member, ok := value[step.name]; ok && !step.isIndex {
+			selected = append(selected, member)
+		}
+	case []any:
+		if step.wildcard {
+			selected = value
+		} else if step.isIndex {
+			index := step.index
+			if index < 0 {
+				index += len(value)
+			}
+			if index >= 0 && index < len(value) {
+				selected = append(selected, value[index])
+			}
+		}
+	}
+	var found []any
+	for _, value := range selected {
+		found = append(found, findJSONPath(value, steps[1:])...)
+	}
+	return found
+}
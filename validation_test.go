@@ -0,0 +1,203 @@
+package barash
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/kiltia/barash/config"
+)
+
+const testDocument = `{
+	"name": "x",
+	"a.b": 3,
+	"none": null,
+	"one": {"k": "v"},
+	"items": [
+		{"id": 1, "ok": true, "tags": ["a", "b"]},
+		{"id": 2, "ok": false, "tags": []}
+	]
+}`
+
+func decodeDocument(t *testing.T) any {
+	t.Helper()
+	var document any
+	if err := json.Unmarshal([]byte(testDocument), &document); err != nil {
+		t.Fatal(err)
+	}
+	return document
+}
+
+func TestFindJSONPath(t *testing.T) {
+	document := decodeDocument(t)
+	tests := []struct {
+		path string
+		want []any
+	}{
+		{"$", []any{document}},
+		{"$.name", []any{"x"}},
+		{"$['name']", []any{"x"}},
+		{`$["name"]`, []any{"x"}},
+		{"$['a.b']", []any{3.0}},
+		{"$.none", []any{nil}},
+		{"$.one.*", []any{"v"}},
+		{"$.one[*]", []any{"v"}},
+		{"$.items[0].id", []any{1.0}},
+		{"$.items[-1].id", []any{2.0}},
+		{"$.items[*].id", []any{1.0, 2.0}},
+		{"$.items[*].tags[*]", []any{"a", "b"}},
+		{"$.items[*]['tags'][0]", []any{"a"}},
+		// Selectors which don't fit the value find nothing
+		{"$.missing", nil},
+		{"$.items[2]", nil},
+		{"$.items[-3]", nil},
+		{"$.items.id", nil},
+		{"$.name[0]", nil},
+		{"$.one[0]", nil},
+		{"$.name.*", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			steps, err := parseJSONPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := findJSONPath(document, steps)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("found %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMalformedJSONPath(t *testing.T) {
+	for _, path := range []string{
+		"",
+		"name",
+		".name",
+		"$.",
+		"$..name",
+		"$.name.",
+		"$[",
+		"$[0",
+		"$[]",
+		"$[name]",
+		"$['name]",
+		"$[1.5]",
+		"$name",
+		"$.items[0]id",
+	} {
+		t.Run(path, func(t *testing.T) {
+			if steps, err := parseJSONPath(path); err == nil {
+				t.Fatalf("parsed %+v from a malformed path", steps)
+			}
+		})
+	}
+}
+
+func TestBodyAssertion(t *testing.T) {
+	document := decodeDocument(t)
+	tests := []struct {
+		name      string
+		assertion config.BodyAssertion
+		ok        bool
+	}{
+		{"found", config.BodyAssertion{Path: "$.name"}, true},
+		{"null is found", config.BodyAssertion{Path: "$.none"}, true},
+		{"nothing is found", config.BodyAssertion{Path: "$.missing"}, false},
+		{
+			"equal string",
+			config.BodyAssertion{Path: "$.name", Equals: "x"},
+			true,
+		},
+		{
+			// Integers decoded from YAML are equal to JSON numbers
+			"equal number",
+			config.BodyAssertion{Path: "$.items[0].id", Equals: 1},
+			true,
+		},
+		{
+			"equal object",
+			config.BodyAssertion{
+				Path:   "$.one",
+				Equals: map[string]any{"k": "v"},
+			},
+			true,
+		},
+		{
+			"unequal value",
+			config.BodyAssertion{Path: "$.name", Equals: "y"},
+			false,
+		},
+		{
+			"every value is equal",
+			config.BodyAssertion{Path: "$.items[*].tags", Equals: []any{}},
+			false,
+		},
+		{
+			"matching string",
+			config.BodyAssertion{Path: "$.name", Matches: "^x$"},
+			true,
+		},
+		{
+			"matching number",
+			config.BodyAssertion{Path: "$['a.b']", Matches: "^3$"},
+			true,
+		},
+		{
+			"matching boolean",
+			config.BodyAssertion{Path: "$.items[0].ok", Matches: "^true$"},
+			true,
+		},
+		{
+			"every value matches",
+			config.BodyAssertion{Path: "$.items[*].ok", Matches: "^true$"},
+			false,
+		},
+		{
+			"absent",
+			config.BodyAssertion{Path: "$.missing", Absent: true},
+			true,
+		},
+		{
+			"present",
+			config.BodyAssertion{Path: "$.items[*].id", Absent: true},
+			false,
+		},
+		{
+			"present null",
+			config.BodyAssertion{Path: "$.none", Absent: true},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertion, err := newBodyAssertion(tt.assertion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = assertion.check(document)
+			if tt.ok && err != nil {
+				t.Fatalf("assertion fails: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("assertion passes")
+			}
+		})
+	}
+}
+
+func TestInvalidBodyAssertions(t *testing.T) {
+	for _, assertion := range []config.BodyAssertion{
+		{Path: "$.["},
+		{Path: "$.name", Matches: "("},
+		{Path: "$.name", Equals: func() {}},
+	} {
+		_, err := newResponseValidator(config.ValidationConfig{
+			Assertions: []config.BodyAssertion{assertion},
+		})
+		if err == nil {
+			t.Fatalf("assertion %+v is accepted", assertion)
+		}
+	}
+}
@@ -3,14 +3,18 @@ package barash
 import (
 	"context"
 	"errors"
+	"io"
 	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 func (r *Runner[S, R, P, Q]) startWriter(
 	wg *sync.WaitGroup,
-	resultsCh chan S,
+	resultsCh chan taskResult[S],
 ) {
 	wg.Go(func() {
 		r.writer(resultsCh)
@@ -18,9 +22,13 @@ func (r *Runner[S, R, P, Q]) startWriter(
 }
 
 func (r *Runner[S, R, P, Q]) writer(
-	resultsCh chan S,
+	resultsCh chan taskResult[S],
 ) {
 	var batch []S
+	// Parameters of the tasks, one for every result in the batch
+	var params []any
+	// Source batches of the tasks whose results are in the batch
+	var tasks []uint64
 
 	innerCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -28,16 +36,24 @@ func (r *Runner[S, R, P, Q]) writer(
 	saveBatch := func() {
 		ctx, cancel := context.WithTimeout(
 			innerCtx,
-			r.cfg.Shutdown.DBSaveTimeout,
+			r.config().Shutdown.DBSaveTimeout,
 		)
 		defer cancel()
-		err := r.write(ctx, batch)
+		err := r.write(ctx, batch, params)
 		// TODO(nrydanov): Add reaction based on error returned
 		// For example, if connection is dropped, we need to automatically
 		// restore session
 		// Source: https://github.com/kiltia/runner/issues/15
 		if err == nil {
 			batch = *new([]S)
+			params = nil
+			for _, seq := range tasks {
+				if onComplete := r.tracker.done(seq); onComplete != nil {
+					onComplete()
+				}
+			}
+			tasks = tasks[:0]
+			r.commitProgress(ctx)
 		} else {
 			zap.S().Errorw(
 				"saving processed batch to the database",
@@ -49,9 +65,13 @@ func (r *Runner[S, R, P, Q]) writer(
 	for result := range resultsCh {
 		batch = append(
 			batch,
-			result,
+			result.values...,
 		)
-		if len(batch) >= r.cfg.Writer.InsertBatchSize {
+		for range result.values {
+			params = append(params, result.params)
+		}
+		tasks = append(tasks, result.batch)
+		if len(batch) >= r.config().Writer.InsertBatchSize {
 			zap.S().Infow(
 				"have enough results, saving to the database",
 			)
@@ -62,24 +82,50 @@ func (r *Runner[S, R, P, Q]) writer(
 	zap.S().
 		Infow("all results processed, saving the rest to the database and exiting")
 	saveBatch()
+	r.closeSinks()
+}
+
+// closeSinks releases sinks which hold resources, such as open files.
+func (r *Runner[S, R, P, Q]) closeSinks() {
+	for _, sink := range r.sinks {
+		closer, ok := sink.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			zap.S().Errorw("closing sink", "error", err)
+		}
+	}
 }
 
 // Writes a non-empty batch to the database.
 func (r *Runner[S, R, P, Q]) write(
 	ctx context.Context,
 	batch []S,
+	params []any,
 ) (err error) {
+	ctx, span := r.tracer.Start(
+		ctx,
+		"insert batch",
+		trace.WithAttributes(attribute.Int("barash.batch_len", len(batch))),
+	)
+	defer func() { endSpan(span, err) }()
 	logger := zap.S().
 		With("batch_len", len(batch))
 	logger.Debugw(
 		"saving processed batch to the database",
 	)
 	var errs []error
-	for _, sink := range r.sinks {
-		errs = append(errs, sink.InsertBatch(
-			ctx,
-			batch,
-		))
+	for i, sink := range r.sinks {
+		start := time.Now()
+		var err error
+		if taskSink, ok := sink.(TaskSink[S]); ok {
+			err = taskSink.InsertTaskBatch(ctx, batch, params)
+		} else {
+			err = sink.InsertBatch(ctx, batch)
+		}
+		r.stats.recordInsert(i, len(batch), time.Since(start), err)
+		errs = append(errs, err)
 	}
 
 	logger.Infow(